@@ -0,0 +1,173 @@
+// redislb 是服务注册表的命令行工具，用于值班时查看服务和节点、订阅节点变更事件和强制移除僵尸节点
+//
+//	redislb [flags] services
+//	redislb [flags] nodes <service>
+//	redislb [flags] watch [service...]
+//	redislb [flags] evict <service> <id>
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/play/play/pkg/redislb"
+	"github.com/redis/go-redis/v9"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:6379", "redis address, multiple addresses separated by commas for redis cluster")
+	password := flag.String("password", os.Getenv("REDIS_PASSWORD"), "redis password, defaults to $REDIS_PASSWORD")
+	db := flag.Int("db", 0, "redis database")
+	asJSON := flag.Bool("json", false, "print output as json")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [flags] <command> [args]
+
+Commands:
+  services               list registered services
+  nodes <service>        list nodes of a service with their TTLs
+  watch [service...]     stream node change events, all services by default
+  evict <service> <id>   force-deregister a node
+
+Flags:
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	rdb := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:    strings.Split(*addr, ","),
+		Password: *password,
+		DB:       *db,
+	})
+	defer rdb.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	c := &cli{admin: redislb.NewAdmin(rdb), json: *asJSON}
+	if err := c.run(ctx, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		if errors.Is(err, errUsage) {
+			flag.Usage()
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("invalid arguments")
+
+type cli struct {
+	admin *redislb.Admin
+	json  bool
+}
+
+func (c *cli) run(ctx context.Context, cmd string, args []string) error {
+	switch cmd {
+	case "services":
+		return c.services(ctx)
+	case "nodes":
+		if len(args) != 1 {
+			return errUsage
+		}
+		return c.nodes(ctx, args[0])
+	case "watch":
+		return c.watch(ctx, args)
+	case "evict":
+		if len(args) != 2 {
+			return errUsage
+		}
+		if err := c.admin.Evict(ctx, args[0], args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("evicted %s/%s\n", args[0], args[1])
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown command %q", errUsage, cmd)
+	}
+}
+
+func (c *cli) services(ctx context.Context) error {
+	services, err := c.admin.Services(ctx)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(services)
+	}
+	for _, service := range services {
+		fmt.Println(service)
+	}
+	return nil
+}
+
+func (c *cli) nodes(ctx context.Context, service string) error {
+	nodes, err := c.admin.Nodes(ctx, service)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(nodes)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tVERSION\tSTATE\tTTL\tENDPOINTS\tMETADATA")
+	for _, n := range nodes {
+		ttl := n.TTL.Truncate(time.Millisecond).String()
+		if n.Expired {
+			ttl = "expired"
+		}
+		if n.Node == nil {
+			fmt.Fprintf(w, "%s\t-\tmissing\t%s\t-\t-\n", n.Id, ttl)
+			continue
+		}
+		state := n.Node.State
+		if state == "" {
+			state = "serving"
+		}
+		metadata := make([]string, 0, len(n.Node.Metadata))
+		for k, v := range n.Node.Metadata {
+			metadata = append(metadata, k+"="+v)
+		}
+		slices.Sort(metadata)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", n.Id, n.Node.Version, state, ttl,
+			strings.Join(n.Node.GetEndpoints(), ","), strings.Join(metadata, ","))
+	}
+	return w.Flush()
+}
+
+func (c *cli) watch(ctx context.Context, services []string) error {
+	events, err := c.admin.Watch(ctx, services...)
+	if err != nil {
+		return err
+	}
+	for event := range events {
+		if c.json {
+			if err := printJSON(event); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n", time.Now().Format(time.RFC3339), event.Type, event.Service, event.Id)
+	}
+	return nil
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -29,10 +29,17 @@ func (u URL) MarshalText() ([]byte, error) {
 	return []byte(u.String()), nil
 }
 
+// 节点状态
+const (
+	NodeStateServing  = "serving"  // 正常提供服务，为空时等同于 serving
+	NodeStateDraining = "draining" // 即将下线，仍然可以处理已有的请求，但不再接收新的请求
+)
+
 type NodeInfo struct {
 	Id        string            `json:"id"` // 唯一性
 	Name      string            `json:"name"`
 	Version   string            `json:"version"`
+	State     string            `json:"state,omitempty"`
 	Metadata  map[string]string `json:"metadata"`
 	Endpoints []URL             `json:"endpoints"`
 }
@@ -55,21 +62,34 @@ func (n *NodeInfo) AddMetadata(key, value string) *NodeInfo {
 	return n
 }
 
-// AddHttPort 添加http端点
+// AddHttPort 为内网 IPv4 地址 IpAddr 添加http端点
 func (n *NodeInfo) AddHttpPort(port string) *NodeInfo {
-	var nurl url.URL
-	nurl.Scheme = "http"
-	nurl.Host = net.JoinHostPort(IpAddr, port)
-	n.Endpoints = append(n.Endpoints, (URL)(nurl))
-	return n
+	return n.AddEndpoint("http", net.JoinHostPort(IpAddr, port))
 }
 
-// AddGrpcPort 添加grpc端点
+// AddGrpcPort 为内网 IPv4 地址 IpAddr 添加grpc端点
 func (n *NodeInfo) AddGrpcPort(port string) *NodeInfo {
-	var nurl url.URL
-	nurl.Scheme = "grpc"
-	nurl.Host = net.JoinHostPort(IpAddr, port)
-	n.Endpoints = append(n.Endpoints, (URL)(nurl))
+	return n.AddEndpoint("grpc", net.JoinHostPort(IpAddr, port))
+}
+
+// AddEndpoints 为 IpAddrs 中的每个地址添加端点，包括 IPv6 和公网地址，没有可用的IP地址时使用主机名
+// 需要发布内网 IPv4 以外的地址时使用，解析器按 redislb.WithAddressPolicy 为每个节点选择端点
+// 旧版本的解析器会将每个端点作为一个独立的节点，所有客户端升级前不要使用
+func (n *NodeInfo) AddEndpoints(scheme, port string) *NodeInfo {
+	hosts := IpAddrs
+	if len(hosts) == 0 {
+		hosts = []string{Hostname}
+	}
+	for _, host := range hosts {
+		n.AddEndpoint(scheme, net.JoinHostPort(host, port))
+	}
+	return n
+}
+
+// AddEndpoint 添加端点，host 为 host:port 格式，host 可以是 IPv4、IPv6 或域名
+// 同一协议的多个端点按添加顺序表示节点自身的优先级
+func (n *NodeInfo) AddEndpoint(scheme, host string) *NodeInfo {
+	n.Endpoints = append(n.Endpoints, URL{Scheme: scheme, Host: host})
 	return n
 }
 
@@ -85,11 +105,22 @@ func (n *NodeInfo) AddId(id string) *NodeInfo {
 	return n
 }
 
-// Key 获取键
+// Key 获取键，服务名使用 hash tag，保证同一服务的键在 Redis Cluster 的同一个槽中
 func (n *NodeInfo) Key() string {
+	return fmt.Sprintf("services:{%s}:%s", n.Name, n.Id)
+}
+
+// LegacyKey 获取旧版本的节点键，旧版本的解析器通过 KEYS "services:<name>:*" 查找节点
+// 仅用于滚动升级期间兼容旧版本的解析器，下一个版本移除
+func (n *NodeInfo) LegacyKey() string {
 	return fmt.Sprintf("services:%s:%s", n.Name, n.Id)
 }
 
+// IndexKey 获取服务的节点索引键，ZSET 成员为节点ID，分数为过期时间（Unix 毫秒）
+func (n *NodeInfo) IndexKey() string {
+	return fmt.Sprintf("services:{%s}", n.Name)
+}
+
 // Value 获取值
 func (n *NodeInfo) Value() string {
 	value, _ := json.Marshal(n)
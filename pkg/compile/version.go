@@ -5,6 +5,7 @@ import (
 	"net"
 	"os"
 	"runtime"
+	"slices"
 
 	"github.com/rs/zerolog/log"
 )
@@ -13,7 +14,8 @@ var (
 	Name     = "" // 项目名
 	Id       = "" // 项目ID, Hostname.Name
 	Hostname = ""
-	IpAddr   = "" // 内网IP地址
+	IpAddr   = ""         // 内网 IPv4 地址，没有时为空
+	IpAddrs  = []string{} // 所有网卡的IP地址，按内网 IPv4、内网 IPv6、公网 IPv4、公网 IPv6 排序，不包括回环和链路本地地址
 
 	Version   = ""
 	GoVersion = runtime.Version()
@@ -27,20 +29,59 @@ func init() {
 	GoVersion = runtime.Version()
 
 	Hostname, _ = os.Hostname()
-	addrs, _ := net.InterfaceAddrs()
 	Id = fmt.Sprintf("%s.%s", Hostname, Name)
 
-	// 获取内网IP地址
+	addrs, _ := net.InterfaceAddrs()
+	IpAddrs = interfaceIps(addrs)
+	IpAddr = privateIPv4(IpAddrs)
+
+	Node.AddId(Id).AddName(Name).AddVersion(Version)
+}
+
+// interfaceIps 返回网卡地址中可以对外提供服务的IP地址，按优先级排序
+func interfaceIps(addrs []net.Addr) []string {
+	rank := func(ip net.IP) int {
+		switch {
+		case ip.IsPrivate() && ip.To4() != nil:
+			return 0
+		case ip.IsPrivate():
+			return 1
+		case ip.To4() != nil:
+			return 2
+		default:
+			return 3
+		}
+	}
+
+	var ips []net.IP
 	for _, address := range addrs {
-		if ipnet, ok := address.(*net.IPNet); ok && ipnet.IP.IsPrivate() {
-			if ipnet.IP.To4() != nil {
-				IpAddr = ipnet.IP.String()
-				break
-			}
+		ipnet, ok := address.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipnet.IP
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsUnspecified() {
+			continue
 		}
+		ips = append(ips, ip)
 	}
+	slices.SortStableFunc(ips, func(a, b net.IP) int { return rank(a) - rank(b) })
 
-	Node.AddId(Id).AddName(Name).AddVersion(Version)
+	result := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		result = append(result, ip.String())
+	}
+	return result
+}
+
+// privateIPv4 返回 ips 中第一个内网 IPv4 地址，没有时返回空
+func privateIPv4(ips []string) string {
+	for _, s := range ips {
+		if ip := net.ParseIP(s); ip != nil && ip.IsPrivate() && ip.To4() != nil {
+			return s
+		}
+	}
+	return ""
 }
 
 func Os() string {
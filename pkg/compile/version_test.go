@@ -0,0 +1,43 @@
+package compile
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+// TestInterfaceIps 验证排除回环、链路本地等地址，并按内网 IPv4、内网 IPv6、公网 IPv4、公网 IPv6 排序
+func TestInterfaceIps(t *testing.T) {
+	ipNet := func(s string) net.Addr {
+		return &net.IPNet{IP: net.ParseIP(s)}
+	}
+	addrs := []net.Addr{
+		ipNet("127.0.0.1"),
+		ipNet("::1"),
+		ipNet("fe80::1"),
+		ipNet("169.254.0.1"),
+		ipNet("2001:db8::1"),
+		ipNet("8.8.8.8"),
+		ipNet("fd00::1"),
+		ipNet("192.168.1.2"),
+		ipNet("10.0.0.1"),
+		&net.IPAddr{IP: net.ParseIP("10.0.0.2")},
+	}
+	expected := []string{"192.168.1.2", "10.0.0.1", "fd00::1", "8.8.8.8", "2001:db8::1"}
+	if ips := interfaceIps(addrs); !slices.Equal(ips, expected) {
+		t.Fatalf("expected %v, got %v", expected, ips)
+	}
+	if ips := interfaceIps(nil); len(ips) != 0 {
+		t.Fatalf("expected no ips, got %v", ips)
+	}
+}
+
+// TestPrivateIPv4 验证 IpAddr 只使用内网 IPv4 地址
+func TestPrivateIPv4(t *testing.T) {
+	if ip := privateIPv4([]string{"10.0.0.1", "fd00::1"}); ip != "10.0.0.1" {
+		t.Fatalf("expected 10.0.0.1, got %q", ip)
+	}
+	if ip := privateIPv4([]string{"fd00::1", "8.8.8.8", "2001:db8::1"}); ip != "" {
+		t.Fatalf("expected no address, got %q", ip)
+	}
+}
@@ -98,6 +98,12 @@ func (m *Meta) Context() (ctx context.Context) {
 	return context.WithValue(m.ctx, metadataKey{}, m)
 }
 
+// Load 从 context.Context 中获取 Meta，不存在时返回 false
+func Load(ctx context.Context) (m *Meta, ok bool) {
+	m, ok = ctx.Value(metadataKey{}).(*Meta)
+	return
+}
+
 // Get 从 context.Context 中获取指定 key 的元数据
 // 如果不存在则返回零值
 func Get[T any](ctx context.Context, key string) (value T) {
@@ -0,0 +1,230 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Backend 是 PubSub 的存储后端
+// 队列（Push/Pop/Len）用于 Publish/Subscribe 的竞争消费，广播（Broadcast/Listen）用于 Broadcast/SubscribeBroadcast
+type Backend interface {
+	// Push 按溢出策略原子性地将消息写入队列尾部，queueSize <= 0 表示不限制，返回写入和丢弃的数量以及写入后的队列长度
+	// OverflowBlock 与 OverflowReject 行为相同，由 PubSub 负责重试
+	Push(ctx context.Context, key string, payloads [][]byte, queueSize int, policy OverflowPolicy) (pushed, dropped, length int64, err error)
+	// Pop 从队列头部最多取出 n 条消息，队列为空时最多阻塞 timeout，超时返回空列表
+	Pop(ctx context.Context, key string, n int, timeout time.Duration) ([][]byte, error)
+	// Len 返回队列长度
+	Len(ctx context.Context, key string) (int64, error)
+	// Broadcast 将消息发送给 channel 的所有监听者，不会因为监听者处理慢而阻塞
+	// 返回因监听者缓冲已满而丢弃的消息数（每个监听者分别计数）
+	Broadcast(ctx context.Context, channel string, payloads [][]byte) (dropped int64, err error)
+	// Listen 监听 channel，返回时监听已经生效
+	Listen(ctx context.Context, channel string) (Listener, error)
+	// Claim 获取或续期 key 的租约，租约空闲或已由 owner 持有时成功并将有效期设为 ttl
+	Claim(ctx context.Context, key, owner string, ttl time.Duration) (bool, error)
+	// Release 释放 owner 持有的租约，不是 owner 持有时不做任何操作
+	Release(ctx context.Context, key, owner string) error
+}
+
+// Listener 是广播 channel 的监听者
+type Listener interface {
+	// Receive 阻塞等待下一条消息，ctx 取消或 Close 后返回错误
+	Receive(ctx context.Context) ([]byte, error)
+	Close() error
+}
+
+// broadcastSubscriber 是支持 Redis SUBSCRIBE 的客户端
+// *redis.Client、*redis.ClusterClient 和 redis.UniversalClient 都满足该接口，redis.Pipeliner 等则不满足
+type broadcastSubscriber interface {
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+}
+
+// pushScript 原子性地检查队列长度并按溢出策略写入消息
+// KEYS[1]: List 键
+// ARGV[1]: 队列大小限制，<= 0 表示不限制
+// ARGV[2]: 溢出策略，block 在脚本中与 reject 相同，由调用方重试
+// ARGV[3...]: 消息
+// 返回 {写入数量, 丢弃数量, 写入后的队列长度}
+var pushScript = redis.NewScript(`
+local size = tonumber(ARGV[1])
+local policy = ARGV[2]
+local total = #ARGV - 2
+
+local function push(from, to)
+    for i = from, to, 1000 do
+        redis.call("RPUSH", KEYS[1], unpack(ARGV, i, math.min(i + 999, to)))
+    end
+end
+
+local function result(pushed, dropped)
+    return {pushed, dropped, redis.call("LLEN", KEYS[1])}
+end
+
+if size <= 0 then
+    push(3, #ARGV)
+    return result(total, 0)
+end
+
+local length = redis.call("LLEN", KEYS[1])
+if length + total <= size then
+    push(3, #ARGV)
+    return result(total, 0)
+end
+
+if policy == "drop_oldest" then
+    push(3, #ARGV)
+    local overflow = length + total - size
+    redis.call("LTRIM", KEYS[1], overflow, -1)
+    return result(total, overflow)
+end
+
+if policy == "drop_newest" then
+    local free = size - length
+    if free <= 0 then
+        return result(0, total)
+    end
+    push(3, 2 + free)
+    return result(free, total - free)
+end
+
+return result(0, total)
+`)
+
+// claimScript 获取或续期租约
+// KEYS[1]: 租约键
+// ARGV[1]: 持有者
+// ARGV[2]: 有效期，毫秒
+var claimScript = redis.NewScript(`
+local owner = redis.call("GET", KEYS[1])
+if owner == false or owner == ARGV[1] then
+    redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+    return 1
+end
+return 0
+`)
+
+// releaseScript 释放自己持有的租约
+// KEYS[1]: 租约键
+// ARGV[1]: 持有者
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+    return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+var _ Backend = (*RedisBackend)(nil)
+
+// RedisBackend 基于 Redis List 和 PUBLISH/SUBSCRIBE 的后端
+type RedisBackend struct {
+	rdb redis.Cmdable
+}
+
+// NewRedisBackend 创建 Redis 后端
+func NewRedisBackend(rdb redis.Cmdable) *RedisBackend {
+	return &RedisBackend{rdb: rdb}
+}
+
+func (b *RedisBackend) Push(ctx context.Context, key string, payloads [][]byte, queueSize int, policy OverflowPolicy) (pushed, dropped, length int64, err error) {
+	args := make([]any, 0, len(payloads)+2)
+	args = append(args, queueSize, string(policy))
+	for _, payload := range payloads {
+		args = append(args, payload)
+	}
+
+	result, err := pushScript.Run(ctx, b.rdb, []string{key}, args...).Int64Slice()
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("redis push script failed: %w", err)
+	}
+	return result[0], result[1], result[2], nil
+}
+
+func (b *RedisBackend) Pop(ctx context.Context, key string, n int, timeout time.Duration) ([][]byte, error) {
+	// BLMPop 从 Redis list 中批量阻塞弹出元素
+	_, values, err := b.rdb.BLMPop(ctx, timeout, "left", int64(n), key).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	payloads := make([][]byte, 0, len(values))
+	for _, value := range values {
+		payloads = append(payloads, []byte(value))
+	}
+	return payloads, nil
+}
+
+func (b *RedisBackend) Len(ctx context.Context, key string) (int64, error) {
+	length, err := b.rdb.LLen(ctx, key).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, fmt.Errorf("redis LLen failed: %w", err)
+	}
+	return length, nil
+}
+
+// Broadcast 的丢弃由 Redis 的 client-output-buffer-limit 控制，这里无法感知，总是返回 0
+func (b *RedisBackend) Broadcast(ctx context.Context, channel string, payloads [][]byte) (int64, error) {
+	_, err := b.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, payload := range payloads {
+			pipe.Publish(ctx, channel, payload)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("redis PUBLISH failed: %w", err)
+	}
+	return 0, nil
+}
+
+func (b *RedisBackend) Listen(ctx context.Context, channel string) (Listener, error) {
+	subscriber, ok := b.rdb.(broadcastSubscriber)
+	if !ok {
+		return nil, ErrBroadcastNotSupported
+	}
+
+	ps := subscriber.Subscribe(ctx, channel)
+	// 等待订阅确认，确保返回后发布的消息不会丢失
+	if _, err := ps.Receive(ctx); err != nil {
+		_ = ps.Close()
+		return nil, fmt.Errorf("redis SUBSCRIBE failed: %w", err)
+	}
+	return &redisListener{ps: ps}, nil
+}
+
+func (b *RedisBackend) Claim(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	claimed, err := claimScript.Run(ctx, b.rdb, []string{key}, owner, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("redis claim script failed: %w", err)
+	}
+	return claimed == 1, nil
+}
+
+func (b *RedisBackend) Release(ctx context.Context, key, owner string) error {
+	if err := releaseScript.Run(ctx, b.rdb, []string{key}, owner).Err(); err != nil {
+		return fmt.Errorf("redis release script failed: %w", err)
+	}
+	return nil
+}
+
+// redisListener 包装 *redis.PubSub
+type redisListener struct {
+	ps *redis.PubSub
+}
+
+func (l *redisListener) Receive(ctx context.Context) ([]byte, error) {
+	msg, err := l.ps.ReceiveMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(msg.Payload), nil
+}
+
+func (l *redisListener) Close() error {
+	return l.ps.Close()
+}
@@ -0,0 +1,257 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"github.com/play/play/pkg/meta"
+	"github.com/tidwall/gjson"
+	"google.golang.org/grpc/metadata"
+)
+
+// 消息头中的保留 key
+const (
+	HeaderMessageId   = "x-pubsub-message-id"   // 消息ID
+	HeaderPublishedAt = "x-pubsub-published-at" // 发布时间，Unix 毫秒
+	HeaderDeadline    = "x-pubsub-deadline"     // 发布方 context 的截止时间，Unix 毫秒，仅在 WithDeadlinePropagation 时写入
+	HeaderKey         = "x-pubsub-key"          // 分区键，相同键的消息按顺序处理
+)
+
+// defaultMetaKeys 默认随消息传递的 meta key
+var defaultMetaKeys = []string{
+	meta.MetaUserId,
+	meta.MetaUserType,
+	meta.MetaUserIp,
+	meta.MetaUserCountry,
+	meta.MetaDeviceId,
+	meta.MetaPlatform,
+	meta.MetaLanguage,
+	meta.MetaVersion,
+}
+
+// Propagator 在消息头中注入和提取链路追踪等上下文
+// 可以用 OpenTelemetry 的 TextMapPropagator 配合 MapCarrier 简单适配
+type Propagator interface {
+	Inject(ctx context.Context, headers map[string]string)
+	Extract(ctx context.Context, headers map[string]string) context.Context
+}
+
+// envelope 是反射订阅使用的带消息头的 JSON 消息格式，开启 WithHeaders 或发布带分区键的消息时写入
+// 未开启时消息仍为纯 JSON 数组，与旧版本的订阅方兼容；两种格式在消费时都被接受
+type envelope struct {
+	Headers map[string]string `json:"headers"`
+	Args    json.RawMessage   `json:"args,omitempty"` // 反射订阅的参数，JSON 数组
+}
+
+// frameMagic 是 Topic 二进制消息帧的前缀，JSON 格式的消息不会以 0x00 开头
+// 帧格式：frameMagic | uvarint(消息头长度) | 消息头 JSON | 编码后的消息体
+// 消息体保持编解码器的原始字节，不会像 JSON envelope 那样被 base64 膨胀
+var frameMagic = []byte{0x00, 'p', 's', 0x01}
+
+type headersKey struct{}
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// WithHeaders 开启反射订阅消息的消息头，消息ID、发布时间、meta 和链路追踪上下文随消息传递
+// 开启后 Publish 和 Broadcast 写入 JSON envelope，旧版本的订阅方无法解析并会丢弃这些消息
+// 滚动升级时先升级所有订阅方，再在发布方开启；Topic 的消息总是带有消息头
+func WithHeaders() Option {
+	return func(o any) {
+		if ps, ok := o.(*PubSub); ok {
+			ps.headers = true
+		}
+	}
+}
+
+// WithPropagator 设置链路追踪上下文的传播器，同时开启 WithHeaders
+func WithPropagator(pp Propagator) Option {
+	return func(o any) {
+		if ps, ok := o.(*PubSub); ok {
+			ps.propagator = pp
+			ps.headers = true
+		}
+	}
+}
+
+// WithDeadlinePropagation 开启截止时间传递，同时开启 WithHeaders
+// 开启后发布方 ctx 的截止时间会写入消息头，处理函数的 ctx 使用相同的截止时间
+// 消息在队列中积压时可能在处理前就已经过期，因此默认关闭
+func WithDeadlinePropagation() Option {
+	return func(o any) {
+		if ps, ok := o.(*PubSub); ok {
+			ps.propagateDeadline = true
+			ps.headers = true
+		}
+	}
+}
+
+// WithMetaKeys 设置随消息传递的 meta key，替换默认列表
+func WithMetaKeys(keys ...string) Option {
+	return func(o any) {
+		if ps, ok := o.(*PubSub); ok {
+			ps.metaKeys = keys
+		}
+	}
+}
+
+// Headers 返回处理函数 context 中的消息头
+func Headers(ctx context.Context) map[string]string {
+	headers, _ := ctx.Value(headersKey{}).(map[string]string)
+	return headers
+}
+
+// MessageId 返回处理函数 context 中的消息ID
+func MessageId(ctx context.Context) string {
+	return Headers(ctx)[HeaderMessageId]
+}
+
+// Key 返回处理函数 context 中消息的分区键
+func Key(ctx context.Context) string {
+	return Headers(ctx)[HeaderKey]
+}
+
+// PublishedAt 返回处理函数 context 中的消息发布时间
+func PublishedAt(ctx context.Context) time.Time {
+	ms, err := strconv.ParseInt(Headers(ctx)[HeaderPublishedAt], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// newHeaders 根据发布方的 context 和分区键构建消息头
+func (p *PubSub) newHeaders(ctx context.Context, key string) map[string]string {
+	headers := map[string]string{
+		HeaderMessageId:   uuid.NewString(),
+		HeaderPublishedAt: strconv.FormatInt(time.Now().UnixMilli(), 10),
+	}
+	if key != "" {
+		headers[HeaderKey] = key
+	}
+	if deadline, ok := ctx.Deadline(); ok && p.propagateDeadline {
+		headers[HeaderDeadline] = strconv.FormatInt(deadline.UnixMilli(), 10)
+	}
+	if m, ok := meta.Load(ctx); ok {
+		for _, key := range p.metaKeys {
+			if value := m.GetString(key); value != "" {
+				headers[key] = value
+			}
+		}
+	}
+	if p.propagator != nil {
+		p.propagator.Inject(ctx, headers)
+	}
+	return headers
+}
+
+// encodeEnvelope 将消息头和反射订阅的参数编码为 JSON envelope
+func encodeEnvelope(headers map[string]string, args json.RawMessage) ([]byte, error) {
+	return json.Marshal(&envelope{Headers: headers, Args: args})
+}
+
+// encodeFrame 将消息头和 Topic 编码后的消息体编码为二进制消息帧
+func encodeFrame(headers map[string]string, body []byte) ([]byte, error) {
+	rawHeaders, err := json.Marshal(headers)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, 0, len(frameMagic)+binary.MaxVarintLen64+len(rawHeaders)+len(body))
+	frame = append(frame, frameMagic...)
+	frame = binary.AppendUvarint(frame, uint64(len(rawHeaders)))
+	frame = append(frame, rawHeaders...)
+	return append(frame, body...), nil
+}
+
+// splitFrame 拆分二进制消息帧，返回消息头 JSON 和消息体
+func splitFrame(payload []byte) (rawHeaders, body []byte, ok bool) {
+	if !bytes.HasPrefix(payload, frameMagic) {
+		return nil, nil, false
+	}
+	rest := payload[len(frameMagic):]
+	n, size := binary.Uvarint(rest)
+	if size <= 0 || n > uint64(len(rest)-size) {
+		return nil, nil, false
+	}
+	rest = rest[size:]
+	return rest[:n], rest[n:], true
+}
+
+// decodeEnvelope 解析 payload，返回消息头和参数（或消息体）
+// 支持 Topic 的二进制消息帧和 JSON envelope
+// 不是这两种格式的旧消息，整个 payload 作为参数返回，消息头为空
+func decodeEnvelope(payload []byte) (map[string]string, []byte) {
+	if rawHeaders, body, ok := splitFrame(payload); ok {
+		var headers map[string]string
+		if err := json.Unmarshal(rawHeaders, &headers); err != nil {
+			return nil, payload
+		}
+		return headers, body
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(payload), []byte("{")) {
+		return nil, payload
+	}
+	var env envelope
+	if err := json.Unmarshal(payload, &env); err != nil || env.Headers == nil {
+		return nil, payload
+	}
+	return env.Headers, env.Args
+}
+
+// partitionKey 在不完整解析 payload 的情况下读取分区键
+func partitionKey(payload []byte) string {
+	if rawHeaders, _, ok := splitFrame(payload); ok {
+		return gjson.GetBytes(rawHeaders, HeaderKey).String()
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(payload), []byte("{")) {
+		return ""
+	}
+	return gjson.GetBytes(payload, "headers."+HeaderKey).String()
+}
+
+// partitionIndex 返回分区键对应的 worker 下标
+func partitionIndex(key string, n int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// messageContext 根据消息头构建处理函数使用的 context
+// 返回的 cancel 必须在处理完成后调用
+func (s *Subscription) messageContext(headers map[string]string) (context.Context, context.CancelFunc) {
+	ctx := s.ctx
+	if len(headers) == 0 {
+		return ctx, func() {}
+	}
+
+	ctx = context.WithValue(ctx, headersKey{}, headers)
+
+	// 还原 meta，保持与 gRPC 入口一致的构建方式
+	md := metadata.MD{}
+	for _, key := range s.pubSub.metaKeys {
+		if value, ok := headers[key]; ok {
+			md.Set(key, value)
+		}
+	}
+	if md.Len() > 0 {
+		ctx = meta.FromContext(metadata.NewIncomingContext(ctx, md)).Context()
+	}
+
+	if s.pubSub.propagator != nil {
+		ctx = s.pubSub.propagator.Extract(ctx, headers)
+	}
+
+	if !s.pubSub.propagateDeadline {
+		return ctx, func() {}
+	}
+	if ms, err := strconv.ParseInt(headers[HeaderDeadline], 10, 64); err == nil {
+		return context.WithDeadline(ctx, time.UnixMilli(ms))
+	}
+	return ctx, func() {}
+}
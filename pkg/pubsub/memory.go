@@ -0,0 +1,211 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var _ Backend = (*MemoryBackend)(nil)
+
+// MemoryBackend 是进程内的后端，用于测试和单节点部署
+// 队列大小、溢出策略、批量获取和广播的行为与 RedisBackend 一致，消息不会持久化
+type MemoryBackend struct {
+	mu        sync.Mutex
+	queues    map[string]*memoryQueue
+	listeners map[string]map[*memoryListener]struct{} // key: channel
+	leases    map[string]memoryLease
+}
+
+// memoryLease 是 Claim 获取的租约
+type memoryLease struct {
+	owner    string
+	expireAt time.Time
+}
+
+// memoryQueue 是单个队列，signal 在每次写入后关闭并替换，用于唤醒等待中的 Pop
+type memoryQueue struct {
+	items  [][]byte
+	signal chan struct{}
+}
+
+// NewMemoryBackend 创建进程内后端
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		queues:    make(map[string]*memoryQueue),
+		listeners: make(map[string]map[*memoryListener]struct{}),
+		leases:    make(map[string]memoryLease),
+	}
+}
+
+// queue 获取或创建队列，调用方需持有 b.mu
+func (b *MemoryBackend) queue(key string) *memoryQueue {
+	q, ok := b.queues[key]
+	if !ok {
+		q = &memoryQueue{signal: make(chan struct{})}
+		b.queues[key] = q
+	}
+	return q
+}
+
+func (b *MemoryBackend) Push(_ context.Context, key string, payloads [][]byte, queueSize int, policy OverflowPolicy) (pushed, dropped, length int64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q := b.queue(key)
+	total := len(payloads)
+	switch {
+	case queueSize <= 0 || len(q.items)+total <= queueSize:
+		q.items = append(q.items, payloads...)
+		pushed = int64(total)
+	case policy == OverflowDropOldest:
+		q.items = append(q.items, payloads...)
+		overflow := len(q.items) - queueSize
+		q.items = append([][]byte(nil), q.items[overflow:]...)
+		pushed, dropped = int64(total), int64(overflow)
+	case policy == OverflowDropNewest:
+		free := max(queueSize-len(q.items), 0)
+		q.items = append(q.items, payloads[:free]...)
+		pushed, dropped = int64(free), int64(total-free)
+	default:
+		dropped = int64(total)
+	}
+
+	if pushed > 0 {
+		close(q.signal)
+		q.signal = make(chan struct{})
+	}
+	return pushed, dropped, int64(len(q.items)), nil
+}
+
+func (b *MemoryBackend) Pop(ctx context.Context, key string, n int, timeout time.Duration) ([][]byte, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		b.mu.Lock()
+		q := b.queue(key)
+		if len(q.items) > 0 {
+			n = min(n, len(q.items))
+			payloads := q.items[:n:n]
+			q.items = q.items[n:]
+			b.mu.Unlock()
+			return payloads, nil
+		}
+		signal := q.signal
+		b.mu.Unlock()
+
+		select {
+		case <-signal:
+		case <-timer.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (b *MemoryBackend) Len(_ context.Context, key string) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if q, ok := b.queues[key]; ok {
+		return int64(len(q.items)), nil
+	}
+	return 0, nil
+}
+
+// Broadcast 不等待处理慢的监听者，监听者的缓冲已满时丢弃发给它的消息
+func (b *MemoryBackend) Broadcast(_ context.Context, channel string, payloads [][]byte) (int64, error) {
+	b.mu.Lock()
+	listeners := make([]*memoryListener, 0, len(b.listeners[channel]))
+	for l := range b.listeners[channel] {
+		listeners = append(listeners, l)
+	}
+	b.mu.Unlock()
+
+	var dropped int64
+	for _, l := range listeners {
+		for _, payload := range payloads {
+			select {
+			case l.msgChan <- payload:
+			case <-l.closed:
+			default:
+				dropped++
+			}
+		}
+	}
+	return dropped, nil
+}
+
+func (b *MemoryBackend) Listen(_ context.Context, channel string) (Listener, error) {
+	l := &memoryListener{
+		backend: b,
+		channel: channel,
+		msgChan: make(chan []byte, defaultDataChanSize),
+		closed:  make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	if b.listeners[channel] == nil {
+		b.listeners[channel] = make(map[*memoryListener]struct{})
+	}
+	b.listeners[channel][l] = struct{}{}
+	b.mu.Unlock()
+	return l, nil
+}
+
+func (b *MemoryBackend) Claim(_ context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if lease, ok := b.leases[key]; ok && lease.owner != owner && now.Before(lease.expireAt) {
+		return false, nil
+	}
+	b.leases[key] = memoryLease{owner: owner, expireAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (b *MemoryBackend) Release(_ context.Context, key, owner string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if lease, ok := b.leases[key]; ok && lease.owner == owner {
+		delete(b.leases, key)
+	}
+	return nil
+}
+
+// memoryListener 是 MemoryBackend 的广播监听者
+type memoryListener struct {
+	backend   *MemoryBackend
+	channel   string
+	msgChan   chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memoryListener) Receive(ctx context.Context) ([]byte, error) {
+	select {
+	case payload := <-l.msgChan:
+		return payload, nil
+	case <-l.closed:
+		return nil, ErrSubscriptionClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.backend.mu.Lock()
+		delete(l.backend.listeners[l.channel], l)
+		if len(l.backend.listeners[l.channel]) == 0 {
+			delete(l.backend.listeners, l.channel)
+		}
+		l.backend.mu.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
@@ -0,0 +1,355 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kind 是消息的投递方式，同名的队列、Topic[T] 和广播是互相独立的，指标按 Kind 区分
+type Kind string
+
+const (
+	KindQueue     Kind = "queue"     // Publish/Subscribe
+	KindTopic     Kind = "topic"     // Topic[T]
+	KindBroadcast Kind = "broadcast" // Broadcast/SubscribeBroadcast
+)
+
+// TopicRef 标识一个指定投递方式的 topic，作为 Stats 和 MemoryMetrics 快照的 key
+// 序列化为 JSON 时的 key 为 "<kind>:<name>"
+type TopicRef struct {
+	Kind Kind
+	Name string
+}
+
+func (r TopicRef) String() string {
+	return string(r.Kind) + ":" + r.Name
+}
+
+func (r TopicRef) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// listKey 返回 topic 对应的队列键，广播没有队列
+func (r TopicRef) listKey() (string, bool) {
+	switch r.Kind {
+	case KindQueue:
+		return formatTopicKey(r.Name), true
+	case KindTopic:
+		return formatTypedKey(r.Name), true
+	}
+	return "", false
+}
+
+// Metrics 收集 pubsub 的运行指标，实现必须是并发安全的
+type Metrics interface {
+	Published(kind Kind, topic string, n int)                 // 成功发布的消息数
+	Dropped(kind Kind, topic string, n int)                   // 因队列或广播监听者缓冲已满被拒绝或丢弃的消息数
+	Consumed(kind Kind, topic string)                         // 处理成功的消息
+	Failed(kind Kind, topic string)                           // 处理失败的消息（解析失败或处理函数返回 error）
+	Panicked(kind Kind, topic string)                         // 处理函数 panic 的次数
+	HandlerDuration(kind Kind, topic string, d time.Duration) // 处理函数耗时
+	// QueueDepth 上报队列长度，发布后为写入后的长度，订阅取空队列时为 0
+	// 不额外查询后端，因此只是近似值，准确的长度可以通过 PubSub.Stats 获取
+	QueueDepth(kind Kind, topic string, depth int64)
+	// QueueLag 上报消息从发布到开始处理的延迟
+	QueueLag(kind Kind, topic string, lag time.Duration)
+}
+
+// TopicCounters 是单个 topic 的计数器快照
+type TopicCounters struct {
+	Published    int64         `json:"published"`
+	Dropped      int64         `json:"dropped"`
+	Consumed     int64         `json:"consumed"`
+	Failed       int64         `json:"failed"`
+	Panics       int64         `json:"panics"`
+	HandlerCount int64         `json:"handler_count"`
+	HandlerTotal time.Duration `json:"handler_total"`
+	HandlerMax   time.Duration `json:"handler_max"`
+	HandlerAvg   time.Duration `json:"handler_avg"`
+	QueueDepth   int64         `json:"queue_depth"` // 最近一次上报的队列长度
+	QueueLag     time.Duration `json:"queue_lag"`   // 最近一次处理的消息的延迟
+}
+
+// SubscriptionStats 是单个订阅的统计信息
+type SubscriptionStats struct {
+	Kind        Kind   `json:"kind"`
+	Topic       string `json:"topic"`
+	Key         string `json:"key"` // 队列键或广播 channel
+	Broadcast   bool   `json:"broadcast"`
+	Concurrency int    `json:"concurrency"`
+	Buffered    int    `json:"buffered"` // 已取出但尚未处理的消息数
+	Consumed    int64  `json:"consumed"`
+	Failed      int64  `json:"failed"`
+	Panics      int64  `json:"panics"`
+}
+
+// TopicStats 是单个 topic 的统计信息
+type TopicStats struct {
+	QueueLength   int64               `json:"queue_length"` // 当前队列长度，包括分区队列
+	Counters      TopicCounters       `json:"counters"`     // 仅在使用 MemoryMetrics 时有值
+	Subscriptions []SubscriptionStats `json:"subscriptions"`
+}
+
+// Stats 是 PubSub 的统计信息
+type Stats struct {
+	Topics map[TopicRef]*TopicStats `json:"topics"`
+}
+
+// Topic 返回指定投递方式和名称的 topic 统计信息，不存在时返回 nil
+func (s *Stats) Topic(kind Kind, name string) *TopicStats {
+	return s.Topics[TopicRef{Kind: kind, Name: name}]
+}
+
+// WithMetrics 设置指标收集器，默认使用 MemoryMetrics
+func WithMetrics(m Metrics) Option {
+	return func(o any) {
+		if ps, ok := o.(*PubSub); ok && m != nil {
+			ps.metrics = m
+		}
+	}
+}
+
+// subscriptionCounters 是每个订阅自身的计数器
+type subscriptionCounters struct {
+	consumed atomic.Int64
+	failed   atomic.Int64
+	panics   atomic.Int64
+}
+
+// Stats 返回每个 topic 和每个订阅的统计信息，以及当前的队列长度
+func (p *PubSub) Stats(ctx context.Context) (*Stats, error) {
+	stats := &Stats{Topics: make(map[TopicRef]*TopicStats)}
+	topicStats := func(ref TopicRef) *TopicStats {
+		ts, ok := stats.Topics[ref]
+		if !ok {
+			ts = &TopicStats{}
+			stats.Topics[ref] = ts
+		}
+		return ts
+	}
+
+	// 需要查询长度的 List
+	listKeys := make(map[TopicRef]string)
+
+	p.mu.RLock()
+	for _, subs := range p.subscriptions {
+		for _, s := range subs {
+			ref := TopicRef{Kind: s.kind, Name: s.topic}
+			ts := topicStats(ref)
+			ts.Subscriptions = append(ts.Subscriptions, s.stats())
+			if !s.broadcast {
+				listKeys[ref] = s.redisKey
+			}
+		}
+	}
+	p.mu.RUnlock()
+
+	if mm, ok := p.metrics.(*MemoryMetrics); ok {
+		for ref, counters := range mm.Snapshot() {
+			topicStats(ref).Counters = counters
+			if _, ok := listKeys[ref]; ok {
+				continue
+			}
+			if key, ok := ref.listKey(); ok {
+				listKeys[ref] = key
+			}
+		}
+	}
+
+	for ref, listKey := range listKeys {
+		for _, key := range p.queueKeys(listKey) {
+			length, err := p.backend.Len(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			topicStats(ref).QueueLength += length
+		}
+	}
+	return stats, nil
+}
+
+// stats 返回订阅的统计信息
+func (s *Subscription) stats() SubscriptionStats {
+	buffered := len(s.dataChan)
+	for _, ch := range s.workerChans {
+		buffered += len(ch)
+	}
+	return SubscriptionStats{
+		Kind:        s.kind,
+		Topic:       s.topic,
+		Key:         s.redisKey,
+		Broadcast:   s.broadcast,
+		Concurrency: s.concurrency,
+		Buffered:    buffered,
+		Consumed:    s.counters.consumed.Load(),
+		Failed:      s.counters.failed.Load(),
+		Panics:      s.counters.panics.Load(),
+	}
+}
+
+// --- MemoryMetrics ---
+
+var _ Metrics = (*MemoryMetrics)(nil)
+
+// MemoryMetrics 是基于内存的 Metrics 实现，按 topic 累计计数
+type MemoryMetrics struct {
+	topics sync.Map // key: TopicRef, value: *topicMetrics
+}
+
+type topicMetrics struct {
+	published    atomic.Int64
+	dropped      atomic.Int64
+	consumed     atomic.Int64
+	failed       atomic.Int64
+	panics       atomic.Int64
+	handlerCount atomic.Int64
+	handlerTotal atomic.Int64 // 纳秒
+	handlerMax   atomic.Int64 // 纳秒
+	queueDepth   atomic.Int64
+	queueLag     atomic.Int64 // 纳秒
+}
+
+// NewMemoryMetrics 创建一个新的 MemoryMetrics
+func NewMemoryMetrics() *MemoryMetrics {
+	return &MemoryMetrics{}
+}
+
+func (m *MemoryMetrics) topic(kind Kind, topic string) *topicMetrics {
+	ref := TopicRef{Kind: kind, Name: topic}
+	if tm, ok := m.topics.Load(ref); ok {
+		return tm.(*topicMetrics)
+	}
+	tm, _ := m.topics.LoadOrStore(ref, &topicMetrics{})
+	return tm.(*topicMetrics)
+}
+
+func (m *MemoryMetrics) Published(kind Kind, topic string, n int) {
+	m.topic(kind, topic).published.Add(int64(n))
+}
+
+func (m *MemoryMetrics) Dropped(kind Kind, topic string, n int) {
+	m.topic(kind, topic).dropped.Add(int64(n))
+}
+
+func (m *MemoryMetrics) Consumed(kind Kind, topic string) {
+	m.topic(kind, topic).consumed.Add(1)
+}
+
+func (m *MemoryMetrics) Failed(kind Kind, topic string) {
+	m.topic(kind, topic).failed.Add(1)
+}
+
+func (m *MemoryMetrics) Panicked(kind Kind, topic string) {
+	m.topic(kind, topic).panics.Add(1)
+}
+
+func (m *MemoryMetrics) HandlerDuration(kind Kind, topic string, d time.Duration) {
+	tm := m.topic(kind, topic)
+	tm.handlerCount.Add(1)
+	tm.handlerTotal.Add(int64(d))
+	for {
+		old := tm.handlerMax.Load()
+		if int64(d) <= old || tm.handlerMax.CompareAndSwap(old, int64(d)) {
+			break
+		}
+	}
+}
+
+func (m *MemoryMetrics) QueueDepth(kind Kind, topic string, depth int64) {
+	m.topic(kind, topic).queueDepth.Store(depth)
+}
+
+func (m *MemoryMetrics) QueueLag(kind Kind, topic string, lag time.Duration) {
+	m.topic(kind, topic).queueLag.Store(int64(lag))
+}
+
+// Snapshot 返回每个 topic 当前的计数器快照
+func (m *MemoryMetrics) Snapshot() map[TopicRef]TopicCounters {
+	snapshot := make(map[TopicRef]TopicCounters)
+	m.topics.Range(func(key, value any) bool {
+		tm := value.(*topicMetrics)
+		c := TopicCounters{
+			Published:    tm.published.Load(),
+			Dropped:      tm.dropped.Load(),
+			Consumed:     tm.consumed.Load(),
+			Failed:       tm.failed.Load(),
+			Panics:       tm.panics.Load(),
+			HandlerCount: tm.handlerCount.Load(),
+			HandlerTotal: time.Duration(tm.handlerTotal.Load()),
+			HandlerMax:   time.Duration(tm.handlerMax.Load()),
+			QueueDepth:   tm.queueDepth.Load(),
+			QueueLag:     time.Duration(tm.queueLag.Load()),
+		}
+		if c.HandlerCount > 0 {
+			c.HandlerAvg = c.HandlerTotal / time.Duration(c.HandlerCount)
+		}
+		snapshot[key.(TopicRef)] = c
+		return true
+	})
+	return snapshot
+}
+
+// WritePrometheus 以 Prometheus 文本格式输出所有指标
+func (m *MemoryMetrics) WritePrometheus(w io.Writer) error {
+	snapshot := m.Snapshot()
+	refs := make([]TopicRef, 0, len(snapshot))
+	for ref := range snapshot {
+		refs = append(refs, ref)
+	}
+	slices.SortFunc(refs, func(a, b TopicRef) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	labels := func(ref TopicRef) string {
+		return fmt.Sprintf("kind=%q,topic=%q", ref.Kind, ref.Name)
+	}
+
+	metrics := []struct {
+		name  string
+		typ   string
+		help  string
+		value func(c TopicCounters) string
+	}{
+		{"pubsub_published_total", "counter", "Total number of published messages.", func(c TopicCounters) string { return strconv.FormatInt(c.Published, 10) }},
+		{"pubsub_dropped_total", "counter", "Total number of messages dropped because the queue is full.", func(c TopicCounters) string { return strconv.FormatInt(c.Dropped, 10) }},
+		{"pubsub_consumed_total", "counter", "Total number of successfully handled messages.", func(c TopicCounters) string { return strconv.FormatInt(c.Consumed, 10) }},
+		{"pubsub_failed_total", "counter", "Total number of messages that failed to be handled.", func(c TopicCounters) string { return strconv.FormatInt(c.Failed, 10) }},
+		{"pubsub_panics_total", "counter", "Total number of recovered handler panics.", func(c TopicCounters) string { return strconv.FormatInt(c.Panics, 10) }},
+		{"pubsub_queue_depth", "gauge", "Last reported number of messages waiting in the queue.", func(c TopicCounters) string { return strconv.FormatInt(c.QueueDepth, 10) }},
+		{"pubsub_queue_lag_seconds", "gauge", "Time between publish and handling of the last handled message.", func(c TopicCounters) string { return strconv.FormatFloat(c.QueueLag.Seconds(), 'g', -1, 64) }},
+	}
+	for _, metric := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.typ); err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			if _, err := fmt.Fprintf(w, "%s{%s} %s\n", metric.name, labels(ref), metric.value(snapshot[ref])); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := fmt.Fprint(w, "# HELP pubsub_handler_duration_seconds Handler execution time.\n# TYPE pubsub_handler_duration_seconds summary\n"); err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		c := snapshot[ref]
+		if _, err := fmt.Fprintf(w, "pubsub_handler_duration_seconds_sum{%s} %g\npubsub_handler_duration_seconds_count{%s} %d\n", labels(ref), c.HandlerTotal.Seconds(), labels(ref), c.HandlerCount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeHTTP 实现 http.Handler，可直接挂载为 Prometheus 的抓取端点
+func (m *MemoryMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = m.WritePrometheus(w)
+}
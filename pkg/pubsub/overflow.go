@@ -0,0 +1,55 @@
+package pubsub
+
+import (
+	"time"
+)
+
+// OverflowPolicy 是队列达到 queueSize 时的处理策略
+type OverflowPolicy string
+
+const (
+	OverflowReject     OverflowPolicy = "reject"      // 拒绝整批消息，返回 ErrQueueFull（默认）
+	OverflowDropOldest OverflowPolicy = "drop_oldest" // 写入整批消息，丢弃队列头部最旧的消息
+	OverflowDropNewest OverflowPolicy = "drop_newest" // 只写入能放下的部分，丢弃本批中超出的消息
+	OverflowBlock      OverflowPolicy = "block"       // 等待队列有足够空间，超时后返回 ErrQueueFull
+)
+
+const (
+	defaultBlockTimeout = 5 * time.Second       // OverflowBlock 默认的等待超时时间
+	blockRetryInterval  = 50 * time.Millisecond // OverflowBlock 重试间隔
+)
+
+// WithOverflow 设置默认的队列溢出策略
+func WithOverflow(policy OverflowPolicy) Option {
+	return func(o any) {
+		if ps, ok := o.(*PubSub); ok && policy != "" {
+			ps.overflow = policy
+		}
+	}
+}
+
+// WithTopicOverflow 为指定 topic 设置队列溢出策略，优先于 WithOverflow
+func WithTopicOverflow(topic string, policy OverflowPolicy) Option {
+	return func(o any) {
+		if ps, ok := o.(*PubSub); ok && policy != "" {
+			ps.topicOverflow[topic] = policy
+		}
+	}
+}
+
+// WithBlockTimeout 设置 OverflowBlock 策略的最长等待时间
+func WithBlockTimeout(d time.Duration) Option {
+	return func(o any) {
+		if ps, ok := o.(*PubSub); ok && d > 0 {
+			ps.blockTimeout = d
+		}
+	}
+}
+
+// overflowPolicy 返回 topic 的溢出策略
+func (p *PubSub) overflowPolicy(topic string) OverflowPolicy {
+	if policy, ok := p.topicOverflow[topic]; ok {
+		return policy
+	}
+	return p.overflow
+}
@@ -0,0 +1,143 @@
+package pubsub
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	partitionLeaseTTL      = 10 * time.Second                           // 分区租约的有效期
+	partitionRenewInterval = partitionLeaseTTL / 3                      // 获取和续期分区租约的间隔
+	partitionRetryInterval = 200 * time.Millisecond                     // 获取或续期出错后第一次重试的间隔，之后指数退避
+	partitionRenewDeadline = partitionLeaseTTL - partitionRenewInterval // 续期持续出错超过该时间后放弃分区，在租约过期前留出余量
+)
+
+// WithPartitions 将带分区键的消息按键的哈希写入 n 个独立的分区队列
+// 每个分区同一时刻只由一个订阅（租约持有者）消费，因此相同 key 的消息在多个订阅（多个节点）之间也按顺序处理
+// 发布方和订阅方必须使用相同的 n，n <= 0 时（默认）带分区键的消息与普通消息写入同一个队列，只保证单个订阅内部的顺序
+// 分区按先到先得分配，持有者停止或租约过期后由其他订阅接管；租约过期接管时持有者已取出的消息可能与接管者并发处理
+// 每个持有的分区占用一个阻塞连接，队列大小限制对每个分区单独生效
+func WithPartitions(n int) Option {
+	return func(o any) {
+		if ps, ok := o.(*PubSub); ok {
+			ps.partitions = max(n, 0)
+		}
+	}
+}
+
+// formatPartitionKey 返回分区队列的键
+func formatPartitionKey(listKey string, partition int) string {
+	return listKey + ":p:" + strconv.Itoa(partition)
+}
+
+// formatPartitionOwnerKey 返回分区租约的键
+func formatPartitionOwnerKey(listKey string, partition int) string {
+	return formatPartitionKey(listKey, partition) + ":owner"
+}
+
+// routeKey 返回消息应写入的队列，带分区键的消息在开启 WithPartitions 时写入对应的分区
+func (p *PubSub) routeKey(listKey, key string) string {
+	if key == "" || p.partitions <= 0 {
+		return listKey
+	}
+	return formatPartitionKey(listKey, partitionIndex(key, p.partitions))
+}
+
+// queueKeys 返回 topic 的所有队列键，包括分区队列
+func (p *PubSub) queueKeys(listKey string) []string {
+	keys := make([]string, 0, p.partitions+1)
+	keys = append(keys, listKey)
+	for i := 0; i < p.partitions; i++ {
+		keys = append(keys, formatPartitionKey(listKey, i))
+	}
+	return keys
+}
+
+// partitionLoop 定期获取和续期分区租约，为持有的每个分区启动一个 popLoop
+// 失去租约的分区立即停止消费，退出时等待分区的 popLoop 结束后释放租约
+func (s *Subscription) partitionLoop() {
+	defer s.wg.Done()
+	defer log.Trace().Str("topic", s.topic).Msg("partition loop stopped")
+
+	var wg sync.WaitGroup
+	owned := make(map[int]context.CancelFunc)
+	defer func() {
+		for _, cancel := range owned {
+			cancel()
+		}
+		wg.Wait()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		for i := range owned {
+			if err := s.pubSub.backend.Release(ctx, formatPartitionOwnerKey(s.redisKey, i), s.id); err != nil {
+				log.Error().Err(err).Str("topic", s.topic).Int("partition", i).Msg("failed to release partition lease")
+			}
+		}
+	}()
+
+	renewed := make(map[int]time.Time) // 持有的分区上次成功续期的时间
+	failures := 0
+	timer := time.NewTimer(partitionRenewInterval)
+	defer timer.Stop()
+	for {
+		failed := false
+		for i := 0; i < s.pubSub.partitions; i++ {
+			claimed, err := s.pubSub.backend.Claim(s.ctx, formatPartitionOwnerKey(s.redisKey, i), s.id, partitionLeaseTTL)
+			cancel, running := owned[i]
+			if err != nil {
+				failed = true
+				log.Error().Err(err).Str("topic", s.topic).Int("partition", i).Msg("failed to claim partition lease")
+				// 出错时租约可能仍然有效，继续消费并重试，长时间续期失败才放弃分区
+				if running && time.Since(renewed[i]) >= partitionRenewDeadline {
+					cancel()
+					delete(owned, i)
+					delete(renewed, i)
+					log.Warn().Str("topic", s.topic).Int("partition", i).Msg("partition lease renewal timed out")
+				}
+				continue
+			}
+			switch {
+			case claimed && !running:
+				ctx, cancel := context.WithCancel(s.ctx)
+				owned[i] = cancel
+				renewed[i] = time.Now()
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					s.popLoop(ctx, formatPartitionKey(s.redisKey, i))
+				}()
+				log.Info().Str("topic", s.topic).Int("partition", i).Msg("partition claimed")
+			case claimed:
+				renewed[i] = time.Now()
+			case running:
+				cancel()
+				delete(owned, i)
+				delete(renewed, i)
+				log.Warn().Str("topic", s.topic).Int("partition", i).Msg("partition lease lost")
+			}
+		}
+
+		wait := partitionRenewInterval
+		if failed {
+			wait = min(partitionRetryInterval<<min(failures, 16), partitionRenewInterval)
+			failures++
+		} else {
+			failures = 0
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.stopChan:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-s.pubSub.closed:
+			return
+		}
+	}
+}
@@ -5,27 +5,31 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/goccy/go-json"
+	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog/log"
 )
 
 // 全局错误码
 var (
-	ErrQueueFull          = errors.New("queue is full")
-	ErrInvalidFunction    = errors.New("invalid function provided")
-	ErrArgMismatch        = errors.New("function arguments mismatch")
-	ErrSubscriptionClosed = errors.New("subscription is closed")
-	ErrPubSubClosed       = errors.New("pubsub is closed")
+	ErrQueueFull             = errors.New("queue is full")
+	ErrInvalidFunction       = errors.New("invalid function provided")
+	ErrArgMismatch           = errors.New("function arguments mismatch")
+	ErrSubscriptionClosed    = errors.New("subscription is closed")
+	ErrPubSubClosed          = errors.New("pubsub is closed")
+	ErrBroadcastNotSupported = errors.New("backend does not support broadcast subscribe")
 )
 
 const (
 	redisKeyPrefix      = "pubsub:topic:"
-	blpopTimeout        = 1 * time.Second // BLPOP 的阻塞超时时间
+	broadcastKeyPrefix  = "pubsub:broadcast:"
+	popTimeout          = 1 * time.Second // Pop 的阻塞超时时间
 	defaultQueueSize    = 1000            // 默认队列大小限制
 	defaultDataChanSize = 100             // 默认内部数据通道大小
 )
@@ -35,36 +39,58 @@ type Option func(any)
 
 // PubSub 结构体
 type PubSub struct {
-	redisClient   redis.Cmdable
+	backend       Backend
 	queueSize     int
 	subscriptions map[string][]*Subscription // key: topic
 	mu            sync.RWMutex
 	closed        chan struct{}
-	wg            sync.WaitGroup // 用于等待所有 Subscription 关闭
-	useRecovery   bool           // 是否开启panic recovery（全局）
+	wg            sync.WaitGroup            // 用于等待所有 Subscription 关闭
+	useRecovery   bool                      // 是否开启panic recovery（全局）
+	propagator    Propagator                // 链路追踪上下文传播器
+	metaKeys      []string                  // 随消息传递的 meta key
+	metrics       Metrics                   // 指标收集器
+	overflow      OverflowPolicy            // 默认的队列溢出策略
+	topicOverflow map[string]OverflowPolicy // 每个 topic 的队列溢出策略
+	blockTimeout  time.Duration             // OverflowBlock 的最长等待时间
+	partitions    int                       // 带分区键的消息的分区队列数量
+
+	headers           bool // 是否在反射订阅的消息中写入消息头
+	propagateDeadline bool // 是否传递发布方 ctx 的截止时间
 }
 
+// invokeFunc 处理一条消息的 payload
+type invokeFunc func(ctx context.Context, payload []byte) error
+
 // Subscription 结构体
 type Subscription struct {
 	pubSub       *PubSub
+	id           string // 订阅的唯一标识，作为分区租约的持有者
+	kind         Kind
 	topic        string
 	redisKey     string
-	handler      reflect.Value      // 订阅的函数
-	handlerType  reflect.Type       // 订阅函数的类型
-	concurrency  int                // 并发worker数量
-	batchSize    int                // 每次BLPOP批量获取的消息数量
-	useRecovery  bool               // 是否开启panic recovery
-	dataChan     chan []byte        // 内部数据通道，BLPOP将数据放入此通道
-	stopChan     chan struct{}      // 通知goroutine停止
-	wg           sync.WaitGroup     // 用于等待worker goroutine结束
-	ctx          context.Context    // 订阅的上下文
-	cancel       context.CancelFunc // 用于取消订阅的上下文
-	processingMu sync.Mutex         // 确保 Stop 时不会有新的消息被处理
+	handler      reflect.Value        // 订阅的函数
+	handlerType  reflect.Type         // 订阅函数的类型
+	invoke       invokeFunc           // 消息处理入口，反射订阅或 Topic 订阅各自设置
+	concurrency  int                  // 并发worker数量
+	parallel     bool                 // 是否允许多个worker同时处理消息
+	batchSize    int                  // 每次Pop批量获取的消息数量
+	useRecovery  bool                 // 是否开启panic recovery
+	dataChan     chan []byte          // 内部数据通道，Pop将数据放入此通道
+	workerChans  []chan []byte        // 每个worker独占的通道，用于带分区键的消息
+	stopChan     chan struct{}        // 通知goroutine停止
+	wg           sync.WaitGroup       // 用于等待worker goroutine结束
+	ctx          context.Context      // 订阅的上下文
+	cancel       context.CancelFunc   // 用于取消订阅的上下文
+	processingMu sync.RWMutex         // 处理消息时持有锁（并行处理时为读锁），Stop 持有写锁确保不会有新的消息被处理
+	broadcast    bool                 // 是否为广播订阅
+	listener     Listener             // 广播订阅的监听者
+	counters     subscriptionCounters // 订阅自身的计数器
 }
 
 // --- PubSub 配置选项 ---
 
-// WithQueueSize 设置Publish时检查的Redis List最大长度
+// WithQueueSize 设置Publish时检查的队列最大长度
+// 超出时的行为由 WithOverflow / WithTopicOverflow 决定
 func WithQueueSize(qs int) Option {
 	return func(o any) {
 		if ps, ok := o.(*PubSub); ok {
@@ -91,6 +117,7 @@ func WithRecovery() Option {
 
 // WithConcurrency 设置消费函数的并发数量
 // 如果 c <= 0, 则默认为 1
+// 默认同一时刻只有一条消息在处理，需要配合 WithParallelProcessing 才会并发执行处理函数
 func WithConcurrency(c int) Option {
 	return func(o any) {
 		if s, ok := o.(*Subscription); ok {
@@ -103,7 +130,18 @@ func WithConcurrency(c int) Option {
 	}
 }
 
-// WithBatchSize 设置每次从Redis批量获取的消息数量
+// WithParallelProcessing 允许多个 worker 同时处理消息
+// 默认情况下即使设置了 WithConcurrency，同一个订阅同一时刻也只有一条消息在处理
+// 开启后不同分区键（或没有分区键）的消息并发处理，相同分区键的消息仍然按顺序逐条处理
+func WithParallelProcessing() Option {
+	return func(o any) {
+		if s, ok := o.(*Subscription); ok {
+			s.parallel = true
+		}
+	}
+}
+
+// WithBatchSize 设置每次从队列批量获取的消息数量
 // 如果 bs <= 0, 则默认为 1（单条获取）
 func WithBatchSize(bs int) Option {
 	return func(o any) {
@@ -117,19 +155,34 @@ func WithBatchSize(bs int) Option {
 	}
 }
 
-// New 创建一个新的 PubSub 实例
+// New 创建一个新的基于 Redis 的 PubSub 实例
 func New(redisClient redis.Cmdable, opts ...Option) *PubSub {
+	return NewWithBackend(NewRedisBackend(redisClient), opts...)
+}
+
+// NewMemory 创建一个新的进程内 PubSub 实例，不依赖 Redis
+func NewMemory(opts ...Option) *PubSub {
+	return NewWithBackend(NewMemoryBackend(), opts...)
+}
+
+// NewWithBackend 使用指定的后端创建一个新的 PubSub 实例
+func NewWithBackend(backend Backend, opts ...Option) *PubSub {
 	ps := &PubSub{
-		redisClient:   redisClient,
+		backend:       backend,
 		queueSize:     defaultQueueSize, // 默认值
 		subscriptions: make(map[string][]*Subscription),
 		closed:        make(chan struct{}),
 		useRecovery:   false, // 默认不recovery
+		metaKeys:      defaultMetaKeys,
+		metrics:       NewMemoryMetrics(),
+		overflow:      OverflowReject,
+		topicOverflow: make(map[string]OverflowPolicy),
+		blockTimeout:  defaultBlockTimeout,
 	}
 	for _, opt := range opts {
 		opt(ps)
 	}
-	log.Trace().Int("queue_size", ps.queueSize).Bool("recovery", ps.useRecovery).Msg("new pubsub initialized")
+	log.Trace().Int("queue_size", ps.queueSize).Str("overflow", string(ps.overflow)).Bool("recovery", ps.useRecovery).Msg("new pubsub initialized")
 	return ps
 }
 
@@ -137,6 +190,49 @@ func formatTopicKey(topic string) string {
 	return redisKeyPrefix + topic
 }
 
+func formatBroadcastKey(topic string) string {
+	return broadcastKeyPrefix + topic
+}
+
+// normalizeArgs 将 Publish 的可变参数规整为消息列表
+// - 如果所有 args 都是 []any 类型，则作为批量发布（每个 []any 是一条消息）
+// - 否则将 args 包装成 []any{args} 作为单条消息
+func normalizeArgs(args []any) [][]any {
+	var argsList [][]any
+	for _, arg := range args {
+		slice, ok := arg.([]any)
+		if !ok {
+			return [][]any{args}
+		}
+		argsList = append(argsList, slice)
+	}
+	return argsList
+}
+
+// marshalArgsList 将每条消息的参数序列化为 JSON 数组
+// 开启 WithHeaders 或 key 不为空时连同 ctx 生成的消息头封装为 envelope，key 作为分区键写入消息头
+func (p *PubSub) marshalArgsList(ctx context.Context, topic, key string, argsList [][]any) ([][]byte, error) {
+	payloads := make([][]byte, 0, len(argsList))
+	for i, args := range argsList {
+		rawArgs, err := json.Marshal(args)
+		if err != nil {
+			log.Error().Err(err).Str("topic", topic).Int("batch_index", i).Interface("args", args).Msg("failed to marshal batch publish arguments")
+			return nil, fmt.Errorf("json marshal failed for batch index %d: %w", i, err)
+		}
+		if !p.headers && key == "" {
+			payloads = append(payloads, rawArgs)
+			continue
+		}
+		payload, err := encodeEnvelope(p.newHeaders(ctx, key), rawArgs)
+		if err != nil {
+			log.Error().Err(err).Str("topic", topic).Int("batch_index", i).Msg("failed to marshal message envelope")
+			return nil, fmt.Errorf("json marshal envelope failed for batch index %d: %w", i, err)
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads, nil
+}
+
 // Publish 发布消息到指定的topic
 // 自动检测参数类型：
 // - 如果所有 args 都是 []any 类型，则作为批量发布（每个 []any 是一条消息）
@@ -154,68 +250,125 @@ func (p *PubSub) Publish(ctx context.Context, topic string, args ...any) error {
 		return nil
 	}
 
-	// 检测是否所有参数都是 []any 类型
-	var argsList [][]any
-	isBatch := true
-	for _, arg := range args {
-		if slice, ok := arg.([]any); ok {
-			argsList = append(argsList, slice)
-		} else {
-			isBatch = false
-			break
-		}
+	return p.publishBatch(ctx, topic, "", normalizeArgs(args))
+}
+
+// PublishKeyed 发布带分区键的消息到指定的topic，参数规则与 Publish 相同
+// 分区键写在消息头中，消息总是使用 envelope 格式，订阅方需要先升级
+// 同一个订阅内，相同 key 的消息按发布顺序逐条处理，开启 WithParallelProcessing 时不同 key 的消息并发处理
+// 多个订阅（多个节点）消费同一个 topic 时，需要开启 WithPartitions 才能保证跨订阅的顺序，否则只保证每个订阅内部的顺序
+func (p *PubSub) PublishKeyed(ctx context.Context, topic, key string, args ...any) error {
+	select {
+	case <-p.closed:
+		log.Error().Str("topic", topic).Msg("cannot publish on closed pubsub")
+		return ErrPubSubClosed
+	default:
 	}
 
-	// 如果不是批量模式，将 args 包装成 []any{args}
-	if !isBatch {
-		argsList = [][]any{args}
+	if len(args) == 0 {
+		log.Trace().Str("topic", topic).Msg("no messages to publish")
+		return nil
 	}
 
-	return p.publishBatch(ctx, topic, argsList)
+	return p.publishBatch(ctx, topic, key, normalizeArgs(args))
 }
 
-// publishBatch 批量发布多条消息到指定的topic
-// 每个 args 元素会被序列化为 JSON 数组字符串存储到 Redis List
-func (p *PubSub) publishBatch(ctx context.Context, topic string, argsList [][]any) error {
-	redisKey := formatTopicKey(topic)
-
-	// 检查队列长度
-	if p.queueSize > 0 {
-		length, err := p.redisClient.LLen(ctx, redisKey).Result()
-		if err != nil && !errors.Is(err, redis.Nil) {
-			log.Error().Err(err).Str("topic", topic).Msg("failed to get list length for batch queue size check")
-			return fmt.Errorf("redis LLen failed: %w", err)
-		}
+// Broadcast 以广播方式发布消息到指定的topic
+// 与 Publish 的队列语义不同，每个 SubscribeBroadcast 的订阅者都会收到每一条消息
+// 消息不做持久化（Redis 后端通过 PUBLISH 投递），发布时不在线的订阅者不会收到
+// 发布不会被处理慢的订阅者阻塞，进程内后端在订阅者缓冲已满时丢弃消息并计入 Dropped
+// 参数规则与 Publish 相同
+func (p *PubSub) Broadcast(ctx context.Context, topic string, args ...any) error {
+	select {
+	case <-p.closed:
+		log.Error().Str("topic", topic).Msg("cannot broadcast on closed pubsub")
+		return ErrPubSubClosed
+	default:
+	}
 
-		// 检查批量发布后是否会超出队列大小限制
-		if length+int64(len(argsList)) > int64(p.queueSize) {
-			log.Warn().Str("topic", topic).Int64("current_length", length).Int("batch_size", len(argsList)).Int("queue_size_limit", p.queueSize).Msg("batch publish would exceed queue size limit")
-			return ErrQueueFull
-		}
+	if len(args) == 0 {
+		log.Trace().Str("topic", topic).Msg("no messages to broadcast")
+		return nil
 	}
 
-	// 序列化所有消息
-	payloads := make([]any, 0, len(argsList))
-	for i, args := range argsList {
-		payload, err := json.Marshal(args)
-		if err != nil {
-			log.Error().Err(err).Str("topic", topic).Int("batch_index", i).Interface("args", args).Msg("failed to marshal batch publish arguments")
-			return fmt.Errorf("json marshal failed for batch index %d: %w", i, err)
-		}
-		payloads = append(payloads, payload)
+	argsList := normalizeArgs(args)
+	payloads, err := p.marshalArgsList(ctx, topic, "", argsList)
+	if err != nil {
+		return err
 	}
 
-	// 使用 RPush 批量推送所有消息
-	err := p.redisClient.RPush(ctx, redisKey, payloads...).Err()
+	dropped, err := p.backend.Broadcast(ctx, formatBroadcastKey(topic), payloads)
 	if err != nil {
-		log.Error().Err(err).Str("topic", topic).Int("batch_size", len(argsList)).Msg("failed to publish batch messages to redis")
-		return fmt.Errorf("redis RPush batch failed: %w", err)
+		log.Error().Err(err).Str("topic", topic).Int("batch_size", len(argsList)).Msg("failed to broadcast messages")
+		return err
 	}
 
-	log.Trace().Str("topic", topic).Int("batch_size", len(argsList)).Msg("batch messages published successfully")
+	p.metrics.Published(KindBroadcast, topic, len(argsList))
+	if dropped > 0 {
+		log.Warn().Str("topic", topic).Int("batch_size", len(argsList)).Int64("dropped", dropped).Msg("broadcast listener buffer full, messages dropped")
+		p.metrics.Dropped(KindBroadcast, topic, int(dropped))
+	}
+	log.Trace().Str("topic", topic).Int("batch_size", len(argsList)).Msg("messages broadcast successfully")
 	return nil
 }
 
+// publishBatch 批量发布多条消息到指定的topic
+// 每个 args 元素会被序列化为 JSON 数组写入队列，格式见 marshalArgsList
+func (p *PubSub) publishBatch(ctx context.Context, topic, key string, argsList [][]any) error {
+	// 序列化所有消息
+	payloads, err := p.marshalArgsList(ctx, topic, key, argsList)
+	if err != nil {
+		return err
+	}
+	return p.pushPayloads(ctx, KindQueue, topic, p.routeKey(formatTopicKey(topic), key), payloads)
+}
+
+// pushPayloads 按 topic 的溢出策略将已序列化的消息批量推送到队列
+// 队列长度检查与写入由后端原子性地完成（Redis 后端使用 Lua 脚本），并发发布时也不会超过 queueSize
+func (p *PubSub) pushPayloads(ctx context.Context, kind Kind, topic, redisKey string, payloads [][]byte) error {
+	policy := p.overflowPolicy(topic)
+	deadline := time.Now().Add(p.blockTimeout)
+
+	for {
+		pushed, dropped, length, err := p.backend.Push(ctx, redisKey, payloads, p.queueSize, policy)
+		if err != nil {
+			log.Error().Err(err).Str("topic", topic).Int("batch_size", len(payloads)).Msg("failed to publish batch messages")
+			return err
+		}
+		p.metrics.QueueDepth(kind, topic, length)
+
+		if dropped == 0 {
+			p.metrics.Published(kind, topic, int(pushed))
+			log.Trace().Str("topic", topic).Int("batch_size", len(payloads)).Msg("batch messages published successfully")
+			return nil
+		}
+
+		switch policy {
+		case OverflowDropOldest, OverflowDropNewest:
+			log.Warn().Str("topic", topic).Int("batch_size", len(payloads)).Int64("dropped", dropped).Int("queue_size_limit", p.queueSize).Str("policy", string(policy)).Msg("queue overflow, messages dropped")
+			p.metrics.Published(kind, topic, int(pushed))
+			p.metrics.Dropped(kind, topic, int(dropped))
+			return nil
+		case OverflowBlock:
+			// 整批都放不下时不再等待
+			if len(payloads) <= p.queueSize && time.Now().Before(deadline) {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-p.closed:
+					return ErrPubSubClosed
+				case <-time.After(blockRetryInterval):
+				}
+				continue
+			}
+		}
+
+		log.Warn().Str("topic", topic).Int("batch_size", len(payloads)).Int("queue_size_limit", p.queueSize).Str("policy", string(policy)).Msg("batch publish would exceed queue size limit")
+		p.metrics.Dropped(kind, topic, len(payloads))
+		return ErrQueueFull
+	}
+}
+
 // MustSubscribe 订阅一个topic，发生错误时panic
 func (p *PubSub) MustSubscribe(ctx context.Context, topic string, fn any, opts ...Option) *Subscription {
 	sub, err := p.Subscribe(ctx, topic, fn, opts...)
@@ -227,6 +380,7 @@ func (p *PubSub) MustSubscribe(ctx context.Context, topic string, fn any, opts .
 
 // Subscribe 订阅一个topic
 // fn 是处理消息的函数，其参数类型和数量必须与Publish时的args对应
+// fn 的第一个参数可以是 context.Context，此时会传入携带发布方 meta 和追踪信息的 ctx（开启 WithDeadlinePropagation 时还带有截止时间）
 // opts 是Subscription的配置选项
 func (p *PubSub) Subscribe(ctx context.Context, topic string, fn any, opts ...Option) (*Subscription, error) {
 	select {
@@ -236,20 +390,82 @@ func (p *PubSub) Subscribe(ctx context.Context, topic string, fn any, opts ...Op
 	default:
 	}
 
+	s, err := p.newReflectSubscription(ctx, topic, fn, opts...)
+	if err != nil {
+		return nil, err
+	}
+	p.addSubscription(s)
+
+	log.Trace().Str("topic", topic).Int("concurrency", s.concurrency).Int("batch_size", s.batchSize).Bool("recovery", s.useRecovery).Msg("new subscription created")
+	return s, nil
+}
+
+// MustSubscribeBroadcast 以广播方式订阅一个topic，发生错误时panic
+func (p *PubSub) MustSubscribeBroadcast(ctx context.Context, topic string, fn any, opts ...Option) *Subscription {
+	sub, err := p.SubscribeBroadcast(ctx, topic, fn, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// SubscribeBroadcast 以广播方式订阅一个topic，接收 Broadcast 发布的每一条消息
+// fn 和 opts 的规则与 Subscribe 相同，WithBatchSize 对广播订阅无效
+// Redis 后端的 redisClient 必须支持 SUBSCRIBE（如 *redis.Client），否则返回 ErrBroadcastNotSupported
+// 返回时订阅已经建立，之后 Broadcast 的消息会缓存到 Loop 启动后处理
+func (p *PubSub) SubscribeBroadcast(ctx context.Context, topic string, fn any, opts ...Option) (*Subscription, error) {
+	select {
+	case <-p.closed:
+		log.Error().Str("topic", topic).Msg("cannot subscribe broadcast on closed pubsub")
+		return nil, ErrPubSubClosed
+	default:
+	}
+
+	s, err := p.newReflectSubscription(ctx, topic, fn, opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.broadcast = true
+	s.kind = KindBroadcast
+	s.redisKey = formatBroadcastKey(topic)
+
+	s.listener, err = p.backend.Listen(s.ctx, s.redisKey)
+	if err != nil {
+		log.Error().Err(err).Str("topic", topic).Msg("failed to listen broadcast channel")
+		s.cancel()
+		return nil, err
+	}
+	p.addSubscription(s)
+
+	log.Trace().Str("topic", topic).Int("concurrency", s.concurrency).Bool("recovery", s.useRecovery).Msg("new broadcast subscription created")
+	return s, nil
+}
+
+// newReflectSubscription 校验处理函数并构造基于反射调用的 Subscription
+func (p *PubSub) newReflectSubscription(ctx context.Context, topic string, fn any, opts ...Option) (*Subscription, error) {
 	fnVal := reflect.ValueOf(fn)
 	if fnVal.Kind() != reflect.Func {
 		log.Error().Str("topic", topic).Msg("provided handler is not a function")
 		return nil, ErrInvalidFunction
 	}
 
+	s := p.newSubscription(ctx, KindQueue, topic, formatTopicKey(topic), opts...)
+	s.handler = fnVal
+	s.handlerType = fnVal.Type()
+	s.invoke = s.invokeReflect
+	return s, nil
+}
+
+// newSubscription 构造 Subscription，调用方负责设置 invoke
+func (p *PubSub) newSubscription(ctx context.Context, kind Kind, topic, redisKey string, opts ...Option) *Subscription {
 	subCtx, subCancel := context.WithCancel(ctx) // 创建一个独立的上下文，方便 Subscription.Stop()
 
-	s := Subscription{
+	s := &Subscription{
 		pubSub:      p,
+		id:          uuid.NewString(),
+		kind:        kind,
 		topic:       topic,
-		redisKey:    formatTopicKey(topic),
-		handler:     fnVal,
-		handlerType: fnVal.Type(),
+		redisKey:    redisKey,
 		concurrency: 1, // 默认并发为1
 		batchSize:   1, // 默认批量大小为1
 		dataChan:    make(chan []byte, defaultDataChanSize),
@@ -260,17 +476,23 @@ func (p *PubSub) Subscribe(ctx context.Context, topic string, fn any, opts ...Op
 	}
 
 	for _, opt := range opts {
-		opt(&s)
+		opt(s)
+	}
+
+	s.workerChans = make([]chan []byte, s.concurrency)
+	for i := range s.workerChans {
+		s.workerChans[i] = make(chan []byte, defaultDataChanSize)
 	}
+	return s
+}
 
+// addSubscription 将 Subscription 加入 PubSub 的跟踪列表
+func (p *PubSub) addSubscription(s *Subscription) {
 	p.mu.Lock()
-	p.subscriptions[topic] = append(p.subscriptions[topic], &s)
+	p.subscriptions[s.topic] = append(p.subscriptions[s.topic], s)
 	p.mu.Unlock()
 
 	p.wg.Add(1) // PubSub 等待此 Subscription
-
-	log.Trace().Str("topic", topic).Int("concurrency", s.concurrency).Int("batch_size", s.batchSize).Bool("recovery", s.useRecovery).Msg("new subscription created")
-	return &s, nil
 }
 
 // Close 关闭PubSub服务，停止所有订阅，并等待它们完成
@@ -308,13 +530,26 @@ func (p *PubSub) Close() error {
 // --- Subscription 方法 ---
 
 // Loop 启动订阅的处理循环
-// 它会启动一个goroutine用于BLMPOP，以及N个worker goroutine用于处理消息
+// 它会启动一个goroutine用于从队列Pop（广播订阅则为接收），以及N个worker goroutine用于处理消息
 func (s *Subscription) Loop() {
 	log.Trace().Str("topic", s.topic).Msg("subscription loop starting")
 
-	// 启动BLMPOP goroutine
-	s.wg.Add(1) // 为了BLMPOP goroutine
-	go s.blmpopLoop()
+	// 启动Pop goroutine，广播订阅则启动接收 goroutine
+	s.wg.Add(1) // 为了Pop/接收 goroutine
+	if s.broadcast {
+		go s.receiveLoop()
+	} else {
+		go func() {
+			defer s.wg.Done()
+			s.popLoop(s.ctx, s.redisKey)
+		}()
+	}
+
+	// 开启分区时启动分区租约 goroutine
+	if !s.broadcast && s.pubSub.partitions > 0 {
+		s.wg.Add(1)
+		go s.partitionLoop()
+	}
 
 	// 启动worker goroutines
 	for i := 0; i < s.concurrency; i++ {
@@ -324,56 +559,47 @@ func (s *Subscription) Loop() {
 	log.Info().Str("topic", s.topic).Int("workers", s.concurrency).Msg("subscription loop and workers started")
 }
 
-func (s *Subscription) blmpopLoop() {
-	defer s.wg.Done()
-	defer log.Trace().Str("topic", s.topic).Msg("blmpop loop stopped")
+// popLoop 从队列 key 中批量取出消息并分发给 worker，ctx 取消时退出
+func (s *Subscription) popLoop(ctx context.Context, key string) {
+	defer log.Trace().Str("topic", s.topic).Str("key", key).Msg("pop loop stopped")
 
-	log.Trace().Str("topic", s.topic).Int("batch_size", s.batchSize).Msg("blmpop loop started")
+	log.Trace().Str("topic", s.topic).Str("key", key).Int("batch_size", s.batchSize).Msg("pop loop started")
 	for {
 		select {
 		case <-s.stopChan: // 外部要求停止
 			return
-		case <-s.ctx.Done(): // 订阅上下文取消
+		case <-ctx.Done(): // 订阅上下文取消或失去分区租约
 			return
 		case <-s.pubSub.closed: // PubSub 关闭
 			return
 		default:
-			// BLMPop 从 Redis list 中批量阻塞弹出元素
-			// 返回值格式: key, values, error
-			key, values, err := s.pubSub.redisClient.BLMPop(s.ctx, blpopTimeout, "left", int64(s.batchSize), s.redisKey).Result()
+			// 从队列中批量阻塞弹出消息
+			payloads, err := s.pubSub.backend.Pop(ctx, key, s.batchSize, popTimeout)
 			if err != nil {
-				if errors.Is(err, redis.Nil) {
-					continue
-				}
-				if errors.Is(err, context.DeadlineExceeded) || strings.Contains(err.Error(), "context canceled") {
+				if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || strings.Contains(err.Error(), "context canceled") {
 					// 超时或上下文取消，继续循环检查 stopChan
-					log.Trace().Str("topic", s.topic).Msg("blmpop timed out or context canceled, retrying")
+					log.Trace().Str("topic", s.topic).Msg("pop timed out or context canceled, retrying")
 					continue
 				}
-				// 其他 Redis 错误
-				log.Error().Err(err).Str("topic", s.topic).Msg("blmpop failed")
+				// 其他后端错误
+				log.Error().Err(err).Str("topic", s.topic).Msg("pop failed")
 				// 考虑错误恢复策略，例如指数退避重试或停止订阅
 				// 为简单起见，这里在严重错误时短暂sleep后重试
 				time.Sleep(1 * time.Second)
 				continue
 			}
 
+			// 取出的消息少于批量大小说明队列已经取空
+			if len(payloads) < s.batchSize {
+				s.pubSub.metrics.QueueDepth(s.kind, s.topic, 0)
+			}
+
 			// 处理批量弹出的消息
-			if len(values) > 0 {
-				log.Trace().Str("topic", s.topic).Str("key", key).Int("batch_count", len(values)).Msg("messages received from blmpop")
-				for _, value := range values {
-					payload := []byte(value)
-					select {
-					case s.dataChan <- payload:
-						// 成功发送到处理通道
-					case <-s.stopChan:
-						log.Warn().Str("topic", s.topic).Msg("blmpop loop stopping, discarding remaining messages")
-						return
-					case <-s.ctx.Done():
-						log.Warn().Str("topic", s.topic).Msg("blmpop loop context done, discarding remaining messages")
-						return
-					case <-s.pubSub.closed:
-						log.Warn().Str("topic", s.topic).Msg("pubsub closed, blmpop loop stopping, discarding remaining messages")
+			if len(payloads) > 0 {
+				log.Trace().Str("topic", s.topic).Int("batch_count", len(payloads)).Msg("messages received from pop")
+				for _, payload := range payloads {
+					if !s.dispatch(payload) {
+						log.Warn().Str("topic", s.topic).Msg("pop loop stopping, discarding remaining messages")
 						return
 					}
 				}
@@ -382,6 +608,59 @@ func (s *Subscription) blmpopLoop() {
 	}
 }
 
+// receiveLoop 从广播监听者接收消息并分发给 worker
+func (s *Subscription) receiveLoop() {
+	defer s.wg.Done()
+	defer log.Trace().Str("topic", s.topic).Msg("broadcast receive loop stopped")
+
+	log.Trace().Str("topic", s.topic).Str("channel", s.redisKey).Msg("broadcast receive loop started")
+	for {
+		payload, err := s.listener.Receive(s.ctx)
+		select {
+		case <-s.stopChan:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-s.pubSub.closed:
+			return
+		default:
+		}
+		if err != nil {
+			log.Error().Err(err).Str("topic", s.topic).Msg("broadcast receive failed")
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		log.Trace().Str("topic", s.topic).Msg("message received from broadcast")
+		if !s.dispatch(payload) {
+			log.Warn().Str("topic", s.topic).Msg("broadcast receive loop stopping, discarding message")
+			return
+		}
+	}
+}
+
+// dispatch 将消息发送给 worker
+// 带分区键的消息按键的哈希固定发给同一个 worker，保证同一个键的消息按顺序逐条处理
+// 订阅停止时返回 false
+func (s *Subscription) dispatch(payload []byte) bool {
+	target := s.dataChan
+	if key := partitionKey(payload); key != "" {
+		target = s.workerChans[partitionIndex(key, len(s.workerChans))]
+	}
+
+	select {
+	case target <- payload:
+		// 成功发送到处理通道
+		return true
+	case <-s.stopChan:
+		return false
+	case <-s.ctx.Done():
+		return false
+	case <-s.pubSub.closed:
+		return false
+	}
+}
+
 func (s *Subscription) worker(workerId int) {
 	defer s.wg.Done()
 	defer log.Trace().Str("topic", s.topic).Int("worker_id", workerId).Msg("worker stopped")
@@ -401,13 +680,21 @@ func (s *Subscription) worker(workerId int) {
 				return
 			}
 			s.processMessage(workerId, payload)
+		case payload := <-s.workerChans[workerId]:
+			s.processMessage(workerId, payload)
 		}
 	}
 }
 
 func (s *Subscription) processMessage(workerId int, payload []byte) {
-	s.processingMu.Lock() // 确保在Stop时，不会有新的处理逻辑开始
-	defer s.processingMu.Unlock()
+	// 确保在Stop时，不会有新的处理逻辑开始；未开启并行处理时同一时刻只处理一条消息
+	if s.parallel {
+		s.processingMu.RLock()
+		defer s.processingMu.RUnlock()
+	} else {
+		s.processingMu.Lock()
+		defer s.processingMu.Unlock()
+	}
 
 	// 检查是否已经停止，防止在锁定后stopChan关闭但依然处理
 	select {
@@ -423,45 +710,76 @@ func (s *Subscription) processMessage(workerId int, payload []byte) {
 		defer func() {
 			if r := recover(); r != nil {
 				log.Error().Str("topic", s.topic).Int("worker_id", workerId).Interface("panic", r).Msg("recovered panic in subscription handler")
+				s.counters.panics.Add(1)
+				s.pubSub.metrics.Panicked(s.kind, s.topic)
 				// 可以加入堆栈打印: string(debug.Stack())
 			}
 		}()
 	}
 
+	// 解析消息头，构建处理函数的 context
+	headers, data := decodeEnvelope(payload)
+	if ms, err := strconv.ParseInt(headers[HeaderPublishedAt], 10, 64); err == nil {
+		s.pubSub.metrics.QueueLag(s.kind, s.topic, time.Since(time.UnixMilli(ms)))
+	}
+	ctx, cancel := s.messageContext(headers)
+	defer cancel()
+
+	// 调用处理函数
+	start := time.Now()
+	err := s.invoke(ctx, data)
+	s.pubSub.metrics.HandlerDuration(s.kind, s.topic, time.Since(start))
+	if err != nil {
+		log.Error().Err(err).Str("topic", s.topic).Int("worker_id", workerId).Bytes("payload", payload).Msg("subscription handler failed")
+		s.counters.failed.Add(1)
+		s.pubSub.metrics.Failed(s.kind, s.topic)
+		// 可以考虑将消息放入死信队列
+		return
+	}
+	s.counters.consumed.Add(1)
+	s.pubSub.metrics.Consumed(s.kind, s.topic)
+	log.Trace().Str("topic", s.topic).Int("worker_id", workerId).Msg("handler called successfully")
+}
+
+// invokeReflect 将 JSON 数组形式的 payload 反序列化为处理函数的参数并通过反射调用
+// 如果处理函数的第一个参数是 context.Context，则传入由消息头构建的 ctx，其余参数与消息参数一一对应
+func (s *Subscription) invokeReflect(ctx context.Context, payload []byte) error {
 	// 反序列化参数
 	var rawArgs []json.RawMessage
 	if err := json.Unmarshal(payload, &rawArgs); err != nil {
-		log.Error().Err(err).Str("topic", s.topic).Int("worker_id", workerId).Bytes("payload", payload).Msg("failed to unmarshal raw arguments from payload")
-		return
+		return fmt.Errorf("unmarshal raw arguments failed: %w", err)
 	}
 
 	numIn := s.handlerType.NumIn()
-	if len(rawArgs) != numIn {
-		log.Error().Str("topic", s.topic).Int("worker_id", workerId).Int("expected_args", numIn).Int("actual_args", len(rawArgs)).Msg("argument count mismatch")
-		// 可以考虑将消息放入死信队列
-		return
+	offset := 0
+	if numIn > 0 && s.handlerType.In(0) == contextType {
+		offset = 1
+	}
+	if len(rawArgs) != numIn-offset {
+		return fmt.Errorf("%w: expected %d, got %d", ErrArgMismatch, numIn-offset, len(rawArgs))
 	}
 
 	// 准备调用函数的参数
 	callArgs := make([]reflect.Value, numIn)
-	for i := 0; i < numIn; i++ {
+	if offset == 1 {
+		callArgs[0] = reflect.ValueOf(ctx)
+	}
+	for i := offset; i < numIn; i++ {
 		argType := s.handlerType.In(i)
 		// 创建该类型的零值指针，用于Unmarshal
 		valPtr := reflect.New(argType)
-		if err := json.Unmarshal(rawArgs[i], valPtr.Interface()); err != nil {
-			log.Error().Err(err).Str("topic", s.topic).Int("worker_id", workerId).Int("arg_index", i).Str("target_type", argType.String()).Bytes("raw_arg", rawArgs[i]).Msg("failed to unmarshal argument for handler")
-			// 可以考虑将消息放入死信队列
-			return
+		if err := json.Unmarshal(rawArgs[i-offset], valPtr.Interface()); err != nil {
+			return fmt.Errorf("unmarshal argument %d to %s failed: %w", i-offset, argType, err)
 		}
 		callArgs[i] = valPtr.Elem() // 获取指针指向的实际值
 	}
 
 	// 调用函数
 	s.handler.Call(callArgs)
-	log.Trace().Str("topic", s.topic).Int("worker_id", workerId).Msg("handler called successfully")
+	return nil
 }
 
-// Stop 停止订阅，关闭worker pool和BLPOP goroutine
+// Stop 停止订阅，关闭worker pool和Pop goroutine
 func (s *Subscription) Stop() error {
 	s.pubSub.mu.Lock() // 操作PubSub的subscriptions列表前加锁
 	// 从PubSub的跟踪中移除自己
@@ -481,20 +799,24 @@ func (s *Subscription) Stop() error {
 	s.pubSub.mu.Unlock()
 
 	s.processingMu.Lock() // 等待当前可能正在处理的消息完成或确保没有新的开始
-	defer s.processingMu.Unlock()
-
 	select {
 	case <-s.stopChan:
+		s.processingMu.Unlock()
 		log.Warn().Str("topic", s.topic).Msg("subscription already stopping or stopped")
 		// 已经关闭或正在关闭，PubSub的wg计数器可能已经减过
 		return ErrSubscriptionClosed
 	default:
 		close(s.stopChan) // 发送停止信号
-		s.cancel()        // 取消订阅的上下文，会影响BLPOP
+		s.cancel()        // 取消订阅的上下文，会影响Pop
+		if s.listener != nil {
+			_ = s.listener.Close() // 关闭广播监听
+		}
 		log.Info().Str("topic", s.topic).Msg("subscription stopping...")
 	}
+	// stopChan 已关闭，释放写锁，让等待中的 worker 看到停止信号后退出
+	s.processingMu.Unlock()
 
-	// 等待所有goroutine (blpopLoop, workers) 退出
+	// 等待所有goroutine (popLoop/receiveLoop, workers) 退出
 	// 这里可以设置一个超时，防止wg.Wait()无限等待
 	waitTimeout := time.After(10 * time.Second) // 例如10秒超时
 	done := make(chan struct{})
@@ -513,13 +835,13 @@ func (s *Subscription) Stop() error {
 
 	s.pubSub.wg.Done() // 通知PubSub，此Subscription已关闭
 
-	// 清理dataChan中可能残留的数据（理论上blpopLoop停止后不会再写入）
+	// 清理dataChan中可能残留的数据（理论上popLoop停止后不会再写入）
 	// 但为了安全，可以尝试清空，以防有worker在stopChan信号后仍尝试读取
 	// 这个操作不是必须的，因为goroutine都退出了，channel会被GC
 	// for len(s.dataChan) > 0 {
 	//	<-s.dataChan
 	// }
-	// close(s.dataChan) // dataChan 由 blpopLoop 写入，由 workers 读取，不应该在这里关闭
+	// close(s.dataChan) // dataChan 由 popLoop 写入，由 workers 读取，不应该在这里关闭
 
 	return nil
 }
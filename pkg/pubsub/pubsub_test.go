@@ -1,15 +1,24 @@
 package pubsub
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/goccy/go-json"
+	"github.com/play/play/pkg/meta"
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 // TestPubSubThroughput 测试 pubsub 的吞吐量
@@ -284,3 +293,1020 @@ func TestPubSubHighLoad(t *testing.T) {
 	fmt.Printf("Lag: %d (%.2f%%)\n", finalPublish-finalConsume,
 		float64(finalPublish-finalConsume)/float64(finalPublish)*100)
 }
+
+// TestPubSubBroadcast 测试广播订阅，每个订阅者都应收到每一条消息
+func TestPubSubBroadcast(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	ctx := context.Background()
+	ps := New(rdb, WithRecovery())
+	defer ps.Close()
+
+	const subscriberCount = 3
+	const messageCount = 5
+	var counts [subscriberCount]atomic.Int64
+	for i := 0; i < subscriberCount; i++ {
+		counter := &counts[i]
+		sub, err := ps.SubscribeBroadcast(ctx, "test_broadcast_topic", func(key string, version int) {
+			counter.Add(1)
+		}, WithConcurrency(2))
+		if err != nil {
+			t.Fatalf("Failed to subscribe broadcast: %v", err)
+		}
+		sub.Loop()
+	}
+
+	for i := 0; i < messageCount; i++ {
+		if err := ps.Broadcast(ctx, "test_broadcast_topic", "config", i); err != nil {
+			t.Fatalf("Failed to broadcast: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		done := true
+		for i := range counts {
+			if counts[i].Load() < messageCount {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := range counts {
+		if got := counts[i].Load(); got != messageCount {
+			t.Errorf("subscriber %d received %d messages, expected %d", i, got, messageCount)
+		}
+	}
+}
+
+// TestCodecRoundTrip 测试各个编解码器的编码和解码
+func TestCodecRoundTrip(t *testing.T) {
+	type order struct {
+		Id     int64  `json:"id" msgpack:"id"`
+		Status string `json:"status" msgpack:"status"`
+	}
+
+	for name, codec := range map[string]Codec{"json": JSONCodec, "msgpack": MsgpackCodec} {
+		data, err := codec.Marshal(order{Id: 1, Status: "paid"})
+		if err != nil {
+			t.Fatalf("%s marshal failed: %v", name, err)
+		}
+		var got order
+		if err := codec.Unmarshal(data, &got); err != nil {
+			t.Fatalf("%s unmarshal failed: %v", name, err)
+		}
+		if got.Id != 1 || got.Status != "paid" {
+			t.Errorf("%s round trip mismatch: %+v", name, got)
+		}
+	}
+
+	data, err := ProtoCodec.Marshal(wrapperspb.String("hello"))
+	if err != nil {
+		t.Fatalf("proto marshal failed: %v", err)
+	}
+	var got *wrapperspb.StringValue
+	if err := ProtoCodec.Unmarshal(data, &got); err != nil {
+		t.Fatalf("proto unmarshal failed: %v", err)
+	}
+	if got.GetValue() != "hello" {
+		t.Errorf("proto round trip mismatch: %q", got.GetValue())
+	}
+
+	if _, err := ProtoCodec.Marshal("not proto"); err == nil {
+		t.Error("expected error when marshaling non proto value")
+	}
+}
+
+// lpopBackend 用轮询 LPOP 代替 BLMPOP，miniredis 不支持 BLMPOP
+type lpopBackend struct {
+	*RedisBackend
+	rdb *redis.Client
+}
+
+func (b *lpopBackend) Pop(ctx context.Context, key string, n int, timeout time.Duration) ([][]byte, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		values, err := b.rdb.LPopCount(ctx, key, n).Result()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		if len(values) > 0 {
+			payloads := make([][]byte, 0, len(values))
+			for _, value := range values {
+				payloads = append(payloads, []byte(value))
+			}
+			return payloads, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// TestTopicRoundTrip 测试 Topic[T] 经过 Redis 队列的发布和订阅
+func TestTopicRoundTrip(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+
+	type order struct {
+		Id     int64  `json:"id"`
+		Status string `json:"status"`
+	}
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	ctx := context.Background()
+	ps := NewWithBackend(&lpopBackend{RedisBackend: NewRedisBackend(rdb), rdb: rdb})
+	defer ps.Close()
+
+	orders := NewTopic[order](ps, "test_topic_round_trip")
+	gotOrders := make(chan order, 2)
+	sub, err := orders.Subscribe(ctx, func(ctx context.Context, msg order) error {
+		gotOrders <- msg
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	sub.Loop()
+
+	names := NewTopic[*wrapperspb.StringValue](ps, "test_topic_round_trip_proto", WithCodec(ProtoCodec))
+	gotNames := make(chan string, 1)
+	sub, err = names.Subscribe(ctx, func(ctx context.Context, msg *wrapperspb.StringValue) error {
+		gotNames <- msg.GetValue()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to subscribe proto topic: %v", err)
+	}
+	sub.Loop()
+
+	if err := orders.Publish(ctx, order{Id: 1, Status: "paid"}, order{Id: 2, Status: "shipped"}); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	if err := names.Publish(ctx, wrapperspb.String("alice")); err != nil {
+		t.Fatalf("Failed to publish proto message: %v", err)
+	}
+
+	for _, want := range []order{{1, "paid"}, {2, "shipped"}} {
+		select {
+		case msg := <-gotOrders:
+			if msg != want {
+				t.Errorf("expected %+v, got %+v", want, msg)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("timed out waiting for message")
+		}
+	}
+	select {
+	case name := <-gotNames:
+		if name != "alice" {
+			t.Errorf("expected alice, got %q", name)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for proto message")
+	}
+}
+
+// TestPubSubContextPropagation 测试 meta 和消息头通过 envelope 传递到处理函数的 ctx
+func TestPubSubContextPropagation(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	ps := New(rdb, WithHeaders())
+	defer ps.Close()
+
+	type received struct {
+		userId    string
+		messageId string
+		name      string
+	}
+	got := make(chan received, 1)
+	sub, err := ps.SubscribeBroadcast(context.Background(), "test_ctx_topic", func(ctx context.Context, name string) {
+		got <- received{
+			userId:    meta.Get[string](ctx, meta.MetaUserId),
+			messageId: MessageId(ctx),
+			name:      name,
+		}
+	})
+	if err != nil {
+		t.Fatalf("Failed to subscribe broadcast: %v", err)
+	}
+	sub.Loop()
+
+	md := metadata.Pairs(meta.MetaUserId, "10086", meta.HeaderToken, "secret")
+	ctx := meta.FromContext(metadata.NewIncomingContext(context.Background(), md)).Context()
+	if err := ps.Broadcast(ctx, "test_ctx_topic", "alice"); err != nil {
+		t.Fatalf("Failed to broadcast: %v", err)
+	}
+
+	select {
+	case r := <-got:
+		if r.userId != "10086" {
+			t.Errorf("user id not propagated, got %q", r.userId)
+		}
+		if r.messageId == "" {
+			t.Error("message id should not be empty")
+		}
+		if r.name != "alice" {
+			t.Errorf("unexpected argument %q", r.name)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+}
+
+// TestDecodeEnvelope 测试新旧消息格式的解析
+func TestDecodeEnvelope(t *testing.T) {
+	headers, data := decodeEnvelope([]byte(`["alice",1]`))
+	if headers != nil || string(data) != `["alice",1]` {
+		t.Errorf("legacy payload should be returned as is, got headers=%v data=%s", headers, data)
+	}
+
+	payload, err := encodeEnvelope(map[string]string{HeaderMessageId: "m1"}, []byte(`["bob"]`))
+	if err != nil {
+		t.Fatalf("encode envelope failed: %v", err)
+	}
+	headers, data = decodeEnvelope(payload)
+	if headers[HeaderMessageId] != "m1" || string(data) != `["bob"]` {
+		t.Errorf("unexpected envelope decode result, got headers=%v data=%s", headers, data)
+	}
+
+	// Topic 的二进制消息帧，消息体不做 base64
+	body := []byte{0x00, 0xff, '{', 0x01}
+	payload, err = encodeFrame(map[string]string{HeaderMessageId: "m2", HeaderKey: "k1"}, body)
+	if err != nil {
+		t.Fatalf("encode frame failed: %v", err)
+	}
+	if len(payload) >= len(body)+100 {
+		t.Errorf("frame too large: %d bytes", len(payload))
+	}
+	headers, data = decodeEnvelope(payload)
+	if headers[HeaderMessageId] != "m2" || !bytes.Equal(data, body) {
+		t.Errorf("unexpected frame decode result, got headers=%v data=%v", headers, data)
+	}
+	if key := partitionKey(payload); key != "k1" {
+		t.Errorf("expected partition key k1, got %q", key)
+	}
+}
+
+// TestPublishFormat 测试默认发布与旧版本订阅方兼容的纯 JSON 数组，开启 WithHeaders 后才写入 envelope
+func TestPublishFormat(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	ctx := context.Background()
+	for name, opts := range map[string][]Option{"default": nil, "headers": {WithHeaders()}} {
+		ps := New(rdb, opts...)
+		topic := "test_format_" + name
+		if err := ps.Publish(ctx, topic, "alice", 1); err != nil {
+			t.Fatalf("%s: publish failed: %v", name, err)
+		}
+		if err := ps.PublishKeyed(ctx, topic, "k1", "bob", 2); err != nil {
+			t.Fatalf("%s: publish keyed failed: %v", name, err)
+		}
+		ps.Close()
+
+		values, err := rdb.LRange(ctx, formatTopicKey(topic), 0, -1).Result()
+		if err != nil || len(values) != 2 {
+			t.Fatalf("%s: unexpected queue %v, err %v", name, values, err)
+		}
+		plain, keyed := values[0], values[1]
+		if name == "default" && plain != `["alice",1]` {
+			t.Errorf("default publish should write a plain JSON array, got %s", plain)
+		}
+		if headers, data := decodeEnvelope([]byte(plain)); string(data) != `["alice",1]` || (name == "headers") != (headers != nil) {
+			t.Errorf("%s: unexpected payload %s", name, plain)
+		}
+		if headers, _ := decodeEnvelope([]byte(keyed)); headers[HeaderKey] != "k1" {
+			t.Errorf("%s: keyed message should carry the key header, got %s", name, keyed)
+		}
+	}
+}
+
+// TestDeadlinePropagation 测试截止时间只在开启 WithDeadlinePropagation 时传递
+func TestDeadlinePropagation(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+
+	for name, opts := range map[string][]Option{"default": nil, "enabled": {WithDeadlinePropagation()}} {
+		t.Run(name, func(t *testing.T) {
+			ps := NewMemory(opts...)
+			defer ps.Close()
+
+			got := make(chan bool, 1)
+			sub, err := ps.Subscribe(context.Background(), "test_deadline_topic", func(ctx context.Context, n int) {
+				_, ok := ctx.Deadline()
+				got <- ok
+			})
+			if err != nil {
+				t.Fatalf("Failed to subscribe: %v", err)
+			}
+			sub.Loop()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if err := ps.Publish(ctx, "test_deadline_topic", 1); err != nil {
+				t.Fatalf("Failed to publish: %v", err)
+			}
+
+			select {
+			case ok := <-got:
+				if ok != (opts != nil) {
+					t.Errorf("expected deadline %v, got %v", opts != nil, ok)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("timed out waiting for message")
+			}
+		})
+	}
+}
+
+// TestPubSubMetrics 测试指标收集、Stats 和 Prometheus 文本输出
+func TestPubSubMetrics(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	defer zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	ctx := context.Background()
+	metrics := NewMemoryMetrics()
+	ps := New(rdb, WithRecovery(), WithMetrics(metrics), WithQueueSize(2))
+	defer ps.Close()
+
+	sub, err := ps.SubscribeBroadcast(ctx, "test_metrics_topic", func(n int) {
+		if n < 0 {
+			panic("negative")
+		}
+	})
+	if err != nil {
+		t.Fatalf("Failed to subscribe broadcast: %v", err)
+	}
+	sub.Loop()
+
+	for _, n := range []int{1, 2, -1} {
+		if err := ps.Broadcast(ctx, "test_metrics_topic", n); err != nil {
+			t.Fatalf("Failed to broadcast: %v", err)
+		}
+	}
+
+	// 队列满时计入 dropped
+	if err := ps.Publish(ctx, "test_metrics_queue", []any{1}, []any{2}, []any{3}); err != ErrQueueFull {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+	if err := ps.Publish(ctx, "test_metrics_queue", 1); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+
+	// 同名的 Topic[T] 使用独立的队列和计数器
+	typed := NewTopic[int](ps, "test_metrics_queue")
+	if err := typed.Publish(ctx, 1, 2); err != nil {
+		t.Fatalf("Failed to publish typed: %v", err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		c := metrics.Snapshot()[TopicRef{Kind: KindBroadcast, Name: "test_metrics_topic"}]
+		if c.Consumed+c.Panics == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats, err := ps.Stats(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	topic := stats.Topic(KindBroadcast, "test_metrics_topic")
+	if topic == nil || topic.Counters.Published != 3 || topic.Counters.Consumed != 2 || topic.Counters.Panics != 1 {
+		t.Fatalf("unexpected topic stats: %+v", topic)
+	}
+	if len(topic.Subscriptions) != 1 || topic.Subscriptions[0].Consumed != 2 || topic.Subscriptions[0].Panics != 1 {
+		t.Errorf("unexpected subscription stats: %+v", topic.Subscriptions)
+	}
+	queue := stats.Topic(KindQueue, "test_metrics_queue")
+	if queue == nil || queue.QueueLength != 1 || queue.Counters.Dropped != 3 || queue.Counters.QueueDepth != 1 {
+		t.Errorf("unexpected queue stats: %+v", queue)
+	}
+	if data, err := json.Marshal(stats); err != nil || !bytes.Contains(data, []byte(`"topic:test_metrics_queue"`)) {
+		t.Errorf("unexpected stats json: %s, err: %v", data, err)
+	}
+	typedStats := stats.Topic(KindTopic, "test_metrics_queue")
+	if typedStats == nil || typedStats.QueueLength != 2 || typedStats.Counters.Published != 2 || typedStats.Counters.Dropped != 0 {
+		t.Errorf("unexpected typed topic stats: %+v", typedStats)
+	}
+
+	var buf bytes.Buffer
+	if err := metrics.WritePrometheus(&buf); err != nil {
+		t.Fatalf("Failed to write prometheus text: %v", err)
+	}
+	for _, line := range []string{
+		`pubsub_consumed_total{kind="broadcast",topic="test_metrics_topic"} 2`,
+		`pubsub_published_total{kind="queue",topic="test_metrics_queue"} 1`,
+		`pubsub_published_total{kind="topic",topic="test_metrics_queue"} 2`,
+		`pubsub_queue_depth{kind="topic",topic="test_metrics_queue"} 2`,
+		`pubsub_queue_lag_seconds{kind="broadcast",topic="test_metrics_topic"}`,
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("missing %q in prometheus output:\n%s", line, buf.String())
+		}
+	}
+}
+
+// TestPubSubOverflow 测试 Redis 和进程内后端的各个队列溢出策略
+func TestPubSubOverflow(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	defer zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	memory := NewMemoryBackend()
+	backends := map[string]struct {
+		backend Backend
+		values  func(key string) []string // 读取队列中的全部消息
+		popOne  func(key string)          // 从队列头部取出一条消息
+	}{
+		"redis": {
+			backend: NewRedisBackend(rdb),
+			values:  func(key string) []string { return rdb.LRange(context.Background(), key, 0, -1).Val() },
+			popOne:  func(key string) { rdb.LPop(context.Background(), key) },
+		},
+		"memory": {
+			backend: memory,
+			values: func(key string) []string {
+				memory.mu.Lock()
+				defer memory.mu.Unlock()
+				var values []string
+				for _, item := range memory.queue(key).items {
+					values = append(values, string(item))
+				}
+				return values
+			},
+			popOne: func(key string) { _, _ = memory.Pop(context.Background(), key, 1, time.Millisecond) },
+		},
+	}
+
+	for name, b := range backends {
+		t.Run(name, func(t *testing.T) {
+			testOverflow(t, b.backend, b.values, b.popOne)
+		})
+	}
+}
+
+func testOverflow(t *testing.T, backend Backend, values func(key string) []string, popOne func(key string)) {
+	ctx := context.Background()
+	ps := NewWithBackend(backend, WithQueueSize(3),
+		WithTopicOverflow("oldest", OverflowDropOldest),
+		WithTopicOverflow("newest", OverflowDropNewest),
+		WithTopicOverflow("block", OverflowBlock),
+		WithBlockTimeout(200*time.Millisecond),
+	)
+	defer ps.Close()
+
+	// 读取队列中的消息参数
+	queued := func(topic string) []int {
+		var got []int
+		for _, value := range values(formatTopicKey(topic)) {
+			_, data := decodeEnvelope([]byte(value))
+			var args []int
+			if err := json.Unmarshal(data, &args); err != nil {
+				t.Fatalf("unmarshal args failed: %v", err)
+			}
+			got = append(got, args...)
+		}
+		return got
+	}
+	publish := func(topic string, ns ...int) error {
+		batch := make([]any, 0, len(ns))
+		for _, n := range ns {
+			batch = append(batch, []any{n})
+		}
+		return ps.Publish(ctx, topic, batch...)
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		if err := publish("reject", 1, 2); err != nil {
+			t.Fatalf("publish failed: %v", err)
+		}
+		if err := publish("reject", 3, 4); err != ErrQueueFull {
+			t.Fatalf("expected ErrQueueFull, got %v", err)
+		}
+		if got := queued("reject"); fmt.Sprint(got) != "[1 2]" {
+			t.Errorf("unexpected queue %v", got)
+		}
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		if err := publish("oldest", 1, 2); err != nil {
+			t.Fatalf("publish failed: %v", err)
+		}
+		if err := publish("oldest", 3, 4); err != nil {
+			t.Fatalf("publish failed: %v", err)
+		}
+		if got := queued("oldest"); fmt.Sprint(got) != "[2 3 4]" {
+			t.Errorf("unexpected queue %v", got)
+		}
+	})
+
+	t.Run("drop newest", func(t *testing.T) {
+		if err := publish("newest", 1, 2); err != nil {
+			t.Fatalf("publish failed: %v", err)
+		}
+		if err := publish("newest", 3, 4); err != nil {
+			t.Fatalf("publish failed: %v", err)
+		}
+		if got := queued("newest"); fmt.Sprint(got) != "[1 2 3]" {
+			t.Errorf("unexpected queue %v", got)
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		if err := publish("block", 1, 2, 3); err != nil {
+			t.Fatalf("publish failed: %v", err)
+		}
+		start := time.Now()
+		if err := publish("block", 4); err != ErrQueueFull {
+			t.Fatalf("expected ErrQueueFull after timeout, got %v", err)
+		}
+		if time.Since(start) < 200*time.Millisecond {
+			t.Error("publish should block until timeout")
+		}
+
+		// 等待期间队列腾出空间后应写入成功
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			popOne(formatTopicKey("block"))
+		}()
+		if err := publish("block", 4); err != nil {
+			t.Fatalf("publish should succeed after queue drains, got %v", err)
+		}
+		if got := queued("block"); fmt.Sprint(got) != "[2 3 4]" {
+			t.Errorf("unexpected queue %v", got)
+		}
+	})
+}
+
+// TestSubscriptionKeyedOrder 测试相同分区键的消息按顺序处理，不同分区键并发处理
+func TestSubscriptionKeyedOrder(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+
+	ctx := context.Background()
+	ps := NewMemory(WithQueueSize(1000))
+	defer ps.Close()
+
+	const keyCount = 8
+	const messagesPerKey = 50
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	received := make(map[string][]int)
+	sub, err := ps.Subscribe(ctx, "test_keyed_topic", func(ctx context.Context, n int) {
+		defer wg.Done()
+		time.Sleep(time.Duration(n%3) * time.Millisecond) // 打乱处理耗时
+		mu.Lock()
+		received[Key(ctx)] = append(received[Key(ctx)], n)
+		mu.Unlock()
+	}, WithConcurrency(4), WithBatchSize(10), WithParallelProcessing())
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	sub.Loop()
+
+	wg.Add(keyCount * messagesPerKey)
+	for n := 0; n < messagesPerKey; n++ {
+		for k := 0; k < keyCount; k++ {
+			if err := ps.PublishKeyed(ctx, "test_keyed_topic", fmt.Sprintf("user-%d", k), n); err != nil {
+				t.Fatalf("Failed to publish: %v", err)
+			}
+		}
+	}
+	wg.Wait()
+
+	for k := 0; k < keyCount; k++ {
+		got := received[fmt.Sprintf("user-%d", k)]
+		if len(got) != messagesPerKey {
+			t.Fatalf("key user-%d received %d messages, expected %d", k, len(got), messagesPerKey)
+		}
+		for i, n := range got {
+			if n != i {
+				t.Fatalf("key user-%d out of order at %d: %v", k, i, got)
+			}
+		}
+	}
+}
+
+// TestSubscriptionSerialByDefault 测试未开启并行处理时，即使有多个 worker 同一时刻也只处理一条消息
+func TestSubscriptionSerialByDefault(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+
+	ctx := context.Background()
+	ps := NewMemory()
+	defer ps.Close()
+
+	var running, maxRunning atomic.Int64
+	var wg sync.WaitGroup
+	sub, err := ps.Subscribe(ctx, "test_serial_topic", func(n int) {
+		defer wg.Done()
+		cur := running.Add(1)
+		for {
+			old := maxRunning.Load()
+			if cur <= old || maxRunning.CompareAndSwap(old, cur) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		running.Add(-1)
+	}, WithConcurrency(4))
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	sub.Loop()
+
+	wg.Add(20)
+	for n := 0; n < 20; n++ {
+		if err := ps.Publish(ctx, "test_serial_topic", n); err != nil {
+			t.Fatalf("Failed to publish: %v", err)
+		}
+	}
+	wg.Wait()
+
+	if got := maxRunning.Load(); got != 1 {
+		t.Errorf("expected at most 1 message in flight, got %d", got)
+	}
+}
+
+// TestSubscriptionPartitions 测试分区队列在多个订阅之间只由一个订阅消费，并在持有者停止后被接管
+func TestSubscriptionPartitions(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+
+	ctx := context.Background()
+	ps := NewMemory(WithPartitions(4))
+	defer ps.Close()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	received := make(map[string][]int)
+	handledBy := make(map[string]map[int]bool) // key: 分区键，value: 处理过该键的订阅
+	subscribe := func(id int) *Subscription {
+		sub, err := ps.Subscribe(ctx, "test_partition_topic", func(ctx context.Context, n int) {
+			defer wg.Done()
+			mu.Lock()
+			defer mu.Unlock()
+			received[Key(ctx)] = append(received[Key(ctx)], n)
+			if handledBy[Key(ctx)] == nil {
+				handledBy[Key(ctx)] = make(map[int]bool)
+			}
+			handledBy[Key(ctx)][id] = true
+		}, WithConcurrency(4), WithParallelProcessing())
+		if err != nil {
+			t.Fatalf("Failed to subscribe: %v", err)
+		}
+		sub.Loop()
+		return sub
+	}
+	first := subscribe(1)
+	time.Sleep(50 * time.Millisecond) // 等待第一个订阅获取所有分区
+	subscribe(2)
+
+	const keyCount = 8
+	publish := func(from, to int) {
+		wg.Add(keyCount * (to - from))
+		for n := from; n < to; n++ {
+			for k := 0; k < keyCount; k++ {
+				if err := ps.PublishKeyed(ctx, "test_partition_topic", fmt.Sprintf("user-%d", k), n); err != nil {
+					t.Fatalf("Failed to publish: %v", err)
+				}
+			}
+		}
+		wg.Wait()
+	}
+
+	publish(0, 20)
+	for key, ids := range handledBy {
+		if len(ids) != 1 || !ids[1] {
+			t.Errorf("key %s should only be handled by the partition owner, got %v", key, ids)
+		}
+	}
+
+	// 持有者停止后释放租约，由另一个订阅接管
+	if err := first.Stop(); err != nil {
+		t.Fatalf("Failed to stop subscription: %v", err)
+	}
+	publish(20, 40)
+
+	for k := 0; k < keyCount; k++ {
+		key := fmt.Sprintf("user-%d", k)
+		got := received[key]
+		if len(got) != 40 {
+			t.Fatalf("key %s received %d messages, expected 40", key, len(got))
+		}
+		for i, n := range got {
+			if n != i {
+				t.Fatalf("key %s out of order at %d: %v", key, i, got)
+			}
+		}
+		if !handledBy[key][2] {
+			t.Errorf("key %s should be taken over by the second subscription", key)
+		}
+	}
+}
+
+// TestBackendClaim 测试两种后端的租约获取、续期和释放
+func TestBackendClaim(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	ctx := context.Background()
+	for name, backend := range map[string]Backend{"redis": NewRedisBackend(rdb), "memory": NewMemoryBackend()} {
+		t.Run(name, func(t *testing.T) {
+			claim := func(owner string, want bool) {
+				t.Helper()
+				claimed, err := backend.Claim(ctx, "test_lease", owner, time.Minute)
+				if err != nil || claimed != want {
+					t.Fatalf("claim by %s: expected %v, got %v (err: %v)", owner, want, claimed, err)
+				}
+			}
+			claim("a", true)
+			claim("a", true) // 续期
+			claim("b", false)
+			if err := backend.Release(ctx, "test_lease", "b"); err != nil {
+				t.Fatalf("release failed: %v", err)
+			}
+			claim("b", false)
+			if err := backend.Release(ctx, "test_lease", "a"); err != nil {
+				t.Fatalf("release failed: %v", err)
+			}
+			claim("b", true)
+		})
+	}
+}
+
+// TestMemoryPubSub 测试进程内后端的发布订阅、批量获取、并发和 recovery
+func TestMemoryPubSub(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	defer zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+
+	ctx := context.Background()
+	ps := NewMemory(WithQueueSize(100), WithRecovery())
+	defer ps.Close()
+
+	var consumed atomic.Int64
+	sub, err := ps.Subscribe(ctx, "test_memory_topic", func(name string, n int) {
+		if n < 0 {
+			panic("negative")
+		}
+		consumed.Add(1)
+	}, WithConcurrency(4), WithBatchSize(5))
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+
+	// Loop 启动前发布，消息应留在队列中
+	for i := 0; i < 20; i++ {
+		if err := ps.Publish(ctx, "test_memory_topic", "msg", i); err != nil {
+			t.Fatalf("Failed to publish: %v", err)
+		}
+	}
+	if err := ps.Publish(ctx, "test_memory_topic", "panic", -1); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	stats, err := ps.Stats(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	if got := stats.Topic(KindQueue, "test_memory_topic").QueueLength; got != 21 {
+		t.Fatalf("expected queue length 21, got %d", got)
+	}
+
+	sub.Loop()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) && consumed.Load() < 20 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := consumed.Load(); got != 20 {
+		t.Fatalf("consumed %d messages, expected 20", got)
+	}
+
+	// panic 的消息被 recovery，订阅继续工作
+	if err := ps.Publish(ctx, "test_memory_topic", "after panic", 1); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	deadline = time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) && consumed.Load() < 21 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := consumed.Load(); got != 21 {
+		t.Fatalf("consumed %d messages after panic, expected 21", got)
+	}
+
+	if err := sub.Stop(); err != nil {
+		t.Fatalf("Failed to stop subscription: %v", err)
+	}
+	if err := sub.Stop(); err != ErrSubscriptionClosed {
+		t.Errorf("expected ErrSubscriptionClosed on second stop, got %v", err)
+	}
+}
+
+// TestMemoryTopic 测试进程内后端上的 Topic[T]
+func TestMemoryTopic(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+
+	type order struct {
+		Id     int64  `msgpack:"id"`
+		Status string `msgpack:"status"`
+	}
+
+	ctx := context.Background()
+	ps := NewMemory(WithQueueSize(2))
+	defer ps.Close()
+
+	topic := NewTopic[order](ps, "test_typed_topic", WithCodec(MsgpackCodec))
+	if err := topic.Publish(ctx, order{Id: 1}, order{Id: 2}, order{Id: 3}); err != ErrQueueFull {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+
+	got := make(chan order, 2)
+	sub, err := topic.Subscribe(ctx, func(ctx context.Context, msg order) error {
+		if MessageId(ctx) == "" {
+			return fmt.Errorf("missing message id")
+		}
+		got <- msg
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	sub.Loop()
+
+	if err := topic.Publish(ctx, order{Id: 1, Status: "paid"}, order{Id: 2, Status: "shipped"}); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	for _, want := range []order{{1, "paid"}, {2, "shipped"}} {
+		select {
+		case msg := <-got:
+			if msg != want {
+				t.Errorf("expected %+v, got %+v", want, msg)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("timed out waiting for message")
+		}
+	}
+}
+
+// TestMemoryBroadcast 测试进程内后端的广播
+func TestMemoryBroadcast(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+
+	ctx := context.Background()
+	ps := NewMemory()
+	defer ps.Close()
+
+	var counts [2]atomic.Int64
+	for i := range counts {
+		counter := &counts[i]
+		sub, err := ps.SubscribeBroadcast(ctx, "test_memory_broadcast", func(version int) {
+			counter.Add(1)
+		})
+		if err != nil {
+			t.Fatalf("Failed to subscribe broadcast: %v", err)
+		}
+		sub.Loop()
+	}
+
+	if err := ps.Broadcast(ctx, "test_memory_broadcast", []any{1}, []any{2}, []any{3}); err != nil {
+		t.Fatalf("Failed to broadcast: %v", err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) && (counts[0].Load() < 3 || counts[1].Load() < 3) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := range counts {
+		if got := counts[i].Load(); got != 3 {
+			t.Errorf("subscriber %d received %d messages, expected 3", i, got)
+		}
+	}
+}
+
+// TestMemoryBroadcastSlowListener 测试广播不会被处理慢的监听者阻塞，缓冲已满时丢弃并计数
+func TestMemoryBroadcastSlowListener(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	defer zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+
+	ctx := context.Background()
+	metrics := NewMemoryMetrics()
+	ps := NewMemory(WithMetrics(metrics))
+	defer ps.Close()
+
+	// 不调用 Loop，监听者的缓冲不会被消费
+	if _, err := ps.SubscribeBroadcast(ctx, "test_memory_slow", func(n int) {}); err != nil {
+		t.Fatalf("Failed to subscribe broadcast: %v", err)
+	}
+
+	total := defaultDataChanSize + 10
+	batch := make([]any, 0, total)
+	for n := 0; n < total; n++ {
+		batch = append(batch, []any{n})
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- ps.Broadcast(ctx, "test_memory_slow", batch...)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Failed to broadcast: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("broadcast blocked on a full listener")
+	}
+
+	c := metrics.Snapshot()[TopicRef{Kind: KindBroadcast, Name: "test_memory_slow"}]
+	if c.Published != int64(total) || c.Dropped != 10 {
+		t.Errorf("expected published %d and dropped 10, got %+v", total, c)
+	}
+}
+
+// TestSubscriptionBuffered 测试 Buffered 包括 worker 通道中等待处理的消息
+func TestSubscriptionBuffered(t *testing.T) {
+	s := &Subscription{
+		dataChan:    make(chan []byte, 2),
+		workerChans: []chan []byte{make(chan []byte, 2), make(chan []byte, 2)},
+	}
+	s.dataChan <- []byte(`[1]`)
+	s.workerChans[0] <- []byte(`[2]`)
+	s.workerChans[1] <- []byte(`[3]`)
+	s.workerChans[1] <- []byte(`[4]`)
+	if buffered := s.stats().Buffered; buffered != 4 {
+		t.Errorf("expected 4 buffered messages, got %d", buffered)
+	}
+}
+
+// flakyClaimBackend 在 failing 时让 Claim 返回错误
+type flakyClaimBackend struct {
+	Backend
+	failing atomic.Bool
+}
+
+func (b *flakyClaimBackend) Claim(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	if b.failing.Load() {
+		return false, errors.New("connection reset")
+	}
+	return b.Backend.Claim(ctx, key, owner, ttl)
+}
+
+// TestPartitionClaimError 测试续期租约出错时继续消费已持有的分区
+func TestPartitionClaimError(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	defer zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+
+	ctx := context.Background()
+	backend := &flakyClaimBackend{Backend: NewMemoryBackend()}
+	ps := NewWithBackend(backend, WithPartitions(1))
+	defer ps.Close()
+
+	got := make(chan int, 1)
+	sub, err := ps.Subscribe(ctx, "test_partition_error", func(n int) { got <- n })
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	sub.Loop()
+	time.Sleep(50 * time.Millisecond) // 等待获取分区
+
+	// 至少经过一次出错的续期
+	backend.failing.Store(true)
+	time.Sleep(partitionRenewInterval + 500*time.Millisecond)
+	if err := ps.PublishKeyed(ctx, "test_partition_error", "k1", 1); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	select {
+	case n := <-got:
+		if n != 1 {
+			t.Errorf("unexpected message %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("partition should still be consumed while renewal fails")
+	}
+}
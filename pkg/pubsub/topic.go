@@ -0,0 +1,132 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+const typedKeyPrefix = "pubsub:typed:"
+
+// Topic 是类型安全的 topic，消息类型在编译期确定，处理消息时不经过反射
+// 使用独立的 Redis List，可以与 PubSub.Publish/Subscribe 同时使用
+type Topic[T any] struct {
+	pubSub   *PubSub
+	name     string
+	redisKey string
+	codec    Codec
+}
+
+// topicOptions 是 Topic 的配置
+type topicOptions struct {
+	codec Codec
+}
+
+// WithCodec 设置 Topic 的消息编解码器，默认为 JSONCodec
+func WithCodec(c Codec) Option {
+	return func(o any) {
+		if to, ok := o.(*topicOptions); ok && c != nil {
+			to.codec = c
+		}
+	}
+}
+
+func formatTypedKey(topic string) string {
+	return typedKeyPrefix + topic
+}
+
+// NewTopic 在 PubSub 上创建一个消息类型为 T 的 Topic
+func NewTopic[T any](ps *PubSub, name string, opts ...Option) *Topic[T] {
+	to := &topicOptions{codec: JSONCodec}
+	for _, opt := range opts {
+		opt(to)
+	}
+	return &Topic[T]{
+		pubSub:   ps,
+		name:     name,
+		redisKey: formatTypedKey(name),
+		codec:    to.codec,
+	}
+}
+
+// Name 返回 topic 名称
+func (t *Topic[T]) Name() string {
+	return t.name
+}
+
+// Publish 发布一条或多条消息，多条消息会一次性批量推送
+func (t *Topic[T]) Publish(ctx context.Context, msgs ...T) error {
+	return t.PublishKeyed(ctx, "", msgs...)
+}
+
+// PublishKeyed 发布带分区键的消息，相同 key 的消息在同一个订阅内按顺序逐条处理
+// 开启 WithPartitions 时跨订阅也按顺序处理，规则与 PubSub.PublishKeyed 相同
+func (t *Topic[T]) PublishKeyed(ctx context.Context, key string, msgs ...T) error {
+	select {
+	case <-t.pubSub.closed:
+		log.Error().Str("topic", t.name).Msg("cannot publish on closed pubsub")
+		return ErrPubSubClosed
+	default:
+	}
+
+	if len(msgs) == 0 {
+		log.Trace().Str("topic", t.name).Msg("no messages to publish")
+		return nil
+	}
+
+	payloads := make([][]byte, 0, len(msgs))
+	for i, msg := range msgs {
+		body, err := t.codec.Marshal(msg)
+		if err != nil {
+			log.Error().Err(err).Str("topic", t.name).Int("batch_index", i).Msg("failed to encode topic message")
+			return fmt.Errorf("encode failed for batch index %d: %w", i, err)
+		}
+		payload, err := encodeFrame(t.pubSub.newHeaders(ctx, key), body)
+		if err != nil {
+			log.Error().Err(err).Str("topic", t.name).Int("batch_index", i).Msg("failed to marshal message frame")
+			return fmt.Errorf("marshal frame failed for batch index %d: %w", i, err)
+		}
+		payloads = append(payloads, payload)
+	}
+	return t.pubSub.pushPayloads(ctx, KindTopic, t.name, t.pubSub.routeKey(t.redisKey, key), payloads)
+}
+
+// MustSubscribe 订阅 Topic，发生错误时panic
+func (t *Topic[T]) MustSubscribe(ctx context.Context, fn func(ctx context.Context, msg T) error, opts ...Option) *Subscription {
+	sub, err := t.Subscribe(ctx, fn, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// Subscribe 订阅 Topic，fn 返回的 error 会被记录到日志
+// fn 的 ctx 携带发布方的 meta 和追踪信息（开启 WithDeadlinePropagation 时还带有截止时间），可通过 Headers、MessageId 读取消息头
+// opts 与 PubSub.Subscribe 相同，返回的 Subscription 同样需要调用 Loop 启动
+func (t *Topic[T]) Subscribe(ctx context.Context, fn func(ctx context.Context, msg T) error, opts ...Option) (*Subscription, error) {
+	select {
+	case <-t.pubSub.closed:
+		log.Error().Str("topic", t.name).Msg("cannot subscribe on closed pubsub")
+		return nil, ErrPubSubClosed
+	default:
+	}
+
+	if fn == nil {
+		log.Error().Str("topic", t.name).Msg("provided handler is nil")
+		return nil, ErrInvalidFunction
+	}
+
+	s := t.pubSub.newSubscription(ctx, KindTopic, t.name, t.redisKey, opts...)
+	s.invoke = func(ctx context.Context, payload []byte) error {
+		var msg T
+		if err := t.codec.Unmarshal(payload, &msg); err != nil {
+			return fmt.Errorf("decode topic message failed: %w", err)
+		}
+		return fn(ctx, msg)
+	}
+	t.pubSub.addSubscription(s)
+
+	log.Trace().Str("topic", t.name).Int("concurrency", s.concurrency).Int("batch_size", s.batchSize).Bool("recovery", s.useRecovery).Msg("new topic subscription created")
+	return s, nil
+}
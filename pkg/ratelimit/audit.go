@@ -0,0 +1,169 @@
+package ratelimit
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/play/play/pkg/pubsub"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultAuditBuffer      = 1024 // 默认审计事件缓冲区大小
+	defaultAuditMatchedRate = 0.01 // 默认未被限流的请求的采样率
+	defaultAuditLimitedRate = 1    // 默认被限流的请求的采样率
+)
+
+// AuditEvent 是一次规则匹配的审计事件
+type AuditEvent struct {
+	Time       time.Time     `json:"time"`
+	Name       string        `json:"name"`      // 配置名称
+	Mode       string        `json:"mode"`      // 配置的模式
+	Path       string        `json:"path"`      // 请求路径
+	Method     string        `json:"method"`    // 请求方法
+	Key        string        `json:"key"`       // 限流键类型
+	KeyValue   string        `json:"key_value"` // 限流键值
+	Limited    bool          `json:"limited"`   // 是否超过限流，shadow 模式下超过限流但不拦截
+	Denied     bool          `json:"denied"`    // 是否命中黑名单
+	Limit      int           `json:"limit"`
+	Remaining  int           `json:"remaining"`
+	RetryAfter time.Duration `json:"retry_after"`
+}
+
+// AuditSink 接收采样后的审计事件，由后台 goroutine 调用
+type AuditSink interface {
+	Record(ctx context.Context, events ...AuditEvent) error
+}
+
+// AuditSinkFunc 将函数适配为 AuditSink
+type AuditSinkFunc func(ctx context.Context, events ...AuditEvent) error
+
+func (f AuditSinkFunc) Record(ctx context.Context, events ...AuditEvent) error {
+	return f(ctx, events...)
+}
+
+// NewPubSubAuditSink 返回将审计事件发布到 pubsub topic 的 AuditSink
+// 消费方使用 pubsub.NewTopic[ratelimit.AuditEvent] 订阅同名 topic
+func NewPubSubAuditSink(ps *pubsub.PubSub, topic string) AuditSink {
+	t := pubsub.NewTopic[AuditEvent](ps, topic)
+	return AuditSinkFunc(func(ctx context.Context, events ...AuditEvent) error {
+		return t.Publish(ctx, events...)
+	})
+}
+
+// WithAudit 设置审计事件的接收方
+func WithAudit(sink AuditSink) ManagerOption {
+	return func(m *RateLimiterManager) {
+		m.audit.sink = sink
+	}
+}
+
+// WithAuditSampling 设置审计事件的采样率，取值 0~1
+// matched 为匹配规则但未被限流的请求的采样率，limited 为被限流（包括 shadow 模式）的请求的采样率
+func WithAuditSampling(matched, limited float64) ManagerOption {
+	return func(m *RateLimiterManager) {
+		m.audit.matchedRate = matched
+		m.audit.limitedRate = limited
+	}
+}
+
+// RuleStats 是单个规则的计数
+type RuleStats struct {
+	Matched       int64 `json:"matched"`        // 匹配的请求数
+	Limited       int64 `json:"limited"`        // 被限流的请求数
+	ShadowLimited int64 `json:"shadow_limited"` // shadow 模式下超过限流但未拦截的请求数
+}
+
+// ruleCounters 是单个规则的计数器
+type ruleCounters struct {
+	matched       atomic.Int64
+	limited       atomic.Int64
+	shadowLimited atomic.Int64
+}
+
+// auditor 负责规则计数和审计事件的采样与异步发送
+type auditor struct {
+	sink        AuditSink
+	matchedRate float64
+	limitedRate float64
+	events      chan AuditEvent
+	dropped     atomic.Int64 // 缓冲区已满被丢弃的事件数
+	rules       sync.Map     // key: 配置名称, value: *ruleCounters
+}
+
+func newAuditor() *auditor {
+	return &auditor{
+		matchedRate: defaultAuditMatchedRate,
+		limitedRate: defaultAuditLimitedRate,
+	}
+}
+
+// counters 获取或创建规则的计数器
+func (a *auditor) counters(name string) *ruleCounters {
+	if c, ok := a.rules.Load(name); ok {
+		return c.(*ruleCounters)
+	}
+	c, _ := a.rules.LoadOrStore(name, &ruleCounters{})
+	return c.(*ruleCounters)
+}
+
+// record 更新规则计数，按采样率将事件放入缓冲区，缓冲区已满时丢弃
+func (a *auditor) record(event AuditEvent, shadow bool) {
+	c := a.counters(event.Name)
+	c.matched.Add(1)
+	rate := a.matchedRate
+	if event.Limited {
+		rate = a.limitedRate
+		if shadow {
+			c.shadowLimited.Add(1)
+		} else {
+			c.limited.Add(1)
+		}
+	}
+
+	if a.events == nil || rate <= 0 || (rate < 1 && rand.Float64() >= rate) {
+		return
+	}
+	select {
+	case a.events <- event:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// run 批量发送缓冲区中的审计事件，直到 ctx 取消
+func (a *auditor) run(ctx context.Context) {
+	batch := make([]AuditEvent, 0, 100)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-a.events:
+			batch = append(batch[:0], event)
+			for len(batch) < cap(batch) && len(a.events) > 0 {
+				batch = append(batch, <-a.events)
+			}
+			if err := a.sink.Record(ctx, batch...); err != nil {
+				log.Error().Err(err).Int("count", len(batch)).Msg("failed to record rate limit audit events")
+			}
+		}
+	}
+}
+
+// stats 返回每个规则的计数
+func (a *auditor) stats() map[string]RuleStats {
+	stats := make(map[string]RuleStats)
+	a.rules.Range(func(key, value any) bool {
+		c := value.(*ruleCounters)
+		stats[key.(string)] = RuleStats{
+			Matched:       c.matched.Load(),
+			Limited:       c.limited.Load(),
+			ShadowLimited: c.shadowLimited.Load(),
+		}
+		return true
+	})
+	return stats
+}
@@ -0,0 +1,182 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultLeaseTTL   = time.Minute     // 默认的并发名额租约时长
+	releaseTimeout    = 3 * time.Second // 释放 Redis 租约的超时时间
+	inflightKeySuffix = ":inflight"     // Redis 并发限流器键的后缀
+)
+
+// ConcurrencyLimiter 并发（在途请求）限流器接口
+type ConcurrencyLimiter interface {
+	// Acquire 获取一个并发名额，d.Limited 为 true 表示名额已满
+	// 返回的 release 用于释放名额，可以重复调用，获取失败时为空操作
+	// 持有者崩溃未释放时，名额在租约到期后自动释放
+	Acquire(ctx context.Context) (release func(), d Decision)
+}
+
+// noopRelease 获取失败时返回的释放函数
+func noopRelease() {}
+
+// MemoryConcurrencyLimit 基于内存的并发限流器，实例是线程安全的
+type MemoryConcurrencyLimit struct {
+	mu     sync.Mutex
+	max    int
+	ttl    time.Duration
+	seq    uint64
+	leases map[uint64]time.Time // key: 租约ID，value: 到期时间
+}
+
+// NewMemoryConcurrency 创建一个新的基于内存的并发限流器，最多允许 max 个在途请求
+func NewMemoryConcurrency(max int, ttl time.Duration) *MemoryConcurrencyLimit {
+	if max < 1 {
+		max = 1
+	}
+	if ttl <= 0 {
+		ttl = defaultLeaseTTL
+	}
+	return &MemoryConcurrencyLimit{
+		max:    max,
+		ttl:    ttl,
+		leases: make(map[uint64]time.Time),
+	}
+}
+
+// Acquire 获取一个并发名额
+func (cl *MemoryConcurrencyLimit) Acquire(_ context.Context) (func(), Decision) {
+	now := time.Now()
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.expire(now)
+	d := Decision{Limit: cl.max}
+	if len(cl.leases) >= cl.max {
+		d.Limited = true
+		return noopRelease, d
+	}
+
+	cl.seq++
+	id := cl.seq
+	cl.leases[id] = now.Add(cl.ttl)
+	d.Remaining = cl.max - len(cl.leases)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cl.mu.Lock()
+			delete(cl.leases, id)
+			cl.mu.Unlock()
+		})
+	}, d
+}
+
+// InFlight 返回当前在途请求数量，包括尚未清理的已到期租约
+func (cl *MemoryConcurrencyLimit) InFlight() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return len(cl.leases)
+}
+
+// idle 清理已到期的租约，返回是否没有在途请求
+func (cl *MemoryConcurrencyLimit) idle() bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.expire(time.Now())
+	return len(cl.leases) == 0
+}
+
+// expire 清理已到期的租约，调用方需持有 mu
+func (cl *MemoryConcurrencyLimit) expire(now time.Time) {
+	for id, expireAt := range cl.leases {
+		if !now.Before(expireAt) {
+			delete(cl.leases, id)
+		}
+	}
+}
+
+// acquireScript 原子性地清理到期租约并获取一个并发名额
+// 租约保存在 ZSET 中，score 为到期时间，时间以 Redis 服务端 TIME 为准（毫秒）
+// KEYS[1]: 租约 ZSET
+// ARGV[1]: 最大并发数
+// ARGV[2]: 租约时长（毫秒）
+// ARGV[3]: 租约ID
+// 返回 {是否获取成功, 当前在途请求数}
+var acquireScript = redis.NewScript(`
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local max = tonumber(ARGV[1])
+local ttl = tonumber(ARGV[2])
+
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now)
+local count = redis.call("ZCARD", KEYS[1])
+if count >= max then
+    return {0, count}
+end
+
+redis.call("ZADD", KEYS[1], now + ttl, ARGV[3])
+redis.call("PEXPIRE", KEYS[1], ttl)
+return {1, count + 1}
+`)
+
+// RedisConcurrencyLimit 基于 Redis 的并发限流器，多个实例共享名额
+type RedisConcurrencyLimit struct {
+	rdb redis.Cmdable
+	key string
+	max int
+	ttl time.Duration
+}
+
+// NewRedisConcurrency 创建一个新的基于 Redis 的并发限流器，最多允许 max 个在途请求
+func NewRedisConcurrency(rdb redis.Cmdable, key string, max int, ttl time.Duration) *RedisConcurrencyLimit {
+	if max < 1 {
+		max = 1
+	}
+	if ttl <= 0 {
+		ttl = defaultLeaseTTL
+	}
+	return &RedisConcurrencyLimit{
+		rdb: rdb,
+		key: key,
+		max: max,
+		ttl: ttl,
+	}
+}
+
+// Acquire 获取一个并发名额，Redis 出错时允许请求通过
+func (cl *RedisConcurrencyLimit) Acquire(ctx context.Context) (func(), Decision) {
+	id := uuid.NewString()
+	d := Decision{Limit: cl.max}
+
+	result, err := acquireScript.Run(ctx, cl.rdb, []string{cl.key}, cl.max, cl.ttl.Milliseconds(), id).Int64Slice()
+	if err != nil {
+		d.Remaining = cl.max
+		return noopRelease, d // 出错时允许请求通过
+	}
+	if result[0] == 0 {
+		d.Limited = true
+		return noopRelease, d
+	}
+	d.Remaining = cl.max - int(result[1])
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			// 请求的 ctx 可能已经取消，使用独立的 ctx 释放
+			ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+			defer cancel()
+			if err := cl.rdb.ZRem(ctx, cl.key, id).Err(); err != nil {
+				log.Error().Err(err).Str("key", cl.key).Msg("failed to release concurrency lease")
+			}
+		})
+	}, d
+}
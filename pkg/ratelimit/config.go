@@ -0,0 +1,264 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrConfigNotFound  = errors.New("rate limit config not found")
+	ErrVersionNotFound = errors.New("rate limit config version not found")
+)
+
+// ConfigVersion 是配置的一个历史版本
+type ConfigVersion struct {
+	Version   int64  `json:"version"`
+	Config    string `json:"config"`     // 配置 JSON，为空表示该版本删除了配置
+	UpdatedAt int64  `json:"updated_at"` // 更新时间，Unix 毫秒
+}
+
+// saveConfigScript 原子性地保存配置、记录历史版本并发送变更通知
+// KEYS[1]: 配置 Hash
+// KEYS[2]: 版本号 Hash，key: 配置名称
+// KEYS[3]: 历史版本 List，最新的在前
+// ARGV[1]: 配置名称
+// ARGV[2]: 配置 JSON，为空表示删除
+// ARGV[3]: 更新时间，Unix 毫秒
+// ARGV[4]: 保留的历史版本数量
+// ARGV[5]: 变更通知 channel
+// 返回新的版本号
+var saveConfigScript = redis.NewScript(`
+local version = redis.call("HINCRBY", KEYS[2], ARGV[1], 1)
+local entry = '{"version":' .. version .. ',"config":' .. cjson.encode(ARGV[2]) .. ',"updated_at":' .. ARGV[3] .. '}'
+redis.call("LPUSH", KEYS[3], entry)
+redis.call("LTRIM", KEYS[3], 0, tonumber(ARGV[4]) - 1)
+
+if ARGV[2] == "" then
+    redis.call("HDEL", KEYS[1], ARGV[1])
+else
+    redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+end
+
+redis.call("PUBLISH", ARGV[5], ARGV[1])
+return version
+`)
+
+// subscriber 是支持 Redis SUBSCRIBE 的客户端
+type subscriber interface {
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+}
+
+// keyPrefix 返回配置相关键的前缀，与配置 Hash 使用相同的 hash tag，保证 saveConfigScript 的键在 Redis Cluster 的同一个 slot
+// configKey 已包含 hash tag 时直接使用，否则将整个 configKey 作为 hash tag，与不带 hash tag 的 configKey 位于同一个 slot
+func (m *RateLimiterManager) keyPrefix() string {
+	if i := strings.IndexByte(m.configKey, '{'); i >= 0 {
+		if j := strings.IndexByte(m.configKey[i+1:], '}'); j > 0 {
+			return m.configKey
+		}
+	}
+	return "{" + m.configKey + "}"
+}
+
+// errorsKey 返回记录无效配置的 Hash 键
+func (m *RateLimiterManager) errorsKey() string {
+	return m.keyPrefix() + ":errors"
+}
+
+// versionKey 返回记录配置版本号的 Hash 键
+func (m *RateLimiterManager) versionKey() string {
+	return m.keyPrefix() + ":version"
+}
+
+// versionsKey 返回记录配置历史版本的 List 键
+func (m *RateLimiterManager) versionsKey(name string) string {
+	return m.keyPrefix() + ":versions:" + name
+}
+
+// parseConfig 解析并校验配置，strict 的含义见 RateLimitConfig.compile
+func (m *RateLimiterManager) parseConfig(name, configJSON string, strict bool) (*RateLimitConfig, error) {
+	var cfg RateLimitConfig
+	if err := json.Unmarshal([]byte(configJSON), &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if err := cfg.compile(name, m.extractors, strict); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// ValidateConfig 校验配置，返回无效的原因，如正则表达式错误、未注册的限流键类型、重复的时间窗口等
+// 与加载 Redis 中已有配置时不同，保存前的校验不兼容旧版本配置中未注册的限流键类型和为 0 的 count、duration
+func (m *RateLimiterManager) ValidateConfig(name string, cfg *RateLimitConfig) error {
+	configJSON, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = m.parseConfig(name, string(configJSON), true)
+	return err
+}
+
+// ConfigErrors 返回最近一次加载时无效的配置及原因，key: 配置名称
+func (m *RateLimiterManager) ConfigErrors() map[string]string {
+	return m.configErrors.Load().(map[string]string)
+}
+
+// reportErrors 将无效的配置写入 "{<configKey>}:errors"，便于运维人员查看
+// 每次加载都重写会让所有实例在每个重载周期都写 Redis，因此只在无效配置与上次写入的不同时写入，调用方需持有 loadMu
+func (m *RateLimiterManager) reportErrors(ctx context.Context, configErrors map[string]string) {
+	if m.reported != nil && maps.Equal(m.reported, configErrors) {
+		return
+	}
+	_, err := m.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, m.errorsKey())
+		if len(configErrors) > 0 {
+			pipe.HSet(ctx, m.errorsKey(), configErrors)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to report invalid rate limit configs")
+		return
+	}
+	m.reported = configErrors
+}
+
+// SetConfig 校验并保存配置，记录新的历史版本并通知所有实例立即重载，返回新的版本号
+func (m *RateLimiterManager) SetConfig(ctx context.Context, name string, cfg *RateLimitConfig) (int64, error) {
+	if err := m.ValidateConfig(name, cfg); err != nil {
+		return 0, err
+	}
+	configJSON, err := json.Marshal(cfg)
+	if err != nil {
+		return 0, err
+	}
+	return m.saveConfig(ctx, name, string(configJSON))
+}
+
+// DeleteConfig 删除配置，删除操作同样记录为一个历史版本，可以回滚
+func (m *RateLimiterManager) DeleteConfig(ctx context.Context, name string) (int64, error) {
+	return m.saveConfig(ctx, name, "")
+}
+
+// saveConfig 保存配置 JSON，为空表示删除
+func (m *RateLimiterManager) saveConfig(ctx context.Context, name, configJSON string) (int64, error) {
+	keys := []string{m.configKey, m.versionKey(), m.versionsKey(name)}
+	version, err := saveConfigScript.Run(ctx, m.rdb, keys, name, configJSON, time.Now().UnixMilli(), m.maxVersions, m.notifyChannel).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to save rate limit config: %w", err)
+	}
+	log.Info().Str("name", name).Int64("version", version).Bool("deleted", configJSON == "").Msg("rate limit config saved")
+	return version, nil
+}
+
+// Versions 返回配置的历史版本，最新的在前
+func (m *RateLimiterManager) Versions(ctx context.Context, name string) ([]ConfigVersion, error) {
+	entries, err := m.rdb.LRange(ctx, m.versionsKey(name), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]ConfigVersion, 0, len(entries))
+	for _, entry := range entries {
+		var v ConfigVersion
+		if err := json.Unmarshal([]byte(entry), &v); err != nil {
+			return nil, fmt.Errorf("failed to parse config version: %w", err)
+		}
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+// Rollback 将配置回滚到指定版本，version <= 0 表示回滚到上一个版本
+// 回滚本身也会记录为一个新的版本，返回新的版本号
+func (m *RateLimiterManager) Rollback(ctx context.Context, name string, version int64) (int64, error) {
+	versions, err := m.Versions(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	if len(versions) == 0 {
+		return 0, ErrConfigNotFound
+	}
+
+	var target *ConfigVersion
+	if version <= 0 {
+		if len(versions) < 2 {
+			return 0, ErrVersionNotFound
+		}
+		target = &versions[1]
+	} else {
+		for i := range versions {
+			if versions[i].Version == version {
+				target = &versions[i]
+				break
+			}
+		}
+		if target == nil {
+			return 0, fmt.Errorf("%w: %d", ErrVersionNotFound, version)
+		}
+	}
+
+	// 历史版本在保存时已校验，但限流键类型可能已不再注册
+	if target.Config != "" {
+		if _, err := m.parseConfig(name, target.Config, true); err != nil {
+			return 0, err
+		}
+	}
+
+	log.Info().Str("name", name).Int64("version", target.Version).Msg("rolling back rate limit config")
+	return m.saveConfig(ctx, name, target.Config)
+}
+
+// subscribe 订阅配置变更通知，返回时订阅已经生效
+// 客户端不支持订阅或订阅失败时返回 nil，仅依赖轮询
+func (m *RateLimiterManager) subscribe() *redis.PubSub {
+	sub, ok := m.rdb.(subscriber)
+	if !ok {
+		log.Warn().Msg("redis client does not support subscribe, rate limit configs are reloaded by polling only")
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(m.ctx, 5*time.Second)
+	defer cancel()
+
+	ps := sub.Subscribe(m.ctx, m.notifyChannel)
+	if _, err := ps.Receive(ctx); err != nil {
+		log.Error().Err(err).Str("channel", m.notifyChannel).Msg("failed to subscribe rate limit config notification")
+		_ = ps.Close()
+		return nil
+	}
+	return ps
+}
+
+// watchConfigLoop 收到配置变更通知后立即重载配置，订阅断开期间的通知由轮询兜底
+func (m *RateLimiterManager) watchConfigLoop(ps *redis.PubSub) {
+	defer ps.Close()
+
+	for {
+		msg, err := ps.ReceiveMessage(m.ctx)
+		if err != nil {
+			if m.ctx.Err() != nil {
+				return
+			}
+			log.Error().Err(err).Str("channel", m.notifyChannel).Msg("failed to receive rate limit config notification")
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		log.Debug().Str("channel", msg.Channel).Str("payload", msg.Payload).Msg("rate limit config changed")
+		if err := m.loadConfig(); err != nil {
+			log.Error().Err(err).Msg("failed to reload rate limit configs")
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// 限流结果对应的响应头
+const (
+	HeaderRetryAfter         = "Retry-After"           // 被限流时需要等待的秒数
+	HeaderRateLimitLimit     = "X-RateLimit-Limit"     // 时间窗口内允许的请求数量
+	HeaderRateLimitRemaining = "X-RateLimit-Remaining" // 剩余的请求数量
+	HeaderRateLimitReset     = "X-RateLimit-Reset"     // 配额完全恢复的时间，Unix 秒
+)
+
+// newDecision 根据 Lua 脚本的返回值构建限流结果
+// result: {是否限流, 需要等待的微秒数, 剩余请求数, 配额完全恢复的微秒数}
+func newDecision(rate int, result []int64) Decision {
+	return Decision{
+		Limited:    result[0] == 1,
+		Limit:      rate,
+		Remaining:  int(result[2]),
+		Reset:      time.Now().Add(time.Duration(result[3]) * time.Microsecond),
+		RetryAfter: time.Duration(result[1]) * time.Microsecond,
+	}
+}
+
+// Headers 返回限流结果对应的响应头，Retry-After 仅在被限流时返回
+func (d *Decision) Headers() map[string]string {
+	headers := map[string]string{
+		HeaderRateLimitLimit:     strconv.Itoa(d.Limit),
+		HeaderRateLimitRemaining: strconv.Itoa(max(d.Remaining, 0)),
+	}
+	if !d.Reset.IsZero() {
+		headers[HeaderRateLimitReset] = strconv.FormatInt(int64(math.Ceil(float64(d.Reset.UnixMilli())/1000)), 10)
+	}
+	if d.Limited {
+		// Retry-After 以秒为单位，向上取整，至少为 1 秒
+		headers[HeaderRetryAfter] = strconv.FormatInt(max(int64(math.Ceil(d.RetryAfter.Seconds())), 1), 10)
+	}
+	return headers
+}
+
+// SetHeaders 将限流结果写入 HTTP 响应头
+func (d *Decision) SetHeaders(h http.Header) {
+	for key, value := range d.Headers() {
+		h.Set(key, value)
+	}
+}
+
+// Metadata 返回限流结果对应的 gRPC 响应头
+func (d *Decision) Metadata() metadata.MD {
+	md := metadata.MD{}
+	for key, value := range d.Headers() {
+		md.Set(key, value)
+	}
+	return md
+}
@@ -2,30 +2,196 @@ package ratelimit
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"regexp"
+	"slices"
 	"time"
+
+	"github.com/rs/zerolog/log"
 )
 
 const (
 	defaultConfigKey = "ratelimit:config" // 默认配置在 Redis 中的键名
 	defaultInterval  = time.Minute        // 默认配置重载间隔
+	defaultLimiters  = 100000             // 默认最多保留的限流器数量
+
+	defaultMaxVersions = 20 // 默认每个配置保留的历史版本数量
+)
+
+// 限流算法，仅在启用 Redis 限流时生效，内存限流器始终使用令牌桶
+const (
+	AlgorithmSlidingWindow = "sliding-window" // 基于 ZSET 的滑动日志（默认），每个请求占用一个成员
+	AlgorithmGCRA          = "gcra"           // GCRA，每个键 O(1) 内存
+	AlgorithmTokenBucket   = "token-bucket"   // 令牌桶，每个键 O(1) 内存
+)
+
+// 规则的模式
+const (
+	ModeEnforce = "enforce" // 超过限流时拦截请求（默认）
+	ModeShadow  = "shadow"  // 仅记录和计数，不拦截请求，用于上线新规则前观察效果
 )
 
 // RateLimiter 限流器接口
 type RateLimiter interface {
+	// Limit 超过限流时返回 true
 	Limit(ctx context.Context) bool
+	// Decide 检查并记录一次请求，返回包含剩余配额的限流结果
+	Decide(ctx context.Context) Decision
+}
+
+// Decision 是一次限流检查的结果
+type Decision struct {
+	Limited    bool          // 是否被限流
+	Name       string        // 匹配的配置名称，仅由 RateLimiterManager 设置
+	Limit      int           // 时间窗口内允许的请求数量
+	Remaining  int           // 本次请求之后剩余的请求数量
+	Reset      time.Time     // 配额完全恢复的时间，为零值表示未知
+	RetryAfter time.Duration // 被限流时需要等待的时间
+}
+
+// RateLimitWindow 是一个限流时间窗口
+type RateLimitWindow struct {
+	Count    int           `json:"count"`    // 允许的请求数量
+	Duration time.Duration `json:"duration"` // 时间窗口
 }
 
 // RateLimitConfig 特定路径的限流配置
 type RateLimitConfig struct {
-	Path     string        `json:"path"`     // 路径模式（支持正则表达式）
-	Methods  []string      `json:"methods"`  // HTTP 方法列表 ["GET", "POST" 等]
-	Count    int           `json:"count"`    // 允许的请求数量
-	Duration time.Duration `json:"duration"` // 时间窗口（如 "1s", "1m"）
-	Key      string        `json:"key"`      // 限流键类型: "device-id", "user-ip", "token"，为空表示仅按 path+method 限流
+	Path      string            `json:"path"`      // 路径模式（支持正则表达式）
+	Methods   []string          `json:"methods"`   // HTTP 方法列表 ["GET", "POST" 等]
+	Count     int               `json:"count"`     // 允许的请求数量
+	Duration  time.Duration     `json:"duration"`  // 时间窗口（如 "1s", "1m"）
+	Windows   []RateLimitWindow `json:"windows"`   // 额外的时间窗口，与 Count/Duration 同时生效，如 10/s 和 500/h
+	Key       string            `json:"key"`       // 限流键类型: "device-id", "user-ip", "token", "path" 或自定义类型，多个用 "+" 组合，为空表示仅按 path+method 限流
+	Algorithm string            `json:"algorithm"` // 限流算法: "sliding-window", "gcra", "token-bucket"，为空表示 "sliding-window"
+	Priority  int               `json:"priority"`  // 优先级，值越大越先检查，相同时按配置名称排序
+	Allow     []string          `json:"allow"`     // 不受该规则限制的键值，组合键各部分用 "|" 连接
+	Deny      []string          `json:"deny"`      // 总是被该规则限流的键值
+	Mode      string            `json:"mode"`      // 模式: "enforce", "shadow"，为空表示 "enforce"
+
+	Concurrency int           `json:"concurrency"` // 最大在途请求数量，0 表示不限制，可以与时间窗口同时使用
+	LeaseTTL    time.Duration `json:"lease_ttl"`   // 并发名额的租约时长，持有者崩溃时到期自动释放，应大于最长的请求耗时，默认 1 分钟
 
 	// 内部字段
 	pathRegexp *regexp.Regexp
 	methodsMap map[string]bool
-	name       string // 配置名称，用于构建 Redis 键
+	name       string            // 配置名称，用于构建 Redis 键
+	windows    []RateLimitWindow // 所有生效的时间窗口
+	keys       []string          // 组合限流键的各部分
+	allowMap   map[string]bool
+	denyMap    map[string]bool
+}
+
+// compile 校验配置并构建内部字段
+// strict 为 false 时兼容旧版本的配置：count 和 duration 小于等于 0 时按 1 次和 1 秒处理，
+// 未注册的限流键类型被忽略（全部未注册时与旧版本一样按 path+method 限流），用于加载 Redis 中已有的配置
+// 保存新配置时使用 strict 校验，拒绝这些配置
+func (c *RateLimitConfig) compile(name string, extractors map[string]KeyExtractor, strict bool) error {
+	// 编译路径正则表达式
+	pathRegexp, err := regexp.Compile(c.Path)
+	if err != nil {
+		return fmt.Errorf("invalid path regex %q: %w", c.Path, err)
+	}
+	c.pathRegexp = pathRegexp
+
+	// 合并时间窗口，没有配置任何窗口和并发数的旧版本配置使用 1 次/秒
+	c.windows = c.windows[:0]
+	if c.Count > 0 || c.Duration > 0 || (!strict && len(c.Windows) == 0 && c.Concurrency <= 0) {
+		primary := RateLimitWindow{Count: c.Count, Duration: c.Duration}
+		if !strict {
+			primary.Count = max(primary.Count, 1)
+			if primary.Duration <= 0 {
+				primary.Duration = time.Second
+			}
+		}
+		c.windows = append(c.windows, primary)
+	}
+	c.windows = append(c.windows, c.Windows...)
+	if len(c.windows) == 0 && c.Concurrency <= 0 {
+		return errors.New("no rate limit window or concurrency configured")
+	}
+	durations := make(map[time.Duration]bool, len(c.windows))
+	for _, w := range c.windows {
+		if w.Count < 1 || w.Duration <= 0 {
+			return fmt.Errorf("invalid rate limit window %d/%s", w.Count, w.Duration)
+		}
+		if durations[w.Duration] {
+			return fmt.Errorf("duplicate rate limit window duration %s", w.Duration)
+		}
+		durations[w.Duration] = true
+	}
+
+	switch c.Algorithm {
+	case "", AlgorithmSlidingWindow, AlgorithmGCRA, AlgorithmTokenBucket:
+	default:
+		return fmt.Errorf("unknown algorithm %q", c.Algorithm)
+	}
+
+	if c.Concurrency < 0 || c.LeaseTTL < 0 {
+		return fmt.Errorf("invalid concurrency %d with lease ttl %s", c.Concurrency, c.LeaseTTL)
+	}
+
+	switch c.Mode {
+	case "", ModeEnforce, ModeShadow:
+	default:
+		return fmt.Errorf("unknown mode %q", c.Mode)
+	}
+
+	// 检查限流键类型是否已注册
+	c.keys = c.keys[:0]
+	for _, key := range parseKeys(c.Key) {
+		if _, ok := extractors[key]; ok {
+			c.keys = append(c.keys, key)
+			continue
+		}
+		if strict {
+			return fmt.Errorf("unknown key type %q", key)
+		}
+		log.Warn().Str("name", name).Str("key", key).Msg("unknown rate limit key type ignored")
+	}
+
+	// 构建方法映射以便快速查找
+	c.methodsMap = make(map[string]bool)
+	for _, method := range c.Methods {
+		c.methodsMap[method] = true
+	}
+
+	c.allowMap = make(map[string]bool)
+	for _, value := range c.Allow {
+		c.allowMap[value] = true
+	}
+	c.denyMap = make(map[string]bool)
+	for _, value := range c.Deny {
+		c.denyMap[value] = true
+	}
+
+	// 存储配置名称，用于后续构建 Redis 键
+	c.name = name
+	return nil
+}
+
+// limit 返回规则的请求数量限制，用于没有经过限流器的结果（如黑名单）
+func (c *RateLimitConfig) limit() int {
+	if len(c.windows) > 0 {
+		return c.windows[0].Count
+	}
+	return c.Concurrency
+}
+
+// sameLimit 判断两个配置创建的限流器是否相同，不同时需要重建限流器
+func (c *RateLimitConfig) sameLimit(o *RateLimitConfig) bool {
+	return c.Algorithm == o.Algorithm && slices.Equal(c.windows, o.windows) &&
+		c.Concurrency == o.Concurrency && c.LeaseTTL == o.LeaseTTL
+}
+
+// LimiterStats 是 RateLimiterManager 中限流器的统计信息
+type LimiterStats struct {
+	Limiters  int            `json:"limiters"`   // 当前存活的限流器数量
+	Capacity  int            `json:"capacity"`   // 最多保留的限流器数量
+	Evicted   int64          `json:"evicted"`    // 因容量、过期或配置变更被移除的限流器数量
+	PerConfig map[string]int `json:"per_config"` // 每个配置存活的限流器数量
+
+	Rules        map[string]RuleStats `json:"rules"`         // 每个规则的匹配和限流计数，包括 shadow 模式
+	AuditDropped int64                `json:"audit_dropped"` // 缓冲区已满被丢弃的审计事件数
 }
@@ -0,0 +1,83 @@
+package ratelimit
+
+import (
+	"context"
+	"strings"
+
+	"github.com/play/play/pkg/meta"
+)
+
+// 内置的限流键类型
+const (
+	KeyDeviceId = "device-id" // 设备ID
+	KeyUserIp   = "user-ip"   // 用户IP
+	KeyToken    = "token"     // 用户登录令牌
+	KeyPath     = "path"      // 请求路径，用于正则匹配多个路径时按路径分别限流
+)
+
+// keySeparator 组合限流键的分隔符，如 "user-ip+path"
+const keySeparator = "+"
+
+// KeyExtractor 从请求 context 中提取限流键值，返回空字符串表示不存在
+type KeyExtractor func(ctx context.Context) string
+
+// MetaKeyExtractor 返回从 Meta 中读取指定 key 的 KeyExtractor
+func MetaKeyExtractor(key string) KeyExtractor {
+	return func(ctx context.Context) string {
+		if m, ok := meta.Load(ctx); ok {
+			return m.GetString(key)
+		}
+		return ""
+	}
+}
+
+// defaultKeyExtractors 返回内置的限流键类型
+func defaultKeyExtractors() map[string]KeyExtractor {
+	return map[string]KeyExtractor{
+		KeyDeviceId: MetaKeyExtractor(meta.MetaDeviceId),
+		KeyUserIp:   MetaKeyExtractor(meta.MetaUserIp),
+		KeyToken:    MetaKeyExtractor(meta.HeaderToken),
+		KeyPath:     MetaKeyExtractor(meta.HeaderRequestPath),
+	}
+}
+
+// WithKeyExtractor 注册自定义的限流键类型，可以覆盖内置类型
+//
+//	ratelimit.WithKeyExtractor("user-id", ratelimit.MetaKeyExtractor(meta.MetaUserId))
+func WithKeyExtractor(name string, extractor KeyExtractor) ManagerOption {
+	return func(m *RateLimiterManager) {
+		m.extractors[name] = extractor
+	}
+}
+
+// parseKeys 解析组合限流键，如 "user-ip+path" 返回 ["user-ip", "path"]
+func parseKeys(key string) []string {
+	if key == "" {
+		return nil
+	}
+	keys := strings.Split(key, keySeparator)
+	for i := range keys {
+		keys[i] = strings.TrimSpace(keys[i])
+	}
+	return keys
+}
+
+// keyValue 提取组合限流键的键值，各部分用 "|" 连接，全部为空时返回空字符串
+func (m *RateLimiterManager) keyValue(ctx context.Context, cfg *RateLimitConfig) string {
+	if len(cfg.keys) == 0 {
+		return ""
+	}
+
+	values := make([]string, len(cfg.keys))
+	found := false
+	for i, key := range cfg.keys {
+		values[i] = m.extractors[key](ctx)
+		if values[i] != "" {
+			found = true
+		}
+	}
+	if !found {
+		return ""
+	}
+	return strings.Join(values, "|")
+}
@@ -1,14 +1,14 @@
 package ratelimit
 
 import (
+	"cmp"
 	"context"
-	"regexp"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/goccy/go-json"
-
+	"github.com/hashicorp/golang-lru/v2/expirable"
 	"github.com/play/play/pkg/meta"
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog/log"
@@ -16,15 +16,40 @@ import (
 
 // RateLimiterManager 从 Redis 配置动态管理限流器
 type RateLimiterManager struct {
-	rdb       redis.Cmdable
-	configKey string
-	interval  time.Duration
-	configs   atomic.Value           // 存储 []*RateLimitConfig，按顺序检查
-	limiters  map[string]RateLimiter // key: 限流器键（config_name:method:keyValue）
-	limiterMu sync.RWMutex           // 保护 limiters
-	ctx       context.Context
-	cancel    context.CancelFunc
-	useRedis  bool
+	rdb           redis.Cmdable
+	configKey     string
+	interval      time.Duration
+	configs       atomic.Value                          // 存储 []*RateLimitConfig，按顺序检查
+	limiters      *expirable.LRU[string, *limiterEntry] // key: 限流器键（config_name:method:keyValue）
+	limiterMu     sync.Mutex                            // 避免并发创建同一个限流器，同时保护 semaphores
+	semaphores    map[string]*MemoryConcurrencyLimit    // 内存并发限流器，key: 限流器键，独立于 limiters 保存，淘汰限流器时不丢失在途名额
+	maxSize       int                                   // 最多保留的限流器数量
+	ttl           time.Duration                         // 限流器的空闲时间，0 表示不过期
+	evicted       atomic.Int64
+	extractors    map[string]KeyExtractor // key: 限流键类型
+	loadMu        sync.Mutex              // 串行化配置加载，避免推送和轮询并发时旧配置覆盖新配置
+	configErrors  atomic.Value            // 存储 map[string]string，最近一次加载时无效的配置，key: 配置名称
+	reported      map[string]string       // 最近一次写入 Redis 的无效配置，nil 表示尚未写入，由 loadMu 保护
+	notifyChannel string                  // 配置变更通知的 channel
+	maxVersions   int                     // 每个配置保留的历史版本数量
+	audit         *auditor                // 规则计数和审计事件
+	ctx           context.Context
+	cancel        context.CancelFunc
+	useRedis      bool
+}
+
+// limiterEntry 是缓存中的限流器，记录创建它的配置，用于配置变更时重建
+// 内存并发限流器同时保存在 semaphores 中，被淘汰后重建时沿用原有的在途名额
+type limiterEntry struct {
+	limiters    []RateLimiter      // 每个时间窗口一个
+	concurrency ConcurrencyLimiter // 未配置并发数时为 nil
+	cfg         *RateLimitConfig
+	touchedAt   atomic.Int64 // 最近一次续期的时间，Unix 纳秒
+}
+
+// undoer 是支持撤销上一次请求的限流器
+type undoer interface {
+	Undo()
 }
 
 // ManagerOption RateLimiterManager 的函数式选项
@@ -51,40 +76,98 @@ func WithRedis() ManagerOption {
 	}
 }
 
+// WithMaxLimiters 设置最多保留的限流器数量，超出时淘汰最久未使用的限流器
+func WithMaxLimiters(size int) ManagerOption {
+	return func(m *RateLimiterManager) {
+		m.maxSize = size
+	}
+}
+
+// WithLimiterTTL 设置限流器的空闲时间，超过 ttl 未被访问的限流器会被移除，再次访问时重新创建
+// 为减少写锁，访问时最多每 ttl/2 续期一次，因此限流器在空闲 ttl/2 到 ttl 之后被移除
+// 内存限流器重建后配额会恢复，ttl 应远大于最长的限流时间窗口
+func WithLimiterTTL(ttl time.Duration) ManagerOption {
+	return func(m *RateLimiterManager) {
+		m.ttl = ttl
+	}
+}
+
+// WithNotifyChannel 设置配置变更通知的 channel，默认为 "<configKey>:notify"
+// 也可以设置为 Redis 键空间通知的 channel，如 "__keyspace@0__:ratelimit:config"（需要开启 notify-keyspace-events）
+func WithNotifyChannel(channel string) ManagerOption {
+	return func(m *RateLimiterManager) {
+		m.notifyChannel = channel
+	}
+}
+
+// WithMaxVersions 设置每个配置保留的历史版本数量
+func WithMaxVersions(n int) ManagerOption {
+	return func(m *RateLimiterManager) {
+		m.maxVersions = n
+	}
+}
+
 // NewManager 创建一个新的 RateLimiterManager
 func NewManager(rdb redis.Cmdable, opts ...ManagerOption) *RateLimiterManager {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	m := &RateLimiterManager{
-		rdb:       rdb,
-		configKey: defaultConfigKey,
-		interval:  defaultInterval,
-		limiters:  make(map[string]RateLimiter),
-		ctx:       ctx,
-		cancel:    cancel,
-		useRedis:  false,
+		rdb:         rdb,
+		configKey:   defaultConfigKey,
+		interval:    defaultInterval,
+		maxSize:     defaultLimiters,
+		maxVersions: defaultMaxVersions,
+		audit:       newAuditor(),
+		semaphores:  make(map[string]*MemoryConcurrencyLimit),
+		extractors:  defaultKeyExtractors(),
+		ctx:         ctx,
+		cancel:      cancel,
+		useRedis:    false,
 	}
 
 	// 初始化 configs 为空切片
 	m.configs.Store([]*RateLimitConfig{})
+	m.configErrors.Store(map[string]string{})
 
 	for _, opt := range opts {
 		opt(m)
 	}
 
+	if m.notifyChannel == "" {
+		m.notifyChannel = m.configKey + ":notify"
+	}
+
+	m.limiters = expirable.NewLRU(m.maxSize, func(string, *limiterEntry) {
+		m.evicted.Add(1)
+	}, m.ttl)
+
+	// 先订阅变更通知再加载初始配置，避免遗漏两者之间的变更
+	ps := m.subscribe()
+
 	// 加载初始配置
 	if err := m.loadConfig(); err != nil {
 		log.Error().Err(err).Msg("failed to load initial rate limit configs")
 	}
 
-	// 启动后台配置重载循环
+	if m.audit.sink != nil {
+		m.audit.events = make(chan AuditEvent, defaultAuditBuffer)
+		go m.audit.run(m.ctx)
+	}
+
+	// 启动后台配置重载循环，变更通知立即重载，轮询作为兜底
 	go m.reloadConfigLoop()
+	if ps != nil {
+		go m.watchConfigLoop(ps)
+	}
 
 	return m
 }
 
-// loadConfig 从 Redis 加载配置
+// loadConfig 从 Redis 加载配置，无效的配置会被跳过并写入 "{<configKey>}:errors"
 func (m *RateLimiterManager) loadConfig() error {
+	m.loadMu.Lock()
+	defer m.loadMu.Unlock()
+
 	ctx, cancel := context.WithTimeout(m.ctx, 5*time.Second)
 	defer cancel()
 
@@ -95,36 +178,29 @@ func (m *RateLimiterManager) loadConfig() error {
 	}
 
 	newConfigs := make([]*RateLimitConfig, 0, len(configs))
+	configErrors := make(map[string]string)
 
 	for name, configJSON := range configs {
-		var cfg RateLimitConfig
-		if err := json.Unmarshal([]byte(configJSON), &cfg); err != nil {
-			log.Error().Err(err).Str("name", name).Msg("failed to parse rate limit config")
-			continue
-		}
-
-		// 编译路径正则表达式
-		pathRegexp, err := regexp.Compile(cfg.Path)
+		cfg, err := m.parseConfig(name, configJSON, false)
 		if err != nil {
-			log.Error().Err(err).Str("name", name).Str("path", cfg.Path).Msg("invalid path regex")
+			log.Error().Err(err).Str("name", name).Msg("invalid rate limit config")
+			configErrors[name] = err.Error()
 			continue
 		}
-		cfg.pathRegexp = pathRegexp
-
-		// 构建方法映射以便快速查找
-		cfg.methodsMap = make(map[string]bool)
-		for _, method := range cfg.Methods {
-			cfg.methodsMap[method] = true
-		}
-
-		// 存储配置名称，用于后续构建 Redis 键
-		cfg.name = name
 
-		newConfigs = append(newConfigs, &cfg)
-		log.Debug().Str("name", name).Str("path", cfg.Path).Int("count", cfg.Count).Dur("duration", cfg.Duration).Msg("loaded rate limit config")
+		newConfigs = append(newConfigs, cfg)
+		log.Debug().Str("name", name).Str("path", cfg.Path).Any("windows", cfg.windows).Str("key", cfg.Key).Str("algorithm", cfg.Algorithm).Int("priority", cfg.Priority).Msg("loaded rate limit config")
 	}
 
+	// 按优先级从高到低排序，相同时按名称排序，保证检查顺序稳定
+	slices.SortFunc(newConfigs, func(a, b *RateLimitConfig) int {
+		return cmp.Or(cmp.Compare(b.Priority, a.Priority), cmp.Compare(a.name, b.name))
+	})
+
 	m.configs.Store(newConfigs)
+	m.configErrors.Store(configErrors)
+	m.purgeLimiters(newConfigs)
+	m.reportErrors(ctx, configErrors)
 
 	log.Info().Int("count", len(newConfigs)).Msg("rate limit configs loaded")
 	return nil
@@ -147,101 +223,354 @@ func (m *RateLimiterManager) reloadConfigLoop() {
 	}
 }
 
-// getKeyValue 根据键类型从上下文中提取键值
-func getKeyValue(ctx context.Context, keyType string) string {
-	switch keyType {
-	case "device-id":
-		return meta.Get[string](ctx, meta.MetaDeviceId)
-	case "user-ip":
-		return meta.Get[string](ctx, meta.MetaUserIp)
-	case "token":
-		return meta.Get[string](ctx, meta.HeaderToken)
-	default:
-		return ""
-	}
+// Close 停止后台配置重载
+func (m *RateLimiterManager) Close() {
+	m.cancel()
 }
 
 // Limit 检查请求是否应该被限流
 // 返回 true 表示应该限流
 func (m *RateLimiterManager) Limit(ctx context.Context) bool {
-	// 从上下文获取路径和方法
-	path := meta.Get[string](ctx, meta.HeaderRequestPath)
-	method := meta.Get[string](ctx, meta.HeaderRequestMethod)
+	d := m.Decide(ctx)
+	return d != nil && d.Limited
+}
 
-	if path == "" || method == "" {
-		return false
+// Decide 检查请求并返回限流结果
+// 被限流时返回第一个触发限流的规则，否则返回剩余配额最少的规则，没有匹配的规则时返回 nil
+// 只配置了并发数的规则由 Acquire 检查，但其黑名单仍在这里生效
+func (m *RateLimiterManager) Decide(ctx context.Context) *Decision {
+	path, method, ok := requestOf(ctx)
+	if !ok {
+		return nil
 	}
 
 	// 无锁加载配置（原子操作）
 	configs := m.configs.Load().([]*RateLimitConfig)
 
+	var result *Decision
+
 	// 检查每个配置以找到匹配的规则
 	for _, cfg := range configs {
-		// 检查方法是否匹配
-		if len(cfg.methodsMap) > 0 && !cfg.methodsMap[method] {
+		keyValue, ok := m.match(ctx, cfg, path, method)
+		if !ok {
 			continue
 		}
 
-		// 检查路径是否匹配
-		if !cfg.pathRegexp.MatchString(path) {
+		// 黑名单中的键值总是被限流，否则应用限流
+		var d Decision
+		denied := keyValue != "" && cfg.denyMap[keyValue]
+		switch {
+		case denied:
+			d = Decision{Limited: true, Limit: cfg.limit()}
+		case len(cfg.windows) > 0:
+			d = m.decide(ctx, m.getLimiters(cfg, method, keyValue).limiters)
+		default:
 			continue
 		}
+		d.Name = cfg.name
 
-		// 如果指定了键类型，则获取键值
-		var keyValue string
-		if cfg.Key != "" {
-			keyValue = getKeyValue(ctx, cfg.Key)
-			if keyValue == "" {
-				log.Debug().Str("path", path).Str("method", method).Str("key", cfg.Key).Msg("rate limit key not found in context")
-			}
+		// shadow 模式的规则只记录，不拦截，也不影响返回的限流结果
+		if m.record(cfg, path, method, keyValue, d, denied) {
+			continue
 		}
 
-		// 构建限流器键
-		limiterKey := cfg.name + ":" + method
-		if keyValue != "" {
-			limiterKey += ":" + keyValue
+		if d.Limited {
+			return &d
 		}
-		limiter := m.getLimiter(limiterKey, cfg)
+		if result == nil || d.Remaining < result.Remaining {
+			result = &d
+		}
+	}
+
+	return result
+}
+
+// Acquire 为配置了并发数的规则获取并发名额，请求处理完成后必须调用返回的 release
+// 任意一个规则的名额已满时释放已获取的名额并返回该规则的结果，否则返回剩余名额最少的规则，没有匹配的规则时返回 nil
+func (m *RateLimiterManager) Acquire(ctx context.Context) (release func(), d *Decision) {
+	path, method, ok := requestOf(ctx)
+	if !ok {
+		return noopRelease, nil
+	}
+
+	configs := m.configs.Load().([]*RateLimitConfig)
 
-		// 应用限流
-		if limiter.Limit(ctx) {
-			log.Warn().Str("path", path).Str("method", method).Str("key", cfg.Key).Str("key_value", keyValue).Str("limiterKey", limiterKey).Msg("exceeded rate limit")
-			return true
+	var releases []func()
+	releaseAll := func() {
+		for _, release := range releases {
+			release()
 		}
+	}
+
+	var result *Decision
+	for _, cfg := range configs {
+		if cfg.Concurrency <= 0 {
+			continue
+		}
+		keyValue, ok := m.match(ctx, cfg, path, method)
+		if !ok {
+			continue
+		}
+
+		release, d := m.getLimiters(cfg, method, keyValue).concurrency.Acquire(ctx)
+		releases = append(releases, release)
+		d.Name = cfg.name
 
+		if m.record(cfg, path, method, keyValue, d, false) {
+			continue
+		}
+
+		if d.Limited {
+			releaseAll()
+			return noopRelease, &d
+		}
+		if result == nil || d.Remaining < result.Remaining {
+			result = &d
+		}
 	}
 
-	return false
+	return releaseAll, result
+}
+
+// requestOf 从上下文获取请求路径和方法
+func requestOf(ctx context.Context) (path, method string, ok bool) {
+	path = meta.Get[string](ctx, meta.HeaderRequestPath)
+	method = meta.Get[string](ctx, meta.HeaderRequestMethod)
+	return path, method, path != "" && method != ""
 }
 
-// getLimiter 获取或创建指定键的限流器
-func (m *RateLimiterManager) getLimiter(limiterKey string, cfg *RateLimitConfig) RateLimiter {
-	// 首先使用读锁检查
-	m.limiterMu.RLock()
-	if limiter, ok := m.limiters[limiterKey]; ok {
-		m.limiterMu.RUnlock()
-		return limiter
+// match 检查请求是否匹配规则，返回限流键值，白名单中的键值视为不匹配
+func (m *RateLimiterManager) match(ctx context.Context, cfg *RateLimitConfig, path, method string) (keyValue string, ok bool) {
+	// 检查方法是否匹配
+	if len(cfg.methodsMap) > 0 && !cfg.methodsMap[method] {
+		return "", false
 	}
-	m.limiterMu.RUnlock()
 
-	// 需要创建，获取写锁
+	// 检查路径是否匹配
+	if !cfg.pathRegexp.MatchString(path) {
+		return "", false
+	}
+
+	// 如果指定了键类型，则获取键值
+	keyValue = m.keyValue(ctx, cfg)
+	if keyValue == "" && len(cfg.keys) > 0 {
+		log.Debug().Str("path", path).Str("method", method).Str("key", cfg.Key).Msg("rate limit key not found in context")
+	}
+
+	// 白名单中的键值不受该规则限制
+	if keyValue != "" && cfg.allowMap[keyValue] {
+		return "", false
+	}
+	return keyValue, true
+}
+
+// record 记录规则的检查结果，返回规则是否为 shadow 模式
+func (m *RateLimiterManager) record(cfg *RateLimitConfig, path, method, keyValue string, d Decision, denied bool) (shadow bool) {
+	shadow = cfg.Mode == ModeShadow
+	m.audit.record(AuditEvent{
+		Time:       time.Now(),
+		Name:       cfg.name,
+		Mode:       cfg.Mode,
+		Path:       path,
+		Method:     method,
+		Key:        cfg.Key,
+		KeyValue:   keyValue,
+		Limited:    d.Limited,
+		Denied:     denied,
+		Limit:      d.Limit,
+		Remaining:  d.Remaining,
+		RetryAfter: d.RetryAfter,
+	}, shadow)
+
+	if !d.Limited {
+		return shadow
+	}
+	if shadow {
+		log.Info().Str("name", cfg.name).Str("path", path).Str("method", method).Str("key", cfg.Key).Str("key_value", keyValue).Bool("denied", denied).Msg("exceeded rate limit in shadow mode")
+	} else {
+		log.Warn().Str("name", cfg.name).Str("path", path).Str("method", method).Str("key", cfg.Key).Str("key_value", keyValue).Bool("denied", denied).Dur("retry_after", d.RetryAfter).Msg("exceeded rate limit")
+	}
+	return shadow
+}
+
+// decide 依次检查规则的每个时间窗口，任意一个窗口超过限流即限流
+// 被限流时撤销之前窗口已消耗的配额（仅内存限流器支持），未限流时返回剩余配额最少的窗口
+func (m *RateLimiterManager) decide(ctx context.Context, limiters []RateLimiter) Decision {
+	var result Decision
+	for i, limiter := range limiters {
+		d := limiter.Decide(ctx)
+		if d.Limited {
+			for _, prev := range limiters[:i] {
+				if u, ok := prev.(undoer); ok {
+					u.Undo()
+				}
+			}
+			return d
+		}
+		if i == 0 || d.Remaining < result.Remaining {
+			result = d
+		}
+	}
+	return result
+}
+
+// getLimiters 获取或创建规则在指定键值上的限流器，配置变更后重建
+func (m *RateLimiterManager) getLimiters(cfg *RateLimitConfig, method, keyValue string) *limiterEntry {
+	// 构建限流器键
+	limiterKey := cfg.name + ":" + method
+	if keyValue != "" {
+		limiterKey += ":" + keyValue
+	}
+
+	if entry, ok := m.limiters.Get(limiterKey); ok && entry.cfg.sameLimit(cfg) {
+		m.touch(limiterKey, entry)
+		return entry
+	}
+
+	// 需要创建，获取锁
 	m.limiterMu.Lock()
 	defer m.limiterMu.Unlock()
 
-	// 获取写锁后再次检查（双重检查）
-	if limiter, ok := m.limiters[limiterKey]; ok {
-		return limiter
+	// 获取锁后再次检查（双重检查）
+	if entry, ok := m.limiters.Peek(limiterKey); ok && entry.cfg.sameLimit(cfg) {
+		return entry
 	}
 
-	// 创建新的限流器
-	var limiter RateLimiter
-	if m.useRedis {
-		redisKey := "ratelimit:" + limiterKey
-		limiter = NewRedis(m.rdb, redisKey, cfg.Count, cfg.Duration)
+	// 创建新的限流器，每个时间窗口一个，第一个窗口沿用原有的 Redis 键
+	// Redis 限流器无法撤销已记录的请求，多个时间窗口使用一个限流器在同一个脚本中检查
+	redisKey := windowKey(cfg, method, keyValue)
+	entry := &limiterEntry{
+		limiters: make([]RateLimiter, 0, len(cfg.windows)),
+		cfg:      cfg,
+	}
+	if m.useRedis && len(cfg.windows) > 1 {
+		entry.limiters = append(entry.limiters, NewRedisMultiWindow(m.rdb, redisKey, cfg.Algorithm, cfg.windows))
 	} else {
-		limiter = NewMemory(cfg.Count, cfg.Duration)
+		for i, w := range cfg.windows {
+			key := redisKey
+			if i > 0 {
+				key += ":" + w.Duration.String()
+			}
+			entry.limiters = append(entry.limiters, m.newLimiter(key, cfg.Algorithm, w))
+		}
+	}
+	if cfg.Concurrency > 0 {
+		if m.useRedis {
+			entry.concurrency = NewRedisConcurrency(m.rdb, "ratelimit:"+limiterKey+inflightKeySuffix, cfg.Concurrency, cfg.LeaseTTL)
+		} else {
+			entry.concurrency = m.semaphore(limiterKey, cfg)
+		}
+	}
+
+	entry.touchedAt.Store(time.Now().UnixNano())
+	m.limiters.Add(limiterKey, entry)
+	return entry
+}
+
+// semaphore 返回限流器键对应的内存并发限流器，并发数和租约时长不变时沿用原有的实例，调用方需持有 limiterMu
+func (m *RateLimiterManager) semaphore(limiterKey string, cfg *RateLimitConfig) *MemoryConcurrencyLimit {
+	sem := NewMemoryConcurrency(cfg.Concurrency, cfg.LeaseTTL)
+	if prev, ok := m.semaphores[limiterKey]; ok && prev.max == sem.max && prev.ttl == sem.ttl {
+		return prev
 	}
+	m.semaphores[limiterKey] = sem
+	return sem
+}
 
-	m.limiters[limiterKey] = limiter
-	return limiter
+// sweepSemaphores 移除没有在途请求且不再被缓存的限流器引用的内存并发限流器
+func (m *RateLimiterManager) sweepSemaphores() {
+	m.limiterMu.Lock()
+	defer m.limiterMu.Unlock()
+
+	for key, sem := range m.semaphores {
+		if entry, ok := m.limiters.Peek(key); ok && entry.concurrency == sem {
+			continue
+		}
+		if sem.idle() {
+			delete(m.semaphores, key)
+		}
+	}
+}
+
+// touch 续期限流器的过期时间，expirable.LRU 只在 Add 时设置过期时间，因此按访问续期需要重新 Add
+func (m *RateLimiterManager) touch(limiterKey string, entry *limiterEntry) {
+	if m.ttl <= 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+	touchedAt := entry.touchedAt.Load()
+	if time.Duration(now-touchedAt) < m.ttl/2 || !entry.touchedAt.CompareAndSwap(touchedAt, now) {
+		return
+	}
+	m.limiters.Add(limiterKey, entry)
+}
+
+// windowKey 返回时间窗口限流器的 Redis 键
+// 滑动窗口（默认算法）沿用原有的 "ratelimit:<name>:<method>[:<key>]"，其他算法为 "ratelimit:<name>:<algorithm>:<method>[:<key>]"
+// 各算法在 Redis 中的数据结构不同，切换算法后使用新的键，不会读到其他算法留下的数据
+func windowKey(cfg *RateLimitConfig, method, keyValue string) string {
+	key := "ratelimit:" + cfg.name + ":"
+	if cfg.Algorithm != "" && cfg.Algorithm != AlgorithmSlidingWindow {
+		key += cfg.Algorithm + ":"
+	}
+	key += method
+	if keyValue != "" {
+		key += ":" + keyValue
+	}
+	return key
+}
+
+// newLimiter 创建单个时间窗口的限流器
+func (m *RateLimiterManager) newLimiter(redisKey, algorithm string, w RateLimitWindow) RateLimiter {
+	if !m.useRedis {
+		return NewMemory(w.Count, w.Duration)
+	}
+	switch algorithm {
+	case AlgorithmGCRA:
+		return NewRedisGCRA(m.rdb, redisKey, w.Count, w.Duration)
+	case AlgorithmTokenBucket:
+		return NewRedisTokenBucket(m.rdb, redisKey, w.Count, w.Duration)
+	default:
+		return NewRedis(m.rdb, redisKey, w.Count, w.Duration)
+	}
+}
+
+// purgeLimiters 移除配置已删除或限流参数已变更的限流器，并清理空闲的内存并发限流器
+func (m *RateLimiterManager) purgeLimiters(configs []*RateLimitConfig) {
+	byName := make(map[string]*RateLimitConfig, len(configs))
+	for _, cfg := range configs {
+		byName[cfg.name] = cfg
+	}
+
+	removed := 0
+	for _, key := range m.limiters.Keys() {
+		entry, ok := m.limiters.Peek(key)
+		if !ok {
+			continue
+		}
+		if cfg, ok := byName[entry.cfg.name]; !ok || !cfg.sameLimit(entry.cfg) {
+			m.limiters.Remove(key)
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Info().Int("count", removed).Msg("removed rate limiters of changed configs")
+	}
+	m.sweepSemaphores()
+}
+
+// Stats 返回当前限流器的统计信息
+func (m *RateLimiterManager) Stats() LimiterStats {
+	stats := LimiterStats{
+		Capacity:     m.maxSize,
+		Evicted:      m.evicted.Load(),
+		PerConfig:    make(map[string]int),
+		Rules:        m.audit.stats(),
+		AuditDropped: m.audit.dropped.Load(),
+	}
+	for _, entry := range m.limiters.Values() {
+		stats.Limiters++
+		stats.PerConfig[entry.cfg.name]++
+	}
+	return stats
 }
@@ -53,6 +53,10 @@ func NewMemory(rate int, per time.Duration) *MemoryRateLimit {
 
 // UpdateRate 允许更新限流频率
 func (rl *MemoryRateLimit) UpdateRate(rate int) {
+	if rate < 1 {
+		rate = 1
+	}
+
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
@@ -61,7 +65,12 @@ func (rl *MemoryRateLimit) UpdateRate(rate int) {
 }
 
 // Limit 超过限流时返回 true
-func (rl *MemoryRateLimit) Limit(_ context.Context) bool {
+func (rl *MemoryRateLimit) Limit(ctx context.Context) bool {
+	return rl.Decide(ctx).Limited
+}
+
+// Decide 检查并记录一次请求，返回限流结果
+func (rl *MemoryRateLimit) Decide(_ context.Context) Decision {
 	now := nowNano()
 
 	rl.mu.Lock()
@@ -81,14 +90,24 @@ func (rl *MemoryRateLimit) Limit(_ context.Context) bool {
 		current = rl.max
 	}
 
+	d := Decision{Limit: int(rl.rate)}
+
 	// 如果我们的配额小于一个单位，则限流！
 	if current < rl.unit {
-		return true
+		d.Limited = true
+		d.RetryAfter = time.Duration((rl.unit - current) / rl.rate)
+		d.Reset = time.Unix(0, now+int64((rl.max-current)/rl.rate))
+		return d
 	}
 
 	// 未限流，减去一个单位
 	rl.allowance += ^(rl.unit - 1)
-	return false
+	current = rl.allowance
+
+	// 每纳秒恢复 rate 个配额，配额恢复到最大值所需时间为 (max - current) / rate
+	d.Remaining = int(current / rl.unit)
+	d.Reset = time.Unix(0, now+int64((rl.max-current)/rl.rate))
+	return d
 }
 
 // Undo 撤销上一次 Limit() 调用，返还消耗的配额
@@ -0,0 +1,188 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/play/play/pkg/meta"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcRequestMethod 直接调用 gRPC 时使用的请求方法，gRPC 请求都是 HTTP/2 POST
+const grpcRequestMethod = http.MethodPost
+
+// middlewareOptions HTTP 中间件和 gRPC 拦截器的配置
+type middlewareOptions struct {
+	exemptPaths    map[string]bool // 精确匹配的豁免路径
+	exemptPrefixes []string        // 前缀匹配的豁免路径
+}
+
+// MiddlewareOption HTTP 中间件和 gRPC 拦截器的函数式选项
+type MiddlewareOption func(*middlewareOptions)
+
+// WithExemptPaths 设置不参与限流的路径
+// 以 "*" 结尾的路径按前缀匹配，如 "/healthz"、"/debug/*"、"/grpc.health.v1.Health/*"
+// gRPC 拦截器同时使用请求路径和完整方法名（如 "/pkg.Service/Method"）匹配
+func WithExemptPaths(paths ...string) MiddlewareOption {
+	return func(o *middlewareOptions) {
+		for _, path := range paths {
+			if prefix, ok := strings.CutSuffix(path, "*"); ok {
+				o.exemptPrefixes = append(o.exemptPrefixes, prefix)
+			} else {
+				o.exemptPaths[path] = true
+			}
+		}
+	}
+}
+
+func newMiddlewareOptions(opts []MiddlewareOption) *middlewareOptions {
+	o := &middlewareOptions{exemptPaths: make(map[string]bool)}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// exempt 判断路径是否豁免限流
+func (o *middlewareOptions) exempt(paths ...string) bool {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if o.exemptPaths[path] {
+			return true
+		}
+		for _, prefix := range o.exemptPrefixes {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HTTPMiddleware 返回 net/http 限流中间件
+// 请求 context 中没有 Meta 时使用 meta.MetadataAnnotator 构建，并传递给后续处理函数
+// 匹配到规则时写入 X-RateLimit-* 响应头，被限流或并发名额已满时返回 429，并发名额在请求处理完成后释放
+func HTTPMiddleware(m *RateLimiterManager, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	o := newMiddlewareOptions(opts)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			if _, ok := meta.Load(ctx); !ok {
+				md := meta.MetadataAnnotator(ctx, r)
+				ctx = meta.FromContext(metadata.NewIncomingContext(ctx, md)).Context()
+				r = r.WithContext(ctx)
+			}
+
+			if o.exempt(r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			release, d := admit(ctx, m)
+			defer release()
+			if d == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			d.SetHeaders(w.Header())
+			if d.Limited {
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// UnaryServerInterceptor 返回 gRPC 一元限流拦截器
+// 匹配到规则时写入 x-ratelimit-* 响应头，被限流时返回 ResourceExhausted
+func UnaryServerInterceptor(m *RateLimiterManager, opts ...MiddlewareOption) grpc.UnaryServerInterceptor {
+	o := newMiddlewareOptions(opts)
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, release, err := o.decideGRPC(ctx, m, info.FullMethod)
+		defer release()
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor 返回 gRPC 流式限流拦截器，仅在建立流时检查一次，并发名额在流结束时释放
+func StreamServerInterceptor(m *RateLimiterManager, opts ...MiddlewareOption) grpc.StreamServerInterceptor {
+	o := newMiddlewareOptions(opts)
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, release, err := o.decideGRPC(ss.Context(), m, info.FullMethod)
+		defer release()
+		if err != nil {
+			return err
+		}
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// serverStream 替换 grpc.ServerStream 的 context
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// admit 先获取并发名额再检查频率限流，返回并发名额的释放函数和用于设置响应头的结果
+// 并发名额已满时不消耗频率限流的配额，频率限流时释放已获取的并发名额
+// 被限流时返回触发限流的结果，否则优先返回频率限流的结果
+func admit(ctx context.Context, m *RateLimiterManager) (release func(), d *Decision) {
+	release, cd := m.Acquire(ctx)
+	if cd != nil && cd.Limited {
+		return release, cd
+	}
+
+	d = m.Decide(ctx)
+	if d != nil && d.Limited {
+		release()
+		return noopRelease, d
+	}
+	if d == nil {
+		return release, cd
+	}
+	return release, d
+}
+
+// decideGRPC 构建 Meta、检查限流并设置 gRPC 响应头，返回带有 Meta 的 context 和并发名额的释放函数
+// 经 grpc-gateway 转发的请求使用 metadata 中的 HTTP 路径和方法，直接调用时使用完整方法名和 POST
+func (o *middlewareOptions) decideGRPC(ctx context.Context, m *RateLimiterManager, fullMethod string) (context.Context, func(), error) {
+	md, ok := meta.Load(ctx)
+	if !ok {
+		md = meta.FromContext(ctx)
+		ctx = md.Context()
+	}
+	if md.GetString(meta.HeaderRequestPath) == "" {
+		md.Set(meta.HeaderRequestPath, fullMethod)
+		md.Set(meta.HeaderRequestMethod, grpcRequestMethod)
+	}
+
+	if o.exempt(fullMethod, md.GetString(meta.HeaderRequestPath)) {
+		return ctx, noopRelease, nil
+	}
+
+	release, d := admit(ctx, m)
+	if d == nil {
+		return ctx, release, nil
+	}
+
+	_ = grpc.SetHeader(ctx, d.Metadata())
+	if d.Limited {
+		return ctx, release, status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry after %s", d.RetryAfter)
+	}
+	return ctx, release, nil
+}
@@ -0,0 +1,739 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/play/play/pkg/meta"
+	"github.com/play/play/pkg/pubsub"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TestRedisAlgorithms 验证 GCRA 和令牌桶限流器与 MemoryRateLimit 的行为一致：
+// 开始时允许 rate 次突发，之后每经过 duration/rate 恢复一次
+func TestRedisAlgorithms(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	ctx := context.Background()
+	const rate = 5
+	const duration = time.Second
+
+	limiters := map[string]interface {
+		RateLimiter
+		UpdateRate(rate int)
+	}{
+		AlgorithmGCRA:        NewRedisGCRA(rdb, "ratelimit:gcra", rate, duration),
+		AlgorithmTokenBucket: NewRedisTokenBucket(rdb, "ratelimit:token-bucket", rate, duration),
+	}
+
+	for name, rl := range limiters {
+		t.Run(name, func(t *testing.T) {
+			now := time.Unix(1700000000, 0)
+			mr.SetTime(now)
+
+			for i := 0; i < rate; i++ {
+				if rl.Limit(ctx) {
+					t.Fatalf("request %d should not be limited", i)
+				}
+			}
+			if !rl.Limit(ctx) {
+				t.Fatalf("request %d should be limited", rate)
+			}
+
+			// 经过一个发放间隔后恢复一次
+			now = now.Add(duration / rate)
+			mr.SetTime(now)
+			if rl.Limit(ctx) {
+				t.Fatal("request after one interval should not be limited")
+			}
+			if !rl.Limit(ctx) {
+				t.Fatal("second request after one interval should be limited")
+			}
+
+			// 经过完整窗口后恢复全部配额，但不会超过 rate
+			now = now.Add(10 * duration)
+			mr.SetTime(now)
+			for i := 0; i < rate; i++ {
+				if rl.Limit(ctx) {
+					t.Fatalf("request %d after full window should not be limited", i)
+				}
+			}
+			if !rl.Limit(ctx) {
+				t.Fatal("burst should not exceed rate")
+			}
+		})
+	}
+
+	// 每个键只占用一个 Redis 键
+	if keys := mr.Keys(); len(keys) != len(limiters) {
+		t.Fatalf("expected %d keys, got %v", len(limiters), keys)
+	}
+}
+
+// TestDecision 验证各限流器返回的剩余配额和等待时间
+func TestDecision(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	mr.SetTime(time.Unix(1700000000, 0))
+
+	ctx := context.Background()
+	const rate = 4
+	const duration = time.Second
+
+	limiters := map[string]RateLimiter{
+		"memory":               NewMemory(rate, duration),
+		AlgorithmSlidingWindow: NewRedis(rdb, "ratelimit:sliding-window", rate, duration),
+		AlgorithmGCRA:          NewRedisGCRA(rdb, "ratelimit:gcra", rate, duration),
+		AlgorithmTokenBucket:   NewRedisTokenBucket(rdb, "ratelimit:token-bucket", rate, duration),
+	}
+
+	for name, rl := range limiters {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < rate; i++ {
+				d := rl.Decide(ctx)
+				if d.Limited || d.Limit != rate || d.Remaining != rate-1-i {
+					t.Fatalf("request %d: unexpected decision %+v", i, d)
+				}
+				if d.Reset.Before(time.Now()) || d.Reset.After(time.Now().Add(duration+time.Second)) {
+					t.Fatalf("request %d: unexpected reset %v", i, d.Reset)
+				}
+			}
+
+			d := rl.Decide(ctx)
+			if !d.Limited || d.Remaining != 0 {
+				t.Fatalf("expected limited decision, got %+v", d)
+			}
+			if d.RetryAfter <= 0 || d.RetryAfter > duration {
+				t.Fatalf("unexpected retry after %v", d.RetryAfter)
+			}
+			if d.Headers()[HeaderRetryAfter] != "1" {
+				t.Fatalf("unexpected headers %v", d.Headers())
+			}
+		})
+	}
+}
+
+// TestHTTPMiddleware 验证中间件写入响应头并在超过限流时返回 429
+func TestHTTPMiddleware(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	mr.HSet(defaultConfigKey, "login", `{"path":"^/login$","methods":["POST"],"count":2,"duration":60000000000}`)
+	mr.HSet(defaultConfigKey, "misc", `{"path":"^/(healthz|other)","count":1,"duration":60000000000}`)
+	m := NewManager(rdb)
+	defer m.Close()
+
+	handler := HTTPMiddleware(m, WithExemptPaths("/healthz", "/other*"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if meta.Get[string](r.Context(), meta.HeaderRequestPath) != r.URL.Path {
+			t.Errorf("meta not propagated to handler")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	do := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		rec := do("/login")
+		if rec.Code != http.StatusOK || rec.Header().Get(HeaderRateLimitLimit) != "2" {
+			t.Fatalf("request %d: unexpected response %d %v", i, rec.Code, rec.Header())
+		}
+	}
+
+	rec := do("/login")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get(HeaderRetryAfter) == "" || rec.Header().Get(HeaderRateLimitRemaining) != "0" {
+		t.Fatalf("unexpected response %d %v", rec.Code, rec.Header())
+	}
+
+	// 豁免的路径不参与限流，也不设置限流响应头
+	for _, path := range []string{"/healthz", "/healthz", "/other/a", "/other/b"} {
+		if rec := do(path); rec.Code != http.StatusOK || rec.Header().Get(HeaderRateLimitLimit) != "" {
+			t.Fatalf("%s: unexpected response %d %v", path, rec.Code, rec.Header())
+		}
+	}
+}
+
+// TestUnaryServerInterceptor 验证直接调用 gRPC 时按完整方法名限流
+func TestUnaryServerInterceptor(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	mr.HSet(defaultConfigKey, "echo", `{"path":"^/test.Echo/","count":1,"duration":60000000000}`)
+	m := NewManager(rdb)
+	defer m.Close()
+
+	interceptor := UnaryServerInterceptor(m, WithExemptPaths("/grpc.health.v1.Health/*"))
+	handler := func(ctx context.Context, req any) (any, error) {
+		return req, nil
+	}
+	call := func(method string) error {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(meta.MetaDeviceId, "device"))
+		_, err := interceptor(ctx, "ping", &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+
+	if err := call("/test.Echo/Ping"); err != nil {
+		t.Fatalf("first call failed: %v", err)
+	}
+	if err := call("/test.Echo/Ping"); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := call("/grpc.health.v1.Health/Check"); err != nil {
+			t.Fatalf("exempt call failed: %v", err)
+		}
+	}
+}
+
+// TestManagerLimiterStore 验证限流器数量受限，且配置变更后重建限流器
+func TestManagerLimiterStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	mr.HSet(defaultConfigKey, "device", `{"path":"^/api/","count":1,"duration":60000000000,"key":"device-id"}`)
+	m := NewManager(rdb, WithMaxLimiters(2))
+	defer m.Close()
+
+	decide := func(device string) *Decision {
+		md := metadata.Pairs(meta.HeaderRequestPath, "/api/test", meta.HeaderRequestMethod, http.MethodGet, meta.MetaDeviceId, device)
+		return m.Decide(meta.FromContext(metadata.NewIncomingContext(context.Background(), md)).Context())
+	}
+
+	for _, device := range []string{"a", "b", "c"} {
+		if d := decide(device); d == nil || d.Limited {
+			t.Fatalf("device %s: unexpected decision %+v", device, d)
+		}
+	}
+	if stats := m.Stats(); stats.Limiters != 2 || stats.Evicted != 1 || stats.PerConfig["device"] != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if d := decide("c"); !d.Limited {
+		t.Fatalf("device c should be limited, got %+v", d)
+	}
+
+	// 修改 count 后限流器被移除，重新创建时使用新的配置
+	mr.HSet(defaultConfigKey, "device", `{"path":"^/api/","count":3,"duration":60000000000,"key":"device-id"}`)
+	if err := m.loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := m.Stats(); stats.Limiters != 0 {
+		t.Fatalf("limiters should be purged after config change, got %+v", stats)
+	}
+	if d := decide("c"); d.Limited || d.Limit != 3 || d.Remaining != 2 {
+		t.Fatalf("unexpected decision after config change %+v", d)
+	}
+}
+
+// TestManagerLimiterTTL 测试限流器按空闲时间过期，持续访问的限流器不会过期
+func TestManagerLimiterTTL(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	mr.HSet(defaultConfigKey, "rule", `{"path":"^/api/","count":1,"duration":60000000000}`)
+	m := NewManager(rdb, WithLimiterTTL(200*time.Millisecond))
+	defer m.Close()
+
+	md := metadata.Pairs(meta.HeaderRequestPath, "/api/test", meta.HeaderRequestMethod, http.MethodGet)
+	ctx := meta.FromContext(metadata.NewIncomingContext(context.Background(), md)).Context()
+	if d := m.Decide(ctx); d == nil || d.Limited {
+		t.Fatalf("unexpected decision %+v", d)
+	}
+
+	// 持续访问超过 ttl，限流器不会被重建，配额不会恢复
+	for i := 0; i < 10; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if d := m.Decide(ctx); d == nil || !d.Limited {
+			t.Fatalf("request %d: limiter should not expire while in use, got %+v", i, d)
+		}
+	}
+
+	// 空闲超过 ttl 后被移除，重新创建的限流器配额已恢复
+	time.Sleep(300 * time.Millisecond)
+	if d := m.Decide(ctx); d == nil || d.Limited {
+		t.Fatalf("idle limiter should expire, got %+v", d)
+	}
+}
+
+// TestManagerAlgorithmKeys 测试不同算法使用不同的 Redis 键，切换算法不会读到旧算法的数据
+func TestManagerAlgorithmKeys(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	mr.HSet(defaultConfigKey, "rule", `{"path":"^/api/","count":1,"duration":60000000000,"algorithm":"gcra"}`)
+	m := NewManager(rdb, WithRedis())
+	defer m.Close()
+
+	md := metadata.Pairs(meta.HeaderRequestPath, "/api/test", meta.HeaderRequestMethod, http.MethodGet)
+	ctx := meta.FromContext(metadata.NewIncomingContext(context.Background(), md)).Context()
+	if d := m.Decide(ctx); d == nil || d.Limited {
+		t.Fatalf("unexpected decision %+v", d)
+	}
+	if !mr.Exists("ratelimit:rule:gcra:GET") {
+		t.Fatalf("gcra key not found, got %v", mr.Keys())
+	}
+
+	// 切换为滑动窗口后使用原有的键，GCRA 留下的数据不影响新的算法
+	mr.HSet(defaultConfigKey, "rule", `{"path":"^/api/","count":1,"duration":60000000000}`)
+	if err := m.loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if d := m.Decide(ctx); d == nil || d.Limited {
+		t.Fatalf("unexpected decision after switching algorithm %+v", d)
+	}
+	if d := m.Decide(ctx); d == nil || !d.Limited {
+		t.Fatalf("sliding window should limit the second request, got %+v", d)
+	}
+	if !mr.Exists("ratelimit:rule:GET") {
+		t.Fatalf("sliding window key not found, got %v", mr.Keys())
+	}
+}
+
+// TestManagerRules 验证组合键、多窗口、优先级、黑白名单和自定义键类型
+func TestManagerRules(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	mr.HSet(defaultConfigKey,
+		"a-ip-path", `{"path":"^/api/","key":"user-ip+path","count":3,"duration":1000000000,"windows":[{"count":2,"duration":3600000000000}],"allow":["10.0.0.1|/api/a"],"deny":["10.0.0.2|/api/a"]}`,
+		"b-country", `{"path":"^/api/","key":"country","count":100,"duration":1000000000,"priority":10}`,
+		"c-invalid", `{"path":"(","count":1,"duration":1000000000}`,
+	)
+	m := NewManager(rdb, WithKeyExtractor("country", MetaKeyExtractor(meta.MetaUserCountry)))
+	defer m.Close()
+
+	configs := m.configs.Load().([]*RateLimitConfig)
+	if len(configs) != 2 || configs[0].name != "b-country" || configs[1].name != "a-ip-path" {
+		t.Fatalf("unexpected configs order")
+	}
+
+	decide := func(ip, path string) *Decision {
+		md := metadata.Pairs(meta.HeaderRequestPath, path, meta.HeaderRequestMethod, http.MethodGet, meta.MetaUserIp, ip, meta.MetaUserCountry, "CN")
+		return m.Decide(meta.FromContext(metadata.NewIncomingContext(context.Background(), md)).Context())
+	}
+
+	// 小时窗口只允许 2 次，剩余配额取最少的窗口
+	if d := decide("10.0.0.3", "/api/a"); d.Limited || d.Name != "a-ip-path" || d.Limit != 2 || d.Remaining != 1 {
+		t.Fatalf("unexpected decision %+v", d)
+	}
+	decide("10.0.0.3", "/api/a")
+	if d := decide("10.0.0.3", "/api/a"); !d.Limited || d.Name != "a-ip-path" {
+		t.Fatalf("hourly window should limit, got %+v", d)
+	}
+	// 组合键中路径不同，使用不同的限流器
+	if d := decide("10.0.0.3", "/api/b"); d.Limited {
+		t.Fatalf("different path should not be limited, got %+v", d)
+	}
+
+	// 白名单跳过该规则，只剩 b-country 生效
+	for i := 0; i < 5; i++ {
+		if d := decide("10.0.0.1", "/api/a"); d.Limited || d.Name != "b-country" {
+			t.Fatalf("allowed key: unexpected decision %+v", d)
+		}
+	}
+	if d := decide("10.0.0.2", "/api/a"); !d.Limited || d.Name != "a-ip-path" || d.Limit != 3 {
+		t.Fatalf("denied key should be limited, got %+v", d)
+	}
+}
+
+// TestManagerLegacyConfig 验证 Redis 中已有的旧版本配置仍然可以加载，保存时才严格校验
+func TestManagerLegacyConfig(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	legacy := `{"path":"^/legacy","key":"unknown","count":0,"duration":0}`
+	mr.HSet(defaultConfigKey, "legacy", legacy)
+	m := NewManager(rdb)
+	defer m.Close()
+
+	// 未注册的限流键类型被忽略，按 path+method 限流，count 为 0 时按 1 次/秒处理
+	md := metadata.Pairs(meta.HeaderRequestPath, "/legacy", meta.HeaderRequestMethod, http.MethodGet)
+	ctx := meta.FromContext(metadata.NewIncomingContext(context.Background(), md)).Context()
+	if d := m.Decide(ctx); d == nil || d.Limited || d.Limit != 1 {
+		t.Fatalf("legacy config should be loaded, got %+v", d)
+	}
+	if d := m.Decide(ctx); d == nil || !d.Limited {
+		t.Fatalf("legacy config should limit the second request, got %+v", d)
+	}
+
+	for name, configJSON := range map[string]string{
+		"legacy":    legacy,
+		"unknown":   `{"path":"^/api/","key":"unknown","count":1,"duration":1000000000}`,
+		"duplicate": `{"path":"^/api/","count":1,"duration":1000000000,"windows":[{"count":5,"duration":1000000000}]}`,
+	} {
+		var cfg RateLimitConfig
+		if err := json.Unmarshal([]byte(configJSON), &cfg); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.ValidateConfig(name, &cfg); err == nil {
+			t.Fatalf("%s: config should be rejected", name)
+		}
+	}
+}
+
+// TestRedisMultiWindow 验证多个时间窗口在一个脚本中检查，被后面的窗口限流时不消耗前面窗口的配额
+func TestRedisMultiWindow(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	windows := []RateLimitWindow{{Count: 3, Duration: time.Second}, {Count: 2, Duration: time.Hour}}
+	for _, algorithm := range []string{AlgorithmSlidingWindow, AlgorithmGCRA, AlgorithmTokenBucket} {
+		t.Run(algorithm, func(t *testing.T) {
+			ctx := context.Background()
+			rl := NewRedisMultiWindow(rdb, "windows:"+algorithm, algorithm, windows)
+			if d := rl.Decide(ctx); d.Limited || d.Limit != 2 || d.Remaining != 1 {
+				t.Fatalf("unexpected decision %+v", d)
+			}
+			if d := rl.Decide(ctx); d.Limited {
+				t.Fatalf("unexpected decision %+v", d)
+			}
+			if d := rl.Decide(ctx); !d.Limited || d.Limit != 2 || d.RetryAfter <= time.Second {
+				t.Fatalf("hourly window should limit, got %+v", d)
+			}
+			if algorithm == AlgorithmSlidingWindow {
+				if n, err := rdb.ZCard(ctx, "{windows:"+algorithm+"}:1s").Result(); err != nil || n != 2 {
+					t.Fatalf("limited request should not be recorded, got %d %v", n, err)
+				}
+			}
+		})
+	}
+}
+
+// TestManagerConfigReload 验证配置变更通知、无效配置报告和版本回滚
+func TestManagerConfigReload(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	ctx := context.Background()
+	admin := NewManager(rdb)
+	defer admin.Close()
+	m := NewManager(rdb)
+	defer m.Close()
+
+	waitConfigs := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for len(m.configs.Load().([]*RateLimitConfig)) != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d configs, got %d", n, len(m.configs.Load().([]*RateLimitConfig)))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// 无效的配置在保存前被拒绝
+	if _, err := admin.SetConfig(ctx, "bad", &RateLimitConfig{Path: "(", Count: 1, Duration: time.Second}); err == nil {
+		t.Fatal("expected invalid regex error")
+	}
+
+	v1, err := admin.SetConfig(ctx, "login", &RateLimitConfig{Path: "^/login$", Count: 10, Duration: time.Second})
+	if err != nil || v1 != 1 {
+		t.Fatalf("SetConfig failed: %d %v", v1, err)
+	}
+	waitConfigs(1)
+
+	if _, err := admin.SetConfig(ctx, "login", &RateLimitConfig{Path: "^/login$", Count: 1, Duration: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := admin.DeleteConfig(ctx, "login"); err != nil {
+		t.Fatal(err)
+	}
+	waitConfigs(0)
+
+	// 回滚到第一个版本
+	v4, err := admin.Rollback(ctx, "login", v1)
+	if err != nil || v4 != 4 {
+		t.Fatalf("Rollback failed: %d %v", v4, err)
+	}
+	waitConfigs(1)
+	if cfg := m.configs.Load().([]*RateLimitConfig)[0]; cfg.Count != 10 {
+		t.Fatalf("unexpected config after rollback %+v", cfg)
+	}
+	versions, err := admin.Versions(ctx, "login")
+	if err != nil || len(versions) != 4 || versions[0].Version != 4 || versions[1].Config != "" {
+		t.Fatalf("unexpected versions %+v %v", versions, err)
+	}
+
+	// 直接写入的无效配置被跳过并报告
+	mr.HSet(defaultConfigKey, "bad", `{"path":"(","count":1,"duration":1000000000}`)
+	if err := m.loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if errs := m.ConfigErrors(); errs["bad"] == "" {
+		t.Fatalf("expected config error, got %v", errs)
+	}
+	errorsKey := "{" + defaultConfigKey + "}:errors"
+	if reported := mr.HGet(errorsKey, "bad"); reported == "" {
+		t.Fatal("expected config error reported to redis")
+	}
+
+	// 无效配置没有变化时不重写
+	mr.Del(errorsKey)
+	if err := m.loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(errorsKey) {
+		t.Fatal("unchanged config errors should not be rewritten")
+	}
+	mr.HDel(defaultConfigKey, "bad")
+	mr.HSet(errorsKey, "bad", "stale")
+	if err := m.loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(errorsKey) {
+		t.Fatal("fixed config errors should be cleared")
+	}
+
+	// 配置相关的键使用 configKey 作为 hash tag
+	if !mr.Exists("{" + defaultConfigKey + "}:version") {
+		t.Fatalf("version key not found, got %v", mr.Keys())
+	}
+	tagged := NewManager(rdb, WithConfigKey("{app}:ratelimit"))
+	defer tagged.Close()
+	if key := tagged.versionKey(); key != "{app}:ratelimit:version" {
+		t.Fatalf("unexpected version key %s", key)
+	}
+}
+
+// TestManagerShadowAudit 验证 shadow 模式不拦截请求，并将审计事件发布到 pubsub
+func TestManagerShadowAudit(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	ctx := context.Background()
+	ps := pubsub.NewMemory()
+	defer ps.Close()
+
+	events := make(chan AuditEvent, 10)
+	sub, err := pubsub.NewTopic[AuditEvent](ps, "ratelimit_audit").Subscribe(ctx, func(ctx context.Context, event AuditEvent) error {
+		events <- event
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.Loop()
+
+	mr.HSet(defaultConfigKey, "shadow", `{"path":"^/api/","count":1,"duration":60000000000,"mode":"shadow"}`)
+	m := NewManager(rdb, WithAudit(NewPubSubAuditSink(ps, "ratelimit_audit")), WithAuditSampling(0, 1))
+	defer m.Close()
+
+	md := metadata.Pairs(meta.HeaderRequestPath, "/api/test", meta.HeaderRequestMethod, http.MethodGet)
+	reqCtx := meta.FromContext(metadata.NewIncomingContext(ctx, md)).Context()
+	for i := 0; i < 3; i++ {
+		if d := m.Decide(reqCtx); d != nil {
+			t.Fatalf("shadow rule should not affect decision, got %+v", d)
+		}
+	}
+
+	if stats := m.Stats().Rules["shadow"]; stats.Matched != 3 || stats.ShadowLimited != 2 || stats.Limited != 0 {
+		t.Fatalf("unexpected rule stats %+v", stats)
+	}
+
+	// 只采样超过限流的请求
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-events:
+			if event.Name != "shadow" || event.Mode != ModeShadow || !event.Limited || event.Path != "/api/test" {
+				t.Fatalf("unexpected audit event %+v", event)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("timed out waiting for audit event")
+		}
+	}
+}
+
+// TestConcurrencyLimiters 验证内存和 Redis 并发限流器的获取、释放和租约到期
+func TestConcurrencyLimiters(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	ctx := context.Background()
+	mr.SetTime(time.Now())
+
+	limiters := map[string]ConcurrencyLimiter{
+		"memory": NewMemoryConcurrency(2, 50*time.Millisecond),
+		"redis":  NewRedisConcurrency(rdb, "ratelimit:test:inflight", 2, 50*time.Millisecond),
+	}
+	for name, cl := range limiters {
+		t.Run(name, func(t *testing.T) {
+			release1, d := cl.Acquire(ctx)
+			if d.Limited || d.Remaining != 1 {
+				t.Fatalf("unexpected decision %+v", d)
+			}
+			_, d = cl.Acquire(ctx)
+			if d.Limited || d.Remaining != 0 {
+				t.Fatalf("unexpected decision %+v", d)
+			}
+			if _, d = cl.Acquire(ctx); !d.Limited {
+				t.Fatal("third acquire should be limited")
+			}
+
+			// 释放后可以再次获取，重复释放无影响
+			release1()
+			release1()
+			release3, d := cl.Acquire(ctx)
+			if d.Limited {
+				t.Fatal("acquire after release should succeed")
+			}
+			release3()
+
+			// 未释放的租约到期后自动释放
+			time.Sleep(60 * time.Millisecond)
+			mr.SetTime(time.Now())
+			if _, d = cl.Acquire(ctx); d.Limited || d.Remaining != 1 {
+				t.Fatalf("expired lease should be released, got %+v", d)
+			}
+		})
+	}
+}
+
+// TestManagerAcquire 验证通过配置启用的并发限流
+func TestManagerAcquire(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	mr.HSet(defaultConfigKey, "export", `{"path":"^/export$","key":"device-id","concurrency":1}`)
+	m := NewManager(rdb, WithRedis())
+	defer m.Close()
+
+	entered := make(chan struct{})
+	done := make(chan struct{})
+	handler := HTTPMiddleware(m)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Block") != "" {
+			close(entered)
+			<-done
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	do := func(device string, block bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/export", nil)
+		req.Header.Set(meta.MetaDeviceId, device)
+		if block {
+			req.Header.Set("X-Block", "1")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	go do("a", true)
+	<-entered
+
+	if rec := do("a", false); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 while in flight, got %d", rec.Code)
+	}
+	if rec := do("b", false); rec.Code != http.StatusOK {
+		t.Fatalf("other device should not be limited, got %d", rec.Code)
+	}
+
+	close(done)
+	deadline := time.Now().Add(2 * time.Second)
+	for do("a", false).Code != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("lease was not released after request finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestManagerAdmitOrder 验证并发名额已满时不消耗频率限流的配额，频率限流时释放已获取的并发名额
+func TestManagerAdmitOrder(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	mr.HSet(defaultConfigKey, "export", `{"path":"^/export$","count":2,"duration":60000000000,"concurrency":1}`)
+	m := NewManager(rdb)
+	defer m.Close()
+
+	md := metadata.Pairs(meta.HeaderRequestPath, "/export", meta.HeaderRequestMethod, http.MethodGet)
+	ctx := meta.FromContext(metadata.NewIncomingContext(context.Background(), md)).Context()
+
+	release, d := admit(ctx, m)
+	if d == nil || d.Limited {
+		t.Fatalf("unexpected decision %+v", d)
+	}
+	if _, d := admit(ctx, m); d == nil || !d.Limited || d.Remaining != 0 {
+		t.Fatalf("concurrency should limit, got %+v", d)
+	}
+	release()
+
+	// 被并发限流的请求没有消耗配额，第二次请求仍然允许
+	release, d = admit(ctx, m)
+	if d == nil || d.Limited {
+		t.Fatalf("limited request should not consume window quota, got %+v", d)
+	}
+	release()
+
+	if _, d := admit(ctx, m); d == nil || !d.Limited || d.Limit != 2 {
+		t.Fatalf("window should limit, got %+v", d)
+	}
+	if sem := m.semaphores["export:GET"]; sem == nil || sem.InFlight() != 0 {
+		t.Fatal("lease should be released when the window limits")
+	}
+}
+
+// TestManagerSemaphores 验证内存并发限流器在限流器被淘汰后仍保留在途名额，空闲后被清理
+func TestManagerSemaphores(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	mr.HSet(defaultConfigKey, "export", `{"path":"^/export$","key":"device-id","concurrency":1}`)
+	m := NewManager(rdb, WithMaxLimiters(1))
+	defer m.Close()
+
+	acquire := func(device string) (func(), *Decision) {
+		md := metadata.Pairs(meta.HeaderRequestPath, "/export", meta.HeaderRequestMethod, http.MethodGet, meta.MetaDeviceId, device)
+		return m.Acquire(meta.FromContext(metadata.NewIncomingContext(context.Background(), md)).Context())
+	}
+
+	release, d := acquire("a")
+	if d == nil || d.Limited {
+		t.Fatalf("unexpected decision %+v", d)
+	}
+	// 其他设备的限流器淘汰了 a 的限流器，重建后在途名额仍然有效
+	releaseB, _ := acquire("b")
+	releaseB()
+	if _, d := acquire("a"); d == nil || !d.Limited {
+		t.Fatalf("evicted limiter should keep in-flight leases, got %+v", d)
+	}
+
+	// b 的限流器已被淘汰且没有在途请求，重载配置时被清理
+	acquire("b")
+	release()
+	if err := m.loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.semaphores["export:GET:a"]; ok {
+		t.Fatalf("idle semaphore should be swept, got %v", m.semaphores)
+	}
+}
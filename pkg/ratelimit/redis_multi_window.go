@@ -0,0 +1,150 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// multiWindowScript 原子性地检查规则的所有时间窗口，全部未超过限流时才在每个窗口记录本次请求
+// Redis 限流器无法撤销已记录的请求，逐个窗口检查时被后面窗口拦截的请求会白白消耗前面窗口的配额
+// 时间以 Redis 服务端 TIME 为准（微秒），各算法的计算与单窗口的限流器一致
+// KEYS[i]: 第 i 个窗口的限流键，需要使用相同的 hash tag
+// ARGV[1]: 算法
+// ARGV[2]: 请求ID，用作滑动窗口 ZSET 的成员
+// ARGV[2i+1], ARGV[2i+2]: 第 i 个窗口的请求数量和时间窗口（微秒）
+// 返回 {是否限流, 需要等待的微秒数, 剩余请求数, 配额完全恢复的微秒数, 窗口下标}
+// 被限流时返回第一个触发限流的窗口，否则返回剩余请求数最少的窗口
+var multiWindowScript = redis.NewScript(`
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local algorithm = ARGV[1]
+
+-- 每个算法返回 {是否限流, 需要等待的微秒数, 剩余请求数, 配额完全恢复的微秒数, 提交时使用的状态}
+local function sliding(key, rate, window)
+    redis.call("ZREMRANGEBYSCORE", key, "-inf", now - window)
+    local count = redis.call("ZCARD", key)
+    if count >= rate then
+        local oldest = redis.call("ZRANGE", key, 0, 0, "WITHSCORES")
+        local newest = redis.call("ZRANGE", key, -1, -1, "WITHSCORES")
+        return {1, tonumber(oldest[2]) + window - now, 0, tonumber(newest[2]) + window - now}
+    end
+    return {0, 0, rate - count - 1, window}
+end
+
+local function gcra(key, rate, window)
+    local interval = math.max(math.floor(window / rate), 1)
+    local tat = tonumber(redis.call("GET", key) or now)
+    if tat < now then
+        tat = now
+    end
+    local newTat = tat + interval
+    if newTat - now > window then
+        return {1, newTat - now - window, 0, tat - now}
+    end
+    return {0, 0, math.floor((window - (newTat - now)) / interval), newTat - now, newTat}
+end
+
+local function bucket(key, rate, window)
+    local state = redis.call("HMGET", key, "tokens", "ts")
+    local tokens = tonumber(state[1]) or rate
+    local ts = tonumber(state[2]) or now
+    if now > ts then
+        tokens = math.min(rate, tokens + (now - ts) * rate / window)
+    end
+    if tokens < 1 then
+        return {1, math.ceil((1 - tokens) * window / rate), 0, math.ceil((rate - tokens) * window / rate)}
+    end
+    tokens = tokens - 1
+    return {0, 0, math.floor(tokens), math.ceil((rate - tokens) * window / rate), tokens}
+end
+
+local check = sliding
+if algorithm == "gcra" then
+    check = gcra
+elseif algorithm == "token-bucket" then
+    check = bucket
+end
+
+local checks = {}
+local result
+for i = 1, #KEYS do
+    local r = check(KEYS[i], tonumber(ARGV[2 * i + 1]), tonumber(ARGV[2 * i + 2]))
+    if r[1] == 1 then
+        return {1, r[2], r[3], r[4], i - 1}
+    end
+    checks[i] = r
+    if result == nil or r[3] < result[3] then
+        result = {0, 0, r[3], r[4], i - 1}
+    end
+end
+
+for i = 1, #KEYS do
+    local window = tonumber(ARGV[2 * i + 2])
+    local state = checks[i][5]
+    if algorithm == "gcra" then
+        redis.call("SET", KEYS[i], string.format("%.0f", state), "PX", math.ceil((state - now) / 1000))
+    elseif algorithm == "token-bucket" then
+        redis.call("HSET", KEYS[i], "tokens", tostring(state), "ts", string.format("%.0f", now))
+        redis.call("PEXPIRE", KEYS[i], math.ceil(window / 1000))
+    else
+        redis.call("ZADD", KEYS[i], now, ARGV[2])
+        redis.call("PEXPIRE", KEYS[i], math.ceil(window / 1000) + 1000)
+    end
+end
+return result
+`)
+
+// RedisMultiWindowRateLimit 基于 Redis 的多窗口限流器，一次请求在一个 Lua 脚本中检查所有窗口
+// 所有窗口的键使用相同的 hash tag，在 Redis Cluster 中位于同一个 slot
+type RedisMultiWindowRateLimit struct {
+	rdb       redis.Cmdable
+	keys      []string
+	algorithm string
+	windows   []RateLimitWindow
+}
+
+// NewRedisMultiWindow 创建一个新的基于 Redis 的多窗口限流器，key 为各窗口键共用的前缀
+// 每个窗口的键为 "{<key>}:<duration>"，algorithm 为空表示滑动窗口
+func NewRedisMultiWindow(rdb redis.Cmdable, key, algorithm string, windows []RateLimitWindow) *RedisMultiWindowRateLimit {
+	rl := &RedisMultiWindowRateLimit{
+		rdb:       rdb,
+		keys:      make([]string, 0, len(windows)),
+		algorithm: algorithm,
+		windows:   make([]RateLimitWindow, 0, len(windows)),
+	}
+	for _, w := range windows {
+		if w.Count < 1 {
+			w.Count = 1
+		}
+		if w.Duration < 1 {
+			w.Duration = time.Second
+		}
+		rl.keys = append(rl.keys, "{"+key+"}:"+w.Duration.String())
+		rl.windows = append(rl.windows, w)
+	}
+	return rl
+}
+
+// Limit 超过任意一个窗口的限流时返回 true
+func (rl *RedisMultiWindowRateLimit) Limit(ctx context.Context) bool {
+	return rl.Decide(ctx).Limited
+}
+
+// Decide 检查所有窗口并在全部未超过限流时记录一次请求，返回限流结果
+func (rl *RedisMultiWindowRateLimit) Decide(ctx context.Context) Decision {
+	args := make([]any, 0, 2+2*len(rl.windows))
+	args = append(args, rl.algorithm, uuid.NewString())
+	for _, w := range rl.windows {
+		args = append(args, w.Count, w.Duration.Microseconds())
+	}
+
+	result, err := multiWindowScript.Run(ctx, rl.rdb, rl.keys, args...).Int64Slice()
+	if err != nil {
+		limit := rl.windows[0].Count
+		return Decision{Limit: limit, Remaining: limit} // 出错时允许请求通过
+	}
+	return newDecision(rl.windows[result[4]].Count, result[:4])
+}
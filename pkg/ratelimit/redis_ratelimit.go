@@ -34,8 +34,14 @@ func NewRedis(rdb redis.Cmdable, key string, rate int, duration time.Duration) *
 
 // Limit 使用 Redis 滑动窗口检查是否超过限流，超过返回 true
 func (rl *RedisRateLimit) Limit(ctx context.Context) bool {
+	return rl.Decide(ctx).Limited
+}
+
+// Decide 使用 Redis 滑动窗口检查并记录一次请求，返回限流结果
+func (rl *RedisRateLimit) Decide(ctx context.Context) Decision {
 	now := time.Now()
 	windowStart := now.Add(-rl.duration)
+	d := Decision{Limit: rl.rate}
 
 	key := rl.key
 	pipe := rl.rdb.Pipeline()
@@ -46,17 +52,30 @@ func (rl *RedisRateLimit) Limit(ctx context.Context) bool {
 	// 计算窗口内的当前条目数
 	zcount := pipe.ZCount(ctx, key, "-inf", "+inf")
 
+	// 获取窗口内最早和最新的条目，用于计算配额恢复时间
+	oldest := pipe.ZRangeWithScores(ctx, key, 0, 0)
+	newest := pipe.ZRangeWithScores(ctx, key, -1, -1)
+
 	// 执行管道
 	_, err := pipe.Exec(ctx)
 	if err != nil {
-		return false // 出错时允许请求通过
+		d.Remaining = rl.rate
+		return d // 出错时允许请求通过
 	}
 
 	count := zcount.Val()
 
 	// 检查是否超过限制
 	if count >= int64(rl.rate) {
-		return true
+		// 最早的条目滑出窗口后恢复一次配额，最新的条目滑出窗口后配额完全恢复
+		d.Limited = true
+		if entries := oldest.Val(); len(entries) > 0 {
+			d.RetryAfter = time.Unix(0, int64(entries[0].Score)).Add(rl.duration).Sub(now)
+		}
+		if entries := newest.Val(); len(entries) > 0 {
+			d.Reset = time.Unix(0, int64(entries[0].Score)).Add(rl.duration)
+		}
+		return d
 	}
 
 	// 添加当前请求
@@ -68,7 +87,9 @@ func (rl *RedisRateLimit) Limit(ctx context.Context) bool {
 	pipe.Expire(ctx, key, rl.duration+time.Second)
 	_, _ = pipe.Exec(ctx)
 
-	return false
+	d.Remaining = rl.rate - int(count) - 1
+	d.Reset = now.Add(rl.duration)
+	return d
 }
 
 // UpdateRate 更新限流频率
@@ -0,0 +1,185 @@
+package redislb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/play/play/pkg/compile"
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrNodeNotFound = errors.New("node not found")
+
+// evictScript 从索引中移除节点并删除节点信息，节点存在时发布 evicted 事件
+// KEYS[1]: 节点键
+// KEYS[2]: 服务索引 ZSET
+// ARGV[1]: 节点ID
+// ARGV[2]: 事件
+// ARGV[3]: 事件 channel
+var evictScript = redis.NewScript(`
+local removed = redis.call("ZREM", KEYS[2], ARGV[1]) + redis.call("DEL", KEYS[1])
+if removed > 0 then
+    redis.call("PUBLISH", ARGV[3], ARGV[2])
+end
+return removed
+`)
+
+// NodeStatus 是服务索引中的一个节点
+type NodeStatus struct {
+	Id        string            `json:"id"`
+	Node      *compile.NodeInfo `json:"node"`       // 节点信息，为空表示节点键已过期或被删除，但索引中的成员尚未清理
+	ExpiresAt time.Time         `json:"expires_at"` // 心跳过期时间
+	TTL       time.Duration     `json:"ttl"`        // 距离心跳过期的剩余时间，以 Redis 服务端时间为准
+	Expired   bool              `json:"expired"`    // 心跳已过期，等待同一服务的其他节点在心跳时清理
+}
+
+// Admin 是服务注册表的管理接口，用于查看服务和节点、订阅节点变更事件和强制移除节点
+type Admin struct {
+	rdb redis.Cmdable
+}
+
+// NewAdmin 创建一个新的 Admin
+func NewAdmin(rdb redis.Cmdable) *Admin {
+	return &Admin{rdb: rdb}
+}
+
+// Services 返回所有存在服务索引的服务名称，按名称排序
+// 使用 SCAN 遍历，Redis Cluster 下遍历所有主节点
+func (a *Admin) Services(ctx context.Context) ([]string, error) {
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	scan := func(ctx context.Context, c redis.Cmdable) error {
+		iter := c.ScanType(ctx, 0, "services:{*}", 100, "zset").Iterator()
+		for iter.Next(ctx) {
+			if name, ok := serviceFromIndexKey(iter.Val()); ok {
+				mu.Lock()
+				seen[name] = true
+				mu.Unlock()
+			}
+		}
+		return iter.Err()
+	}
+
+	var err error
+	if cc, ok := a.rdb.(*redis.ClusterClient); ok {
+		err = cc.ForEachMaster(ctx, func(ctx context.Context, c *redis.Client) error {
+			return scan(ctx, c)
+		})
+	} else {
+		err = scan(ctx, a.rdb)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan services: %w", err)
+	}
+
+	services := make([]string, 0, len(seen))
+	for name := range seen {
+		services = append(services, name)
+	}
+	slices.Sort(services)
+	return services, nil
+}
+
+// serviceFromIndexKey 从服务索引键中解析服务名称
+func serviceFromIndexKey(key string) (string, bool) {
+	name, ok := strings.CutPrefix(key, "services:{")
+	if !ok {
+		return "", false
+	}
+	name, ok = strings.CutSuffix(name, "}")
+	if !ok || name == "" || strings.ContainsAny(name, "{}") {
+		return "", false
+	}
+	return name, true
+}
+
+// Nodes 返回服务索引中的所有节点，包括心跳已过期但尚未清理的节点，按节点ID排序
+func (a *Admin) Nodes(ctx context.Context, service string) ([]NodeStatus, error) {
+	now, err := a.rdb.Time(ctx).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get server time: %w", err)
+	}
+
+	node := &compile.NodeInfo{Name: service}
+	members, err := a.rdb.ZRangeWithScores(ctx, node.IndexKey(), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
+	}
+	if len(members) == 0 {
+		return []NodeStatus{}, nil
+	}
+
+	keys := make([]string, 0, len(members))
+	for _, member := range members {
+		node.Id = member.Member.(string)
+		keys = append(keys, node.Key())
+	}
+	values, err := a.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get values: %w", err)
+	}
+
+	nodes := make([]NodeStatus, 0, len(members))
+	for i, member := range members {
+		expiresAt := time.UnixMilli(int64(member.Score))
+		status := NodeStatus{
+			Id:        member.Member.(string),
+			ExpiresAt: expiresAt,
+			TTL:       expiresAt.Sub(now),
+			Expired:   !expiresAt.After(now),
+		}
+		if value, ok := values[i].(string); ok {
+			var info compile.NodeInfo
+			if err := json.Unmarshal([]byte(value), &info); err == nil {
+				status.Node = &info
+			}
+		}
+		nodes = append(nodes, status)
+	}
+	slices.SortFunc(nodes, func(a, b NodeStatus) int { return strings.Compare(a.Id, b.Id) })
+	return nodes, nil
+}
+
+// Watch 订阅指定服务的节点变更事件，services 为空时订阅所有服务
+// 返回时订阅已经生效，ctx 取消后关闭返回的 channel
+func (a *Admin) Watch(ctx context.Context, services ...string) (<-chan Event, error) {
+	sub, ok := a.rdb.(subscriber)
+	if !ok {
+		return nil, ErrWatchNotSupported
+	}
+	if len(services) == 0 {
+		return watchEvents(ctx, sub.PSubscribe(ctx, eventsChannel("*")))
+	}
+
+	channels := make([]string, 0, len(services))
+	for _, service := range services {
+		channels = append(channels, eventsChannel(service))
+	}
+	return watchEvents(ctx, sub.Subscribe(ctx, channels...))
+}
+
+// Evict 强制移除节点并发布 evicted 事件，用于清理已经不存在但仍在发布的僵尸节点
+// 节点进程仍在运行时，下一次心跳会重新注册
+func (a *Admin) Evict(ctx context.Context, service, id string) error {
+	node := &compile.NodeInfo{Name: service, Id: id}
+	event, _ := json.Marshal(&Event{Type: EventEvicted, Service: service, Id: id})
+	keys := []string{node.Key(), node.IndexKey()}
+	removed, err := evictScript.Run(ctx, a.rdb, keys, id, event, eventsChannel(service)).Int()
+	if err != nil {
+		return fmt.Errorf("failed to evict node: %w", err)
+	}
+	// 同时删除旧版本的节点键，见 Registry
+	if err := a.rdb.Del(ctx, node.LegacyKey()).Err(); err != nil {
+		return fmt.Errorf("failed to evict node: %w", err)
+	}
+	if removed == 0 {
+		return ErrNodeNotFound
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+package redislb
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/goccy/go-json"
+	"github.com/play/play/pkg/compile"
+
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// BalancerName 是加权负载均衡器的名称，通过服务配置启用，可以为每个连接单独设置可用区和金丝雀版本：
+//
+//	grpc.WithDefaultServiceConfig(`{"loadBalancingConfig":[{"redislb_weighted":{"localZone":"z1","canaryVersion":"v2","canaryPercent":10}}]}`)
+//
+// 服务配置中没有设置的字段使用 RegisterBalancer 的选项
+const BalancerName = "redislb_weighted"
+
+type BalancerOptApplyFn func(*lbConfig)
+
+// WithLocalZone 设置本机所在的可用区，优先选择同一可用区的节点，没有可用节点时再选择其他可用区
+func WithLocalZone(zone string) BalancerOptApplyFn {
+	return func(cfg *lbConfig) {
+		cfg.LocalZone = zone
+	}
+}
+
+// WithCanary 将 percent% 的请求路由到指定版本的节点，其余请求只路由到其他版本的节点
+// 通过 WithVersion 指定了版本的请求不受影响
+func WithCanary(version string, percent int) BalancerOptApplyFn {
+	return func(cfg *lbConfig) {
+		cfg.CanaryVersion = version
+		cfg.CanaryPercent = percent
+	}
+}
+
+// RegisterBalancer 注册加权负载均衡器，需要在创建 gRPC 连接前调用，opts 为所有连接的默认配置
+func RegisterBalancer(opts ...BalancerOptApplyFn) {
+	bb := &balancerBuilder{}
+	for _, opt := range opts {
+		opt(&bb.defaults)
+	}
+	balancer.Register(bb)
+}
+
+type versionKey struct{}
+
+// WithVersion 指定请求路由到的节点版本，没有该版本的可用节点时路由到所有节点
+func WithVersion(ctx context.Context, version string) context.Context {
+	return context.WithValue(ctx, versionKey{}, version)
+}
+
+// versionFromContext 返回请求指定的节点版本
+func versionFromContext(ctx context.Context) string {
+	version, _ := ctx.Value(versionKey{}).(string)
+	return version
+}
+
+// lbConfig 是负载均衡器的配置
+type lbConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	LocalZone     string `json:"localZone,omitempty"`
+	CanaryVersion string `json:"canaryVersion,omitempty"`
+	CanaryPercent int    `json:"canaryPercent,omitempty"`
+}
+
+var (
+	_ balancer.Builder      = (*balancerBuilder)(nil)
+	_ balancer.ConfigParser = (*balancerBuilder)(nil)
+)
+
+// balancerBuilder 为每个连接创建一个负载均衡器，子连接的管理由 base 负载均衡器完成
+type balancerBuilder struct {
+	defaults lbConfig
+}
+
+func (bb *balancerBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := &pickerBuilder{config: bb.defaults, latest: resolver.NewAddressMapV2[*attributes.Attributes]()}
+	return &weightedBalancer{
+		Balancer: base.NewBalancerBuilder(BalancerName, pb, base.Config{HealthCheck: true}).Build(cc, opts),
+		defaults: bb.defaults,
+		pb:       pb,
+	}
+}
+
+func (bb *balancerBuilder) Name() string {
+	return BalancerName
+}
+
+// ParseConfig 解析服务配置中的负载均衡器配置，没有设置的字段使用默认配置
+func (bb *balancerBuilder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	cfg := bb.defaults
+	var override lbConfig
+	if err := json.Unmarshal(js, &override); err != nil {
+		return nil, fmt.Errorf("failed to parse %s config: %w", BalancerName, err)
+	}
+	if override.CanaryPercent < 0 || override.CanaryPercent > 100 {
+		return nil, fmt.Errorf("invalid canary percent %d", override.CanaryPercent)
+	}
+	if override.LocalZone != "" {
+		cfg.LocalZone = override.LocalZone
+	}
+	if override.CanaryVersion != "" {
+		cfg.CanaryVersion = override.CanaryVersion
+		cfg.CanaryPercent = override.CanaryPercent
+	}
+	return &cfg, nil
+}
+
+// weightedBalancer 在 base 负载均衡器之前记录最新的配置和地址属性
+// base 负载均衡器只在创建子连接时保存地址，节点的权重、状态等变化时不会重建子连接，picker 需要使用最新的地址属性
+type weightedBalancer struct {
+	balancer.Balancer
+	defaults lbConfig
+	pb       *pickerBuilder
+}
+
+func (b *weightedBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	b.pb.config = b.defaults
+	if cfg, ok := s.BalancerConfig.(*lbConfig); ok {
+		b.pb.config = *cfg
+	}
+	b.pb.setAddresses(s.ResolverState.Addresses)
+	return b.Balancer.UpdateClientConnState(s)
+}
+
+var _ base.PickerBuilder = (*pickerBuilder)(nil)
+
+// pickerBuilder 由 weightedBalancer 更新，gRPC 串行调用负载均衡器，不需要加锁
+type pickerBuilder struct {
+	config lbConfig
+	latest *resolver.AddressMapV2[*attributes.Attributes] // 最新的地址属性
+}
+
+// setAddresses 记录最新的地址属性
+func (pb *pickerBuilder) setAddresses(addrs []resolver.Address) {
+	pb.latest = resolver.NewAddressMapV2[*attributes.Attributes]()
+	for _, addr := range addrs {
+		pb.latest.Set(addr, addr.BalancerAttributes)
+	}
+}
+
+func (pb *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	conns := make([]*weightedConn, 0, len(info.ReadySCs))
+	for sc, sci := range info.ReadySCs {
+		attrs := sci.Address.BalancerAttributes
+		if pb.latest != nil {
+			if latest, ok := pb.latest.Get(sci.Address); ok {
+				attrs = latest
+			}
+		}
+		conns = append(conns, newWeightedConn(sc, attrs))
+	}
+	return &picker{
+		config: pb.config,
+		conns:  conns,
+	}
+}
+
+// weightedConn 是带有负载均衡属性的子连接
+type weightedConn struct {
+	sc       balancer.SubConn
+	weight   int
+	zone     string
+	version  string
+	draining bool
+}
+
+func newWeightedConn(sc balancer.SubConn, attrs *attributes.Attributes) *weightedConn {
+	wc := &weightedConn{sc: sc, weight: defaultWeight}
+	if weight, ok := attrs.Value(AttrWeight).(int); ok && weight > 0 {
+		wc.weight = weight
+	}
+	wc.zone, _ = attrs.Value(AttrZone).(string)
+	wc.version, _ = attrs.Value(AttrVersion).(string)
+	wc.draining = attrs.Value(AttrState) == compile.NodeStateDraining
+	return wc
+}
+
+// picker 先排除 draining 的节点，然后按版本、再按可用区筛选子连接，然后在筛选结果中做平滑加权轮询
+// 每组筛选结果在第一次使用时创建，之后选择子连接不需要加锁
+type picker struct {
+	config lbConfig
+	conns  []*weightedConn
+	groups sync.Map // key: 筛选条件, value: *wrr[*weightedConn]，每组筛选结果单独轮询
+}
+
+func (p *picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	version := versionFromContext(info.Ctx)
+	excludeVersion := ""
+	if version == "" && p.config.CanaryVersion != "" {
+		if rand.IntN(100) < p.config.CanaryPercent {
+			version = p.config.CanaryVersion
+		} else {
+			excludeVersion = p.config.CanaryVersion
+		}
+	}
+
+	key := strings.Join([]string{version, excludeVersion}, "|")
+	g, ok := p.groups.Load(key)
+	if !ok {
+		g, _ = p.groups.LoadOrStore(key, p.newGroup(version, excludeVersion))
+	}
+	wc, _ := g.(*wrr[*weightedConn]).next(nil)
+	return balancer.PickResult{SubConn: wc.sc}, nil
+}
+
+// newGroup 按条件筛选子连接，每一步筛选结果为空时放弃该步筛选
+func (p *picker) newGroup(version, excludeVersion string) *wrr[*weightedConn] {
+	conns := filterConns(p.conns, func(wc *weightedConn) bool { return !wc.draining })
+	if version != "" {
+		conns = filterConns(conns, func(wc *weightedConn) bool { return wc.version == version })
+	} else if excludeVersion != "" {
+		conns = filterConns(conns, func(wc *weightedConn) bool { return wc.version != excludeVersion })
+	}
+	if p.config.LocalZone != "" {
+		conns = filterConns(conns, func(wc *weightedConn) bool { return wc.zone == p.config.LocalZone })
+	}
+	return newWRR(conns, func(wc *weightedConn) int { return wc.weight })
+}
+
+// filterConns 返回满足条件的子连接，没有满足条件的子连接时返回原列表
+func filterConns(conns []*weightedConn, fn func(*weightedConn) bool) []*weightedConn {
+	filtered := make([]*weightedConn, 0, len(conns))
+	for _, wc := range conns {
+		if fn(wc) {
+			filtered = append(filtered, wc)
+		}
+	}
+	if len(filtered) == 0 {
+		return conns
+	}
+	return filtered
+}
+
+// wrr 是平滑加权轮询（与 nginx 相同），权重高的节点被均匀地穿插选择
+// 创建时预先计算一个周期内的选择顺序，选择时只原子地递增游标，可以在多个 goroutine 中并发使用
+type wrr[T any] struct {
+	items    []T
+	schedule []int // 一个周期内依次选择的节点下标
+	cursor   atomic.Uint64
+}
+
+func newWRR[T any](items []T, weight func(T) int) *wrr[T] {
+	weights := make([]int, len(items))
+	total, g := 0, 0
+	for i, item := range items {
+		weights[i] = weight(item)
+		g = gcd(g, weights[i])
+	}
+	for i := range weights {
+		weights[i] /= g
+		total += weights[i]
+	}
+	// 权重相差悬殊时按比例缩小，限制一个周期的长度
+	if total > maxSchedule {
+		scaled := 0
+		for i := range weights {
+			weights[i] = max(weights[i]*maxSchedule/total, 1)
+			scaled += weights[i]
+		}
+		total = scaled
+	}
+
+	w := &wrr[T]{items: items, schedule: make([]int, 0, total)}
+	current := make([]int, len(items))
+	for range total {
+		best := 0
+		for i := range items {
+			current[i] += weights[i]
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		w.schedule = append(w.schedule, best)
+	}
+	return w
+}
+
+// maxSchedule 是平滑加权轮询一个周期的最大长度
+const maxSchedule = 1 << 16
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// next 在 skip 返回 false 的节点中选择下一个节点，没有可选节点时返回 false
+func (w *wrr[T]) next(skip func(T) bool) (T, bool) {
+	if n := uint64(len(w.schedule)); n > 0 {
+		start := w.cursor.Add(1) - 1
+		for i := range n {
+			item := w.items[w.schedule[(start+i)%n]]
+			if skip == nil || !skip(item) {
+				return item, true
+			}
+		}
+	}
+	var zero T
+	return zero, false
+}
@@ -1,6 +1,7 @@
 package redislb
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strings"
@@ -19,23 +20,55 @@ func WithLogger(logger grpclog.LoggerV2) BuilderOptApplyFn {
 	}
 }
 
+// Deprecated: 使用 WithWhitelist，两者都支持 IPv4 和 IPv6 网段
 func WithIPv4Whitelist(subnets []string) BuilderOptApplyFn {
+	return WithWhitelist(subnets)
+}
+
+// WithWhitelist 设置允许连接的网段，支持 IPv4 和 IPv6，为空表示不限制，设置后只允许 WithAllowedHostnames 中的域名端点
+func WithWhitelist(subnets []string) BuilderOptApplyFn {
 	return func(builder *builder) {
 		builder.whitelistSubnets = subnets
 	}
 }
 
+// WithResolverOptions 设置创建 Resolver 时的选项，如 WithAddressPolicy
+func WithResolverOptions(opts ...ResolverOptApplyFn) BuilderOptApplyFn {
+	return func(builder *builder) {
+		builder.resolverOpts = append(builder.resolverOpts, opts...)
+	}
+}
+
+// WithPollInterval 设置无法订阅节点变更事件或服务只有一个节点时的轮询间隔
+func WithPollInterval(d time.Duration) BuilderOptApplyFn {
+	return func(builder *builder) {
+		builder.pollInterval = d
+	}
+}
+
+// WithReconcileInterval 设置订阅节点变更事件且服务有多个节点时的对账间隔
+func WithReconcileInterval(d time.Duration) BuilderOptApplyFn {
+	return func(builder *builder) {
+		builder.reconcileInterval = d
+	}
+}
+
 var _ resolver.Builder = (*builder)(nil)
 
 type builder struct {
-	rds              redis.Cmdable
-	logger           grpclog.LoggerV2
-	whitelistSubnets []string
+	rds               redis.Cmdable
+	logger            grpclog.LoggerV2
+	whitelistSubnets  []string
+	pollInterval      time.Duration
+	reconcileInterval time.Duration
+	resolverOpts      []ResolverOptApplyFn
 }
 
 func NewBuilder(rds redis.Cmdable, opts ...BuilderOptApplyFn) *builder {
 	b := &builder{
-		rds: rds,
+		rds:               rds,
+		pollInterval:      2 * time.Second,
+		reconcileInterval: 30 * time.Second,
 	}
 
 	for _, opt := range opts {
@@ -50,25 +83,23 @@ func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, opts res
 		return nil, fmt.Errorf("unexpected schema: %s", target.URL.Scheme)
 	}
 
-	whitelistNets := make([]*net.IPNet, 0, len(b.whitelistSubnets))
-	for _, subnet := range b.whitelistSubnets {
-		_, net, err := net.ParseCIDR(subnet)
-		if err == nil {
-			whitelistNets = append(whitelistNets, net)
-		}
-	}
-
 	// 创建公共的 Resolver
-	commonResolver := NewResolver(b.rds, target.URL.Host, whitelistNets, "grpc")
+	commonResolver := NewResolver(b.rds, target.URL.Host, parseSubnets(b.whitelistSubnets), "grpc", b.resolverOpts...)
 
 	// 创建 schemaResolver，内嵌公共 Resolver
+	ctx, cancel := context.WithCancel(context.Background())
 	res := &schemaResolver{
-		Resolver:    commonResolver,
-		watchTicker: time.NewTicker(time.Second * 2),
-		client:      cc,
-		rnChan:      make(chan struct{}),
-		closeChan:   make(chan struct{}),
+		Resolver:          commonResolver,
+		watchTicker:       time.NewTicker(b.pollInterval),
+		pollInterval:      b.pollInterval,
+		reconcileInterval: b.reconcileInterval,
+		client:            cc,
+		rnChan:            make(chan struct{}, 1),
+		closeChan:         make(chan struct{}),
+		ctx:               ctx,
+		cancel:            cancel,
 	}
+	res.interval.Store(int64(b.pollInterval))
 
 	if b.logger == nil {
 		res.logger = grpclog.Component(b.Scheme())
@@ -78,11 +109,24 @@ func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, opts res
 
 	if res.serviceName != "" {
 		go res.watcher()
+		go res.watchEvents()
 		res.resolveNow(false)
 	}
 	return res, nil
 }
 
+// parseSubnets 解析 CIDR 格式的网段，忽略无效的网段
+func parseSubnets(subnets []string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(subnets))
+	for _, subnet := range subnets {
+		_, ipNet, err := net.ParseCIDR(subnet)
+		if err == nil {
+			nets = append(nets, ipNet)
+		}
+	}
+	return nets
+}
+
 func (b *builder) Scheme() string {
 	return schema
 }
@@ -0,0 +1,86 @@
+package redislb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/goccy/go-json"
+	"github.com/redis/go-redis/v9"
+)
+
+// 服务节点变更事件类型
+const (
+	EventRegister   = "register"   // 节点注册，或过期后重新注册
+	EventDeregister = "deregister" // 节点主动注销
+	EventLost       = "lost"       // 节点心跳超时，由同一服务的其他节点在心跳时发现
+	EventDraining   = "draining"   // 节点进入 draining 状态，不再接收新的请求
+	EventUnhealthy  = "unhealthy"  // 节点健康检查失败，从服务发现中移除，恢复后重新发布 register 事件
+	EventEvicted    = "evicted"    // 节点被管理员强制移除
+)
+
+var ErrWatchNotSupported = errors.New("redis client does not support subscribe")
+
+// Event 是服务节点变更事件
+type Event struct {
+	Type    string `json:"type"`
+	Service string `json:"service"`
+	Id      string `json:"id"`
+}
+
+// subscriber 是支持 Redis SUBSCRIBE 的客户端
+type subscriber interface {
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+	PSubscribe(ctx context.Context, patterns ...string) *redis.PubSub
+}
+
+// eventsChannel 返回服务节点变更事件的 channel
+func eventsChannel(service string) string {
+	return "services:{" + service + "}:events"
+}
+
+// Watch 订阅服务节点变更事件，返回时订阅已经生效，ctx 取消后关闭返回的 channel
+// 订阅断开重连期间的事件会丢失，调用方需要定期调用 Resolve 对账
+func (r *Resolver) Watch(ctx context.Context) (<-chan Event, error) {
+	sub, ok := r.rdb.(subscriber)
+	if !ok {
+		return nil, ErrWatchNotSupported
+	}
+	return watchEvents(ctx, sub.Subscribe(ctx, eventsChannel(r.serviceName)))
+}
+
+// watchEvents 等待订阅生效，然后将收到的消息解析为 Event，ctx 取消后关闭订阅和返回的 channel
+func watchEvents(ctx context.Context, ps *redis.PubSub) (<-chan Event, error) {
+	if _, err := ps.Receive(ctx); err != nil {
+		_ = ps.Close()
+		return nil, fmt.Errorf("failed to subscribe: %w", err)
+	}
+
+	events := make(chan Event, 16)
+	go func() {
+		defer close(events)
+		defer ps.Close()
+
+		ch := ps.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				var event Event
+				if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+					continue
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,270 @@
+package redislb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/play/play/pkg/compile"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrNoEndpoints = errors.New("no available endpoints")
+
+const (
+	defaultCacheTTL = 5 * time.Second // 默认的服务地址缓存时间
+	defaultRetries  = 2               // 默认连接失败时重试的次数
+	resolveTimeout  = 5 * time.Second // 单次解析服务地址的超时时间
+)
+
+type TransportOptApplyFn func(*Transport)
+
+// WithBaseTransport 设置实际发送请求的 RoundTripper，默认为 http.DefaultTransport
+func WithBaseTransport(base http.RoundTripper) TransportOptApplyFn {
+	return func(t *Transport) {
+		t.base = base
+	}
+}
+
+// WithCacheTTL 设置服务地址的缓存时间
+func WithCacheTTL(d time.Duration) TransportOptApplyFn {
+	return func(t *Transport) {
+		t.cacheTTL = d
+	}
+}
+
+// WithRetries 设置连接失败时换一个节点重试的次数，0 表示不重试
+func WithRetries(n int) TransportOptApplyFn {
+	return func(t *Transport) {
+		t.retries = n
+	}
+}
+
+// WithTransportWhitelist 设置允许访问的网段，支持 IPv4 和 IPv6，为空表示不限制，设置后只允许 WithAllowedHostnames 中的域名端点
+func WithTransportWhitelist(subnets []string) TransportOptApplyFn {
+	return func(t *Transport) {
+		t.whitelistNets = parseSubnets(subnets)
+	}
+}
+
+// WithTransportResolverOptions 设置创建 Resolver 时的选项，如 WithAddressPolicy
+func WithTransportResolverOptions(opts ...ResolverOptApplyFn) TransportOptApplyFn {
+	return func(t *Transport) {
+		t.resolverOpts = append(t.resolverOpts, opts...)
+	}
+}
+
+var _ http.RoundTripper = (*Transport)(nil)
+
+// Transport 是解析 redislb://service/path 地址的 http.RoundTripper
+// 通过 Resolver 获取服务的 http 端点，按权重轮询并跳过 draining 的节点，连接失败时换一个节点重试
+// 其他协议的请求直接交给 base 处理
+type Transport struct {
+	rdb           redis.Cmdable
+	base          http.RoundTripper
+	cacheTTL      time.Duration
+	retries       int
+	whitelistNets []*net.IPNet
+	resolverOpts  []ResolverOptApplyFn
+
+	mu       sync.Mutex
+	services map[string]*httpService // key: 服务名称
+}
+
+// httpService 是缓存的服务地址
+// 地址列表过期后在后台解析，解析期间和解析失败时继续使用上次的结果，只有从未解析成功时才等待解析完成
+type httpService struct {
+	resolver  *Resolver
+	ttl       time.Duration
+	wrr       atomic.Pointer[wrr[Address]]
+	expiresAt atomic.Int64 // 地址列表的过期时间，Unix 纳秒
+
+	mu        sync.Mutex
+	resolving chan struct{} // 正在进行的解析，完成后关闭
+	err       error         // 上次解析的错误
+}
+
+// NewTransport 创建一个新的 Transport
+func NewTransport(rdb redis.Cmdable, opts ...TransportOptApplyFn) *Transport {
+	t := &Transport{
+		rdb:      rdb,
+		base:     http.DefaultTransport,
+		cacheTTL: defaultCacheTTL,
+		retries:  defaultRetries,
+		services: make(map[string]*httpService),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// NewHTTPClient 创建一个使用 Transport 的 http.Client
+func NewHTTPClient(rdb redis.Cmdable, opts ...TransportOptApplyFn) *http.Client {
+	return &http.Client{Transport: NewTransport(rdb, opts...)}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != schema {
+		return t.base.RoundTrip(req)
+	}
+
+	svc := t.service(req.URL.Host)
+	tried := make(map[string]bool)
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		addr, err := svc.pick(req, tried)
+		if err != nil {
+			if lastErr != nil {
+				// 所有节点都连接失败
+				return nil, lastErr
+			}
+			if req.Body != nil {
+				_ = req.Body.Close()
+			}
+			return nil, fmt.Errorf("%s://%s: %w", schema, req.URL.Host, err)
+		}
+		tried[addr.Addr] = true
+
+		outreq := req.Clone(req.Context())
+		outreq.URL.Scheme = "http"
+		outreq.URL.Host = addr.Addr
+		outreq.Host = ""
+		if attempt > 0 && req.GetBody != nil {
+			if outreq.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := t.base.RoundTrip(outreq)
+		if err == nil || attempt >= t.retries || !isDialError(err) || !canRetry(req) {
+			return resp, err
+		}
+		lastErr = err
+		svc.invalidate()
+	}
+}
+
+// service 返回服务的缓存
+func (t *Transport) service(name string) *httpService {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	svc, ok := t.services[name]
+	if !ok {
+		svc = &httpService{resolver: NewResolver(t.rdb, name, t.whitelistNets, "http", t.resolverOpts...), ttl: t.cacheTTL}
+		t.services[name] = svc
+	}
+	return svc
+}
+
+// pick 选择一个没有尝试过的节点
+func (s *httpService) pick(req *http.Request, tried map[string]bool) (Address, error) {
+	if done := s.refresh(); done != nil {
+		select {
+		case <-done:
+		case <-req.Context().Done():
+			return Address{}, req.Context().Err()
+		}
+	}
+
+	w := s.wrr.Load()
+	if w == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return Address{}, s.err
+	}
+	addr, ok := w.next(func(addr Address) bool { return tried[addr.Addr] })
+	if !ok {
+		return Address{}, ErrNoEndpoints
+	}
+	return addr, nil
+}
+
+// refresh 在地址列表过期且没有正在进行的解析时启动后台解析，同一时刻只有一个解析
+// 从未解析成功时返回正在进行的解析，调用方需要等待其完成
+func (s *httpService) refresh() <-chan struct{} {
+	if s.wrr.Load() != nil && time.Now().UnixNano() < s.expiresAt.Load() {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.resolving == nil && time.Now().UnixNano() >= s.expiresAt.Load() {
+		s.resolving = make(chan struct{})
+		go s.resolve()
+	}
+	if s.wrr.Load() != nil {
+		return nil
+	}
+	return s.resolving
+}
+
+// resolve 解析服务地址，失败时保留上次的结果，在缓存时间后重试
+func (s *httpService) resolve() {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := s.resolver.Resolve(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer func() {
+		close(s.resolving)
+		s.resolving = nil
+	}()
+
+	s.err = err
+	if err != nil {
+		if s.wrr.Load() != nil {
+			s.expiresAt.Store(time.Now().Add(s.ttl).UnixNano())
+			log.Warn().Err(err).Str("service", s.resolver.serviceName).Msg("failed to resolve http endpoints")
+		}
+		return
+	}
+	s.wrr.Store(newWRR(filterAddrs(addrs), addressWeight))
+	s.expiresAt.Store(time.Now().Add(s.ttl).UnixNano())
+}
+
+// invalidate 使缓存过期，下次选择时在后台重新解析，本次重试继续使用当前的地址列表
+func (s *httpService) invalidate() {
+	s.expiresAt.Store(0)
+}
+
+// filterAddrs 排除 draining 的节点，所有节点都在 draining 时返回原列表
+func filterAddrs(addrs []Address) []Address {
+	filtered := make([]Address, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr.Attributes[AttrState] != compile.NodeStateDraining {
+			filtered = append(filtered, addr)
+		}
+	}
+	if len(filtered) == 0 {
+		return addrs
+	}
+	return filtered
+}
+
+// addressWeight 返回节点的权重
+func addressWeight(addr Address) int {
+	if weight, ok := addr.Attributes[AttrWeight].(int); ok && weight > 0 {
+		return weight
+	}
+	return defaultWeight
+}
+
+// isDialError 判断是否为建立连接失败，此时请求还没有发送，换一个节点重试是安全的
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// canRetry 判断请求体是否可以重新读取
+func canRetry(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
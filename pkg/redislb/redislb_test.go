@@ -0,0 +1,710 @@
+package redislb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/play/play/pkg/compile"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+// newTestNode 创建只有一个 grpc 端点的节点
+func newTestNode(name, id, host string) *compile.NodeInfo {
+	node := compile.NewNodeInfo().AddName(name).AddId(id)
+	node.Endpoints = append(node.Endpoints, compile.URL(url.URL{Scheme: "grpc", Host: host}))
+	return node
+}
+
+// heartbeatNode 模拟节点的一次心跳
+func heartbeatNode(t *testing.T, rdb redis.Cmdable, node *compile.NodeInfo, ttl time.Duration) {
+	t.Helper()
+	keys := []string{node.Key(), node.IndexKey()}
+	if err := heartbeatScript.Run(context.Background(), rdb, keys, node.Value(), node.Id, ttl.Milliseconds(), node.Name, eventsChannel(node.Name), "").Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestResolverIndex 验证解析器通过索引获取节点，并忽略和清理过期的节点
+func TestResolverIndex(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	mr.SetTime(now)
+
+	heartbeatNode(t, rdb, newTestNode("user", "a", "10.0.0.1:9000"), 10*time.Second)
+	heartbeatNode(t, rdb, newTestNode("user", "b", "10.0.0.2:9000"), 2*time.Second)
+	heartbeatNode(t, rdb, newTestNode("order", "c", "10.0.0.3:9000"), 10*time.Second)
+
+	r := NewResolver(rdb, "user", nil, "grpc")
+	addrs, err := r.Resolve(ctx)
+	if err != nil || len(addrs) != 2 {
+		t.Fatalf("expected 2 addresses, got %v %v", addrs, err)
+	}
+
+	// 节点 b 的心跳过期后不再返回，索引在最晚过期的节点过期时才过期，不随最后一次心跳的 TTL 过期
+	mr.SetTime(now.Add(5 * time.Second))
+	mr.FastForward(5 * time.Second)
+	addrs, err = r.Resolve(ctx)
+	if err != nil || len(addrs) != 1 || addrs[0].Addr != "10.0.0.1:9000" {
+		t.Fatalf("expected only node a, got %v %v", addrs, err)
+	}
+
+	// 下一次心跳清理过期的成员
+	heartbeatNode(t, rdb, newTestNode("user", "a", "10.0.0.1:9000"), 10*time.Second)
+	members, err := mr.ZMembers("services:{user}")
+	if err != nil || len(members) != 1 || members[0] != "a" {
+		t.Fatalf("expected expired member removed, got %v %v", members, err)
+	}
+}
+
+// testClientConn 记录 UpdateState 调用的 resolver.ClientConn
+type testClientConn struct {
+	resolver.ClientConn
+	mu     sync.Mutex
+	states []resolver.State
+}
+
+func (cc *testClientConn) UpdateState(state resolver.State) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.states = append(cc.states, state)
+	return nil
+}
+
+func (cc *testClientConn) ReportError(error) {}
+
+func (cc *testClientConn) updates() []resolver.State {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return slices.Clone(cc.states)
+}
+
+// TestResolverEvents 验证节点变更事件立即触发更新，且地址集合不变时不重复更新
+func TestResolverEvents(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	ctx := context.Background()
+	mr.SetTime(time.Now())
+	heartbeatNode(t, rdb, newTestNode("user", "a", "10.0.0.1:9000"), 10*time.Second)
+
+	events, err := NewResolver(rdb, "user", nil, "grpc").Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc := &testClientConn{}
+	b := NewBuilder(rdb, WithPollInterval(time.Hour))
+	res, err := b.Build(resolver.Target{URL: url.URL{Scheme: schema, Host: "user"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+
+	waitUpdates := func(n int) []resolver.State {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			if states := cc.updates(); len(states) >= n {
+				return states
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d updates, got %d", n, len(cc.updates()))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitUpdates(1)
+
+	// 等待事件订阅生效，再次心跳不发布事件，手动触发的解析也不会重复更新
+	time.Sleep(50 * time.Millisecond)
+	heartbeatNode(t, rdb, newTestNode("user", "a", "10.0.0.1:9000"), 10*time.Second)
+	res.ResolveNow(resolver.ResolveNowOptions{})
+
+	// 新节点注册后立即更新
+	heartbeatNode(t, rdb, newTestNode("user", "b", "10.0.0.2:9000"), 10*time.Second)
+	if event := <-events; event.Type != EventRegister || event.Id != "b" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	states := waitUpdates(2)
+	if len(states[1].Addresses) != 2 {
+		t.Fatalf("expected 2 addresses, got %+v", states[1])
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(cc.updates()); n != 2 {
+		t.Fatalf("expected no duplicate updates, got %d", n)
+	}
+}
+
+// TestResolverDraining 验证 draining 的节点不出现在解析结果中，除非所有节点都处于 draining 状态
+func TestResolverDraining(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	mr.SetTime(time.Now())
+	draining := func(id, host string) *compile.NodeInfo {
+		node := newTestNode("user", id, host)
+		node.State = compile.NodeStateDraining
+		return node
+	}
+	heartbeatNode(t, rdb, newTestNode("user", "a", "10.0.0.1:9000"), 10*time.Second)
+	heartbeatNode(t, rdb, draining("b", "10.0.0.2:9000"), 10*time.Second)
+
+	cc := &testClientConn{}
+	b := NewBuilder(rdb, WithPollInterval(time.Hour))
+	res, err := b.Build(resolver.Target{URL: url.URL{Scheme: schema, Host: "user"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+	sr := res.(*schemaResolver)
+
+	if states := cc.updates(); len(states) != 1 || len(states[0].Addresses) != 1 || states[0].Addresses[0].Addr != "10.0.0.1:9000" {
+		t.Fatalf("expected draining node excluded, got %+v", states)
+	}
+
+	heartbeatNode(t, rdb, draining("a", "10.0.0.1:9000"), 10*time.Second)
+	sr.resolveNow(true)
+	if states := cc.updates(); len(states) != 2 || len(states[1].Addresses) != 2 {
+		t.Fatalf("expected all addresses when every node is draining, got %+v", states)
+	}
+}
+
+// TestResolverInterval 验证只有一个节点或订阅断开时使用轮询间隔，订阅后有多个节点时使用对账间隔
+func TestResolverInterval(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	mr.SetTime(time.Now())
+	heartbeatNode(t, rdb, newTestNode("user", "a", "10.0.0.1:9000"), 10*time.Second)
+
+	cc := &testClientConn{}
+	b := NewBuilder(rdb, WithPollInterval(time.Minute), WithReconcileInterval(time.Hour))
+	res, err := b.Build(resolver.Target{URL: url.URL{Scheme: schema, Host: "user"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+	sr := res.(*schemaResolver)
+
+	waitInterval := func(d time.Duration) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Duration(sr.interval.Load()) != d {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected interval %s, got %s", d, time.Duration(sr.interval.Load()))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// 订阅生效后只有一个节点时仍然轮询
+	time.Sleep(50 * time.Millisecond)
+	if !sr.watching.Load() {
+		t.Fatal("expected watching")
+	}
+	waitInterval(time.Minute)
+
+	heartbeatNode(t, rdb, newTestNode("user", "b", "10.0.0.2:9000"), 10*time.Second)
+	waitInterval(time.Hour)
+
+	// 订阅断开后恢复轮询
+	events := make(chan Event)
+	close(events)
+	sr.consumeEvents(events)
+	waitInterval(time.Minute)
+}
+
+// TestResolverAttributes 验证节点的元数据完整地写入地址属性
+func TestResolverAttributes(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	mr.SetTime(time.Now())
+	node := newTestNode("user", "a", "10.0.0.1:9000").AddVersion("v2").
+		AddMetadata(MetadataWeight, "30").AddMetadata(MetadataZone, "zone-a")
+	heartbeatNode(t, rdb, node, 10*time.Second)
+
+	cc := &testClientConn{}
+	res, err := NewBuilder(rdb, WithPollInterval(time.Hour)).Build(resolver.Target{URL: url.URL{Scheme: schema, Host: "user"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+
+	states := cc.updates()
+	if len(states) != 1 || len(states[0].Addresses) != 1 {
+		t.Fatalf("unexpected states %+v", states)
+	}
+	attrs := states[0].Addresses[0].BalancerAttributes
+	expected := map[string]any{AttrId: "a", AttrWeight: 30, AttrZone: "zone-a", AttrVersion: "v2", AttrState: ""}
+	for k, v := range expected {
+		if got := attrs.Value(k); got != v {
+			t.Errorf("attribute %s: expected %v, got %v", k, v, got)
+		}
+	}
+}
+
+// testSubConn 是只用于区分节点的 balancer.SubConn
+type testSubConn struct {
+	balancer.SubConn
+	id string
+}
+
+// buildTestPicker 用给定的节点属性创建 picker
+func buildTestPicker(pb *pickerBuilder, nodes ...*compile.NodeInfo) balancer.Picker {
+	info := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for _, node := range nodes {
+		addr := resolver.Address{Addr: node.Id}
+		for k, v := range nodeAttributes(node) {
+			addr.BalancerAttributes = addr.BalancerAttributes.WithValue(k, v)
+		}
+		info.ReadySCs[&testSubConn{id: node.Id}] = base.SubConnInfo{Address: addr}
+	}
+	return pb.Build(info)
+}
+
+// pickCounts 选择 n 次并统计每个节点被选中的次数
+func pickCounts(t *testing.T, p balancer.Picker, ctx context.Context, n int) map[string]int {
+	t.Helper()
+	counts := make(map[string]int)
+	for range n {
+		res, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[res.SubConn.(*testSubConn).id]++
+	}
+	return counts
+}
+
+// TestWeightedPicker 验证加权轮询、同可用区优先和按版本路由
+func TestWeightedPicker(t *testing.T) {
+	ctx := context.Background()
+	node := func(id, weight, zone, version string) *compile.NodeInfo {
+		return newTestNode("user", id, id).AddVersion(version).
+			AddMetadata(MetadataWeight, weight).AddMetadata(MetadataZone, zone)
+	}
+
+	// 按权重分配请求
+	p := buildTestPicker(&pickerBuilder{}, node("a", "300", "", ""), node("b", "100", "", ""))
+	if counts := pickCounts(t, p, ctx, 400); counts["a"] != 300 || counts["b"] != 100 {
+		t.Fatalf("unexpected weighted distribution %v", counts)
+	}
+
+	// 并发选择时仍然按权重分配
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	concurrent := make(map[string]int)
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				res, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				concurrent[res.SubConn.(*testSubConn).id]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if concurrent["a"] != 300 || concurrent["b"] != 100 {
+		t.Fatalf("unexpected concurrent distribution %v", concurrent)
+	}
+
+	// 优先选择同可用区的节点，同可用区没有节点时选择其他可用区
+	p = buildTestPicker(&pickerBuilder{config: lbConfig{LocalZone: "z1"}}, node("a", "100", "z1", ""), node("b", "100", "z2", ""))
+	if counts := pickCounts(t, p, ctx, 10); counts["a"] != 10 {
+		t.Fatalf("expected local zone only, got %v", counts)
+	}
+	p = buildTestPicker(&pickerBuilder{config: lbConfig{LocalZone: "z3"}}, node("a", "100", "z1", ""), node("b", "100", "z2", ""))
+	if counts := pickCounts(t, p, ctx, 10); counts["a"] != 5 || counts["b"] != 5 {
+		t.Fatalf("expected fallback to all zones, got %v", counts)
+	}
+
+	// 金丝雀版本只接收指定比例的请求，指定版本的请求总是路由到该版本
+	pb := &pickerBuilder{config: lbConfig{CanaryVersion: "v2", CanaryPercent: 0}}
+	p = buildTestPicker(pb, node("a", "100", "", "v1"), node("b", "100", "", "v2"))
+	if counts := pickCounts(t, p, ctx, 10); counts["a"] != 10 {
+		t.Fatalf("expected no canary traffic, got %v", counts)
+	}
+	if counts := pickCounts(t, p, WithVersion(ctx, "v2"), 10); counts["b"] != 10 {
+		t.Fatalf("expected pinned version, got %v", counts)
+	}
+	pb.config.CanaryPercent = 100
+	p = buildTestPicker(pb, node("a", "100", "", "v1"), node("b", "100", "", "v2"))
+	if counts := pickCounts(t, p, ctx, 10); counts["b"] != 10 {
+		t.Fatalf("expected all canary traffic, got %v", counts)
+	}
+
+	// 不为 draining 的节点分配新的请求
+	draining := node("b", "100", "", "")
+	draining.State = compile.NodeStateDraining
+	p = buildTestPicker(&pickerBuilder{}, node("a", "100", "", ""), draining)
+	if counts := pickCounts(t, p, ctx, 10); counts["a"] != 10 {
+		t.Fatalf("expected draining node excluded, got %v", counts)
+	}
+
+	// 没有可用节点
+	if _, err := buildTestPicker(&pickerBuilder{}).Pick(balancer.PickInfo{Ctx: ctx}); err != balancer.ErrNoSubConnAvailable {
+		t.Fatalf("expected ErrNoSubConnAvailable, got %v", err)
+	}
+}
+
+// TestBalancerConfig 验证每个连接的负载均衡配置覆盖默认配置，且 picker 使用最新的地址属性
+func TestBalancerConfig(t *testing.T) {
+	bb := &balancerBuilder{}
+	WithLocalZone("z1")(&bb.defaults)
+	WithCanary("v2", 10)(&bb.defaults)
+
+	cfg, err := bb.ParseConfig([]byte(`{}`))
+	if err != nil || *cfg.(*lbConfig) != bb.defaults {
+		t.Fatalf("expected defaults, got %+v %v", cfg, err)
+	}
+	cfg, err = bb.ParseConfig([]byte(`{"localZone":"z2","canaryVersion":"v3","canaryPercent":50}`))
+	if err != nil || *cfg.(*lbConfig) != (lbConfig{LocalZone: "z2", CanaryVersion: "v3", CanaryPercent: 50}) {
+		t.Fatalf("unexpected config %+v %v", cfg, err)
+	}
+	if _, err := bb.ParseConfig([]byte(`{"canaryVersion":"v3","canaryPercent":101}`)); err == nil {
+		t.Fatal("expected invalid canary percent")
+	}
+
+	// 子连接保存的是创建时的地址属性，权重变化后使用最新的属性
+	ctx := context.Background()
+	a := newTestNode("user", "a", "a").AddMetadata(MetadataWeight, "100")
+	b := newTestNode("user", "b", "b").AddMetadata(MetadataWeight, "100")
+	pb := &pickerBuilder{}
+	latest := newTestNode("user", "a", "a").AddMetadata(MetadataWeight, "300")
+	addr := resolver.Address{Addr: "a"}
+	for k, v := range nodeAttributes(latest) {
+		addr.BalancerAttributes = addr.BalancerAttributes.WithValue(k, v)
+	}
+	pb.setAddresses([]resolver.Address{addr, {Addr: "b"}})
+	if counts := pickCounts(t, buildTestPicker(pb, a, b), ctx, 400); counts["a"] != 300 || counts["b"] != 100 {
+		t.Fatalf("expected latest weights, got %v", counts)
+	}
+}
+
+// TestRegistry 验证立即注册、draining 状态、健康检查和注销
+func TestRegistry(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	ctx := context.Background()
+	var healthy atomic.Bool
+	healthy.Store(true)
+	reg := NewRegistry(rdb,
+		WithNode(newTestNode("user", "a", "10.0.0.1:9000")),
+		WithKeepAliveDuration(20*time.Millisecond),
+		WithTtl(time.Second),
+		WithDrainTimeout(50*time.Millisecond),
+		WithHealthCheck(func(context.Context) error {
+			if !healthy.Load() {
+				return errors.New("unhealthy")
+			}
+			return nil
+		}),
+	)
+
+	r := NewResolver(rdb, "user", nil, "grpc")
+	events, err := r.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolve := func() []Address {
+		t.Helper()
+		addrs, err := r.Resolve(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addrs
+	}
+	waitEvent := func(typ string) {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event.Type != typ || event.Id != "a" {
+				t.Fatalf("expected %s event, got %+v", typ, event)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for %s event", typ)
+		}
+	}
+
+	// Register 返回时节点已经注册
+	if err := reg.Register(); err != nil {
+		t.Fatal(err)
+	}
+	if addrs := resolve(); len(addrs) != 1 {
+		t.Fatalf("expected registered node, got %v", addrs)
+	}
+	waitEvent(EventRegister)
+	// 同时写入旧版本的节点键
+	if !mr.Exists("services:user:a") {
+		t.Fatalf("expected legacy node key, got %v", mr.Keys())
+	}
+
+	// 健康检查失败时移除，恢复后重新注册
+	healthy.Store(false)
+	waitEvent(EventUnhealthy)
+	if addrs := resolve(); len(addrs) != 0 {
+		t.Fatalf("expected unhealthy node removed, got %v", addrs)
+	}
+	healthy.Store(true)
+	waitEvent(EventRegister)
+
+	// draining 的节点仍然发布
+	if err := reg.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(EventDraining)
+	if addrs := resolve(); len(addrs) != 1 || addrs[0].Attributes[AttrState] != compile.NodeStateDraining {
+		t.Fatalf("expected draining node, got %v", addrs)
+	}
+	if mr.Exists("services:user:a") {
+		t.Fatal("legacy node key should be deleted while draining")
+	}
+
+	// Close 返回时节点已经注销
+	reg.Close()
+	if addrs := resolve(); len(addrs) != 0 {
+		t.Fatalf("expected node deregistered, got %v", addrs)
+	}
+	waitEvent(EventDeregister)
+}
+
+// TestTransport 验证 http 请求通过服务发现路由，连接失败时换一个节点重试
+func TestTransport(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	mr.SetTime(time.Now())
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte(r.Method + " " + r.URL.RequestURI() + " " + string(body)))
+	}))
+	defer srv.Close()
+
+	// 已关闭的端口，连接会失败
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := ln.Addr().String()
+	_ = ln.Close()
+
+	httpNode := func(id, host string) *compile.NodeInfo {
+		node := compile.NewNodeInfo().AddName("api").AddId(id)
+		node.Endpoints = append(node.Endpoints, compile.URL(url.URL{Scheme: "http", Host: host}))
+		return node
+	}
+	heartbeatNode(t, rdb, httpNode("live", srv.Listener.Addr().String()), 10*time.Second)
+	heartbeatNode(t, rdb, httpNode("dead", deadAddr), 10*time.Second)
+
+	client := NewHTTPClient(rdb)
+	for i := range 4 {
+		resp, err := client.Post("redislb://api/echo?i=1", "text/plain", strings.NewReader("hello"))
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "POST /echo?i=1 hello" {
+			t.Fatalf("unexpected response %q", body)
+		}
+	}
+
+	// 不重试时部分请求会失败
+	client = NewHTTPClient(rdb, WithRetries(0))
+	failed := 0
+	for range 4 {
+		resp, err := client.Get("redislb://api/echo")
+		if err != nil {
+			failed++
+			continue
+		}
+		resp.Body.Close()
+	}
+	if failed != 2 {
+		t.Fatalf("expected 2 failed requests without retry, got %d", failed)
+	}
+
+	// 没有可用节点
+	if _, err := client.Get("redislb://unknown/"); !errors.Is(err, ErrNoEndpoints) {
+		t.Fatalf("expected ErrNoEndpoints, got %v", err)
+	}
+
+	// 地址列表过期或连接失败后在后台重新解析，Redis 不可用时继续使用上次的地址列表
+	client = NewHTTPClient(rdb, WithCacheTTL(time.Millisecond))
+	get := func() error {
+		resp, err := client.Get("redislb://api/echo")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+	mr.Close()
+	time.Sleep(5 * time.Millisecond)
+	for i := range 4 {
+		if err := get(); err != nil {
+			t.Fatalf("request %d after redis down: %v", i, err)
+		}
+	}
+}
+
+// TestAdmin 验证列出服务和节点、订阅事件和强制移除节点
+func TestAdmin(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	mr.SetTime(now)
+
+	heartbeatNode(t, rdb, newTestNode("user", "b", "10.0.0.2:9000").AddVersion("v1"), 10*time.Second)
+	heartbeatNode(t, rdb, newTestNode("user", "a", "10.0.0.1:9000"), 2*time.Second)
+	heartbeatNode(t, rdb, newTestNode("order", "c", "10.0.0.3:9000"), 10*time.Second)
+
+	admin := NewAdmin(rdb)
+	services, err := admin.Services(ctx)
+	if err != nil || !slices.Equal(services, []string{"order", "user"}) {
+		t.Fatalf("unexpected services %v %v", services, err)
+	}
+
+	// 节点 a 的心跳过期后仍在索引中，直到被清理
+	mr.SetTime(now.Add(5 * time.Second))
+	mr.FastForward(5 * time.Second)
+	nodes, err := admin.Nodes(ctx, "user")
+	if err != nil || len(nodes) != 2 {
+		t.Fatalf("unexpected nodes %v %v", nodes, err)
+	}
+	if nodes[0].Id != "a" || !nodes[0].Expired || nodes[0].Node != nil {
+		t.Fatalf("expected expired node a without info, got %+v", nodes[0])
+	}
+	if nodes[1].Id != "b" || nodes[1].Expired || nodes[1].TTL <= 4*time.Second || nodes[1].TTL > 5*time.Second || nodes[1].Node.Version != "v1" {
+		t.Fatalf("unexpected node b %+v", nodes[1])
+	}
+
+	events, err := admin.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.Evict(ctx, "user", "b"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		if event != (Event{Type: EventEvicted, Service: "user", Id: "b"}) {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for evicted event")
+	}
+	if err := admin.Evict(ctx, "user", "b"); !errors.Is(err, ErrNodeNotFound) {
+		t.Fatalf("expected ErrNodeNotFound, got %v", err)
+	}
+}
+
+// TestResolverAddressPolicy 验证 IPv6 和域名端点、IPv6 白名单以及多个端点的选择策略
+func TestResolverAddressPolicy(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	ctx := context.Background()
+	mr.SetTime(time.Now())
+	node := compile.NewNodeInfo().AddName("user").AddId("a").
+		AddEndpoint("grpc", "api-a.internal:9000").
+		AddEndpoint("grpc", "[fd00::1]:9000").
+		AddEndpoint("grpc", "10.0.0.1:9000").
+		AddEndpoint("grpc", "10.0.0.2:9000")
+	heartbeatNode(t, rdb, node, 10*time.Second)
+
+	resolve := func(nets []string, opts ...ResolverOptApplyFn) []string {
+		t.Helper()
+		addrs, err := NewResolver(rdb, "user", parseSubnets(nets), "grpc", opts...).Resolve(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			hosts = append(hosts, addr.Addr)
+		}
+		return hosts
+	}
+
+	tests := []struct {
+		name      string
+		nets      []string
+		policy    AddressPolicy
+		hostnames []string
+		expected  []string
+	}{
+		{"default", nil, "", nil, []string{"10.0.0.1:9000"}},
+		{"ipv6", nil, PreferIPv6, nil, []string{"[fd00::1]:9000"}},
+		{"hostname", nil, PreferHostname, nil, []string{"api-a.internal:9000"}},
+		{"all", nil, AllAddresses, nil, []string{"api-a.internal:9000", "[fd00::1]:9000", "10.0.0.1:9000", "10.0.0.2:9000"}},
+		{"ipv6 whitelist", []string{"fd00::/8"}, PreferIPv4, nil, []string{"[fd00::1]:9000"}},
+		{"hostname restricted", []string{"192.168.0.0/16"}, PreferIPv4, nil, []string{}},
+		{"hostname allowed", []string{"192.168.0.0/16"}, PreferIPv4, []string{".internal"}, []string{"api-a.internal:9000"}},
+		{"hostname not matched", []string{"192.168.0.0/16"}, PreferIPv4, []string{"internal", ".b.internal"}, []string{}},
+		{"ipv4 whitelist", []string{"10.0.0.2/32"}, AllAddresses, nil, []string{"10.0.0.2:9000"}},
+		{"ipv4 whitelist and hostname", []string{"10.0.0.2/32"}, AllAddresses, []string{"API-A.internal"}, []string{"api-a.internal:9000", "10.0.0.2:9000"}},
+	}
+	for _, tt := range tests {
+		var opts []ResolverOptApplyFn
+		if tt.policy != "" {
+			opts = append(opts, WithAddressPolicy(tt.policy))
+		}
+		if len(tt.hostnames) > 0 {
+			opts = append(opts, WithAllowedHostnames(tt.hostnames...))
+		}
+		if hosts := resolve(tt.nets, opts...); !slices.Equal(hosts, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, hosts)
+		}
+	}
+
+	// 使用所有端点时节点的权重平均分配到各个端点
+	addrs, err := NewResolver(rdb, "user", nil, "grpc", WithAddressPolicy(AllAddresses)).Resolve(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs {
+		if weight := addr.Attributes[AttrWeight]; weight != defaultWeight/4 {
+			t.Fatalf("expected split weight, got %v", weight)
+		}
+	}
+}
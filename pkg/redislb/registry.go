@@ -3,19 +3,81 @@ package redislb
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/goccy/go-json"
 	"github.com/play/play/pkg/compile"
 	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
 )
 
+// heartbeatScript 原子性地写入节点信息并更新索引中的过期时间，同时清理已过期的成员
+// 新加入索引的节点发布 register 事件，被清理的节点发布 lost 事件
+// 时间以 Redis 服务端 TIME 为准，避免各节点时钟不一致
+// KEYS[1]: 节点键
+// KEYS[2]: 服务索引 ZSET
+// ARGV[1]: 节点信息
+// ARGV[2]: 节点ID
+// ARGV[3]: TTL（毫秒）
+// ARGV[4]: 服务名称
+// ARGV[5]: 事件 channel
+// ARGV[6]: 节点已在索引中时发布的事件类型，为空表示不发布，用于通知节点状态变更
+var heartbeatScript = redis.NewScript(`
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local ttl = tonumber(ARGV[3])
+
+redis.call("SET", KEYS[1], ARGV[1], "PX", ttl)
+local added = redis.call("ZADD", KEYS[2], now + ttl, ARGV[2])
+
+local expired = redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", now)
+if #expired > 0 then
+    redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", now)
+    for _, id in ipairs(expired) do
+        redis.call("PUBLISH", ARGV[5], cjson.encode({type = "lost", service = ARGV[4], id = id}))
+    end
+end
+-- 索引在最晚过期的节点过期时过期
+local last = redis.call("ZRANGE", KEYS[2], -1, -1, "WITHSCORES")
+redis.call("PEXPIREAT", KEYS[2], last[2])
+
+if added == 1 then
+    redis.call("PUBLISH", ARGV[5], cjson.encode({type = "register", service = ARGV[4], id = ARGV[2]}))
+elseif ARGV[6] ~= "" then
+    redis.call("PUBLISH", ARGV[5], cjson.encode({type = ARGV[6], service = ARGV[4], id = ARGV[2]}))
+end
+return added
+`)
+
+// HealthCheckFunc 检查节点是否健康，返回 error 时节点从服务发现中移除，直到检查恢复
+type HealthCheckFunc func(ctx context.Context) error
+
+// Registry 将节点注册到服务索引 "services:{<name>}"，并定时发送心跳
+//
+// 节点键迁移：节点键由 "services:<name>:<id>" 改为带 hash tag 的 "services:{<name>}:<id>"，解析器改为通过服务索引查找节点
+// 本版本的 Registry 同时写入旧的节点键（draining 和注销时删除），旧版本的解析器仍然可以发现新版本的节点；
+// 新版本的解析器只读取服务索引，看不到旧版本的节点，因此应先升级所有服务端，再升级客户端
+// 下一个版本将不再写入旧的节点键，升级前需确认已经没有旧版本的解析器
 type Registry struct {
 	rdb               redis.Cmdable
+	node              *compile.NodeInfo
 	ttl               time.Duration
 	KeepAliveDuration time.Duration
-	isClosed          atomic.Bool
-	closeChan         chan struct{}
+	drainTimeout      time.Duration
+	healthCheck       HealthCheckFunc
+
+	mu         sync.Mutex // 串行化心跳、健康检查和状态变更
+	state      string     // 节点状态，compile.NodeStateServing 或 compile.NodeStateDraining
+	drainAt    time.Time  // 进入 draining 状态的时间
+	registered bool       // 节点是否在服务索引中
+
+	isStarted atomic.Bool
+	isClosed  atomic.Bool
+	closeChan chan struct{}
+	doneChan  chan struct{}
 }
 
 type RegistryOptionApplyFn func(*Registry)
@@ -32,11 +94,35 @@ func WithKeepAliveDuration(d time.Duration) RegistryOptionApplyFn {
 	}
 }
 
+// WithNode 设置注册的节点，默认为 compile.Node
+func WithNode(node *compile.NodeInfo) RegistryOptionApplyFn {
+	return func(r *Registry) {
+		r.node = node
+	}
+}
+
+// WithDrainTimeout 设置 Close 时 draining 状态的持续时间，期间节点仍然发布但不再接收新的请求，默认为 0，即立即注销
+func WithDrainTimeout(d time.Duration) RegistryOptionApplyFn {
+	return func(r *Registry) {
+		r.drainTimeout = d
+	}
+}
+
+// WithHealthCheck 设置健康检查，每次心跳前调用，超时时间为 KeepAliveDuration
+func WithHealthCheck(fn HealthCheckFunc) RegistryOptionApplyFn {
+	return func(r *Registry) {
+		r.healthCheck = fn
+	}
+}
+
 func NewRegistry(rdb redis.Cmdable, opts ...RegistryOptionApplyFn) *Registry {
 	r := &Registry{
+		node:              compile.Node,
 		ttl:               10 * time.Second,
 		KeepAliveDuration: 3 * time.Second,
+		state:             compile.NodeStateServing,
 		closeChan:         make(chan struct{}),
+		doneChan:          make(chan struct{}),
 	}
 
 	for _, opt := range opts {
@@ -46,22 +132,39 @@ func NewRegistry(rdb redis.Cmdable, opts ...RegistryOptionApplyFn) *Registry {
 	return r
 }
 
+// Register 立即注册节点，之后定时发送心跳，注册失败时返回 error
+// 设置了健康检查且检查失败时不注册，直到检查恢复
 func (r *Registry) Register() error {
 	if r.ttl <= r.KeepAliveDuration {
 		return errors.New("registry TTL should be greater than registry keepalive duration")
 	}
+	if !r.isStarted.CompareAndSwap(false, true) {
+		return errors.New("registry already started")
+	}
+
+	ctx := context.Background()
+	if err := r.keepAlive(ctx); err != nil {
+		r.isStarted.Store(false)
+		return fmt.Errorf("failed to register: %w", err)
+	}
 
 	go func() {
+		defer close(r.doneChan)
 		ticker := time.NewTicker(r.KeepAliveDuration)
-		ctx := context.Background()
 
 		for {
 			select {
 			case <-ticker.C:
-				r.rdb.SetEx(ctx, compile.Node.Key(), compile.Node.Value(), r.ttl)
+				if err := r.keepAlive(ctx); err != nil {
+					log.Warn().Err(err).Str("service", r.node.Name).Str("id", r.node.Id).Msg("failed to keep alive")
+				}
 			case <-r.closeChan:
 				ticker.Stop()
-				r.rdb.Del(ctx, compile.Node.Key())
+				r.mu.Lock()
+				if err := r.deregister(ctx, EventDeregister); err != nil {
+					log.Warn().Err(err).Str("service", r.node.Name).Str("id", r.node.Id).Msg("failed to deregister")
+				}
+				r.mu.Unlock()
 				return
 			}
 		}
@@ -69,8 +172,107 @@ func (r *Registry) Register() error {
 	return nil
 }
 
+// keepAlive 执行健康检查并发送心跳，健康检查失败时从服务索引中移除节点
+func (r *Registry) keepAlive(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.healthCheck != nil {
+		hctx, cancel := context.WithTimeout(ctx, r.KeepAliveDuration)
+		err := r.healthCheck(hctx)
+		cancel()
+		if err != nil {
+			if !r.registered {
+				return nil
+			}
+			log.Warn().Err(err).Str("service", r.node.Name).Str("id", r.node.Id).Msg("health check failed, removing node from discovery")
+			return r.deregister(ctx, EventUnhealthy)
+		}
+	}
+	return r.heartbeat(ctx, "")
+}
+
+// Drain 将节点标记为 draining 状态，节点仍然发布，但负载均衡器不再为其分配新的请求
+func (r *Registry) Drain(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state == compile.NodeStateDraining {
+		return nil
+	}
+	r.state = compile.NodeStateDraining
+	r.drainAt = time.Now()
+	if !r.registered {
+		return nil
+	}
+	return r.heartbeat(ctx, EventDraining)
+}
+
+// heartbeat 写入节点信息并刷新索引，节点已在索引中时发布 event 事件，调用方需要持有 mu
+func (r *Registry) heartbeat(ctx context.Context, event string) error {
+	node := *r.node
+	node.State = r.state
+	keys := []string{node.Key(), node.IndexKey()}
+	err := heartbeatScript.Run(ctx, r.rdb, keys, node.Value(), node.Id, r.ttl.Milliseconds(), node.Name, eventsChannel(node.Name), event).Err()
+	if err != nil {
+		return err
+	}
+	r.registered = true
+
+	// 旧版本的解析器不识别 draining 状态，draining 时删除旧的节点键，不再为其分配新的请求
+	// 旧的节点键与服务索引不在同一个槽中，不能在脚本中写入
+	if node.State == compile.NodeStateDraining {
+		err = r.rdb.Del(ctx, node.LegacyKey()).Err()
+	} else {
+		err = r.rdb.Set(ctx, node.LegacyKey(), node.Value(), r.ttl).Err()
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("service", node.Name).Str("id", node.Id).Msg("failed to write legacy node key")
+	}
+	return nil
+}
+
+// deregister 删除节点信息、从索引中移除并发布事件，调用方需要持有 mu
+func (r *Registry) deregister(ctx context.Context, eventType string) error {
+	event, _ := json.Marshal(&Event{Type: eventType, Service: r.node.Name, Id: r.node.Id})
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, r.node.IndexKey(), r.node.Id)
+		pipe.Del(ctx, r.node.Key())
+		pipe.Publish(ctx, eventsChannel(r.node.Name), event)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.registered = false
+
+	if err := r.rdb.Del(ctx, r.node.LegacyKey()).Err(); err != nil {
+		log.Warn().Err(err).Str("service", r.node.Name).Str("id", r.node.Id).Msg("failed to delete legacy node key")
+	}
+	return nil
+}
+
+// Close 注销节点，设置了 WithDrainTimeout 时先进入 draining 状态并等待 drainTimeout
+// 返回时节点已经注销
 func (r *Registry) Close() {
-	if r.isClosed.CompareAndSwap(false, true) {
-		close(r.closeChan)
+	if !r.isClosed.CompareAndSwap(false, true) {
+		return
+	}
+
+	if r.isStarted.Load() && r.drainTimeout > 0 {
+		if err := r.Drain(context.Background()); err != nil {
+			log.Warn().Err(err).Str("service", r.node.Name).Str("id", r.node.Id).Msg("failed to drain")
+		}
+		r.mu.Lock()
+		wait := r.drainTimeout - time.Since(r.drainAt)
+		r.mu.Unlock()
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+
+	close(r.closeChan)
+	if r.isStarted.Load() {
+		<-r.doneChan
 	}
 }
@@ -4,6 +4,10 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,7 +15,6 @@ import (
 	"github.com/goccy/go-json"
 	"github.com/play/play/pkg/compile"
 	"github.com/redis/go-redis/v9"
-	"google.golang.org/grpc/attributes"
 	"google.golang.org/grpc/grpclog"
 	"google.golang.org/grpc/resolver"
 )
@@ -23,6 +26,94 @@ type Address struct {
 	ServerName string         // 服务名称
 }
 
+// liveNodesScript 返回索引中未过期的节点ID
+// 时间以 Redis 服务端 TIME 为准，与 heartbeatScript 一致
+// KEYS[1]: 服务索引 ZSET
+var liveNodesScript = redis.NewScript(`
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+return redis.call("ZRANGEBYSCORE", KEYS[1], "(" .. now, "+inf")
+`)
+
+// 地址属性的 key
+const (
+	AttrId      = "id"      // 节点ID，string
+	AttrWeight  = "weight"  // 权重，int，来自 Metadata["weight"]，默认为 defaultWeight
+	AttrZone    = "zone"    // 可用区，string，来自 Metadata["zone"]
+	AttrVersion = "version" // 版本，string，来自 NodeInfo.Version
+	AttrState   = "state"   // 节点状态，string，来自 NodeInfo.State，为空时等同于 compile.NodeStateServing
+)
+
+// 节点元数据中用于负载均衡的 key
+const (
+	MetadataWeight = "weight"
+	MetadataZone   = "zone"
+)
+
+const defaultWeight = 100 // 未设置或设置无效时的默认权重
+
+// nodeAttributes 返回节点的地址属性
+func nodeAttributes(node *compile.NodeInfo) map[string]any {
+	weight, err := strconv.Atoi(node.Metadata[MetadataWeight])
+	if err != nil || weight <= 0 {
+		weight = defaultWeight
+	}
+	return map[string]any{
+		AttrId:      node.Id,
+		AttrWeight:  weight,
+		AttrZone:    node.Metadata[MetadataZone],
+		AttrVersion: node.Version,
+		AttrState:   node.State,
+	}
+}
+
+// AddressPolicy 是节点发布了多个同协议端点时的选择策略
+// 节点默认只发布内网 IPv4 端点，通过 compile.NodeInfo.AddEndpoints 发布 IPv6、公网地址或主机名时生效
+type AddressPolicy string
+
+const (
+	PreferIPv4     AddressPolicy = "prefer-ipv4"     // 优先 IPv4，其次 IPv6，最后域名（默认）
+	PreferIPv6     AddressPolicy = "prefer-ipv6"     // 优先 IPv6，其次 IPv4，最后域名
+	PreferHostname AddressPolicy = "prefer-hostname" // 优先域名，其次 IPv4，最后 IPv6
+	AllAddresses   AddressPolicy = "all"             // 使用所有端点，每个端点作为一个地址，节点的权重平均分配到各个端点
+)
+
+// 端点地址的类型
+const (
+	hostIPv4 = iota
+	hostIPv6
+	hostName
+)
+
+// preference 返回策略中各类型端点的优先级，值越小越优先
+func (p AddressPolicy) preference(kind int) int {
+	switch p {
+	case PreferIPv6:
+		return [...]int{hostIPv4: 1, hostIPv6: 0, hostName: 2}[kind]
+	case PreferHostname:
+		return [...]int{hostIPv4: 1, hostIPv6: 2, hostName: 0}[kind]
+	default:
+		return kind
+	}
+}
+
+type ResolverOptApplyFn func(*Resolver)
+
+// WithAddressPolicy 设置节点发布了多个同协议端点时的选择策略
+func WithAddressPolicy(policy AddressPolicy) ResolverOptApplyFn {
+	return func(r *Resolver) {
+		r.policy = policy
+	}
+}
+
+// WithAllowedHostnames 设置了白名单网段时，允许连接的域名端点，以 "." 开头时匹配该域名的所有子域名
+// 没有设置白名单网段时所有域名端点都允许连接
+func WithAllowedHostnames(hostnames ...string) ResolverOptApplyFn {
+	return func(r *Resolver) {
+		r.allowedHostnames = append(r.allowedHostnames, hostnames...)
+	}
+}
+
 // Resolver 是一个不依赖 gRPC 的公共解析器结构体
 type Resolver struct {
 	mu            sync.RWMutex
@@ -30,19 +121,28 @@ type Resolver struct {
 	serviceName   string
 	whitelistNets []*net.IPNet
 	scheme        string // 协议类型，如 "grpc", "http" 等
+	policy        AddressPolicy
+
+	allowedHostnames []string // 设置了 whitelistNets 时允许的域名端点
 }
 
 // NewResolver 创建一个新的 Resolver
-func NewResolver(rdb redis.Cmdable, serviceName string, whitelistNets []*net.IPNet, scheme string) *Resolver {
+// whitelistNets 支持 IPv4 和 IPv6 网段，设置后域名端点不做解析，只允许 WithAllowedHostnames 中的域名
+func NewResolver(rdb redis.Cmdable, serviceName string, whitelistNets []*net.IPNet, scheme string, opts ...ResolverOptApplyFn) *Resolver {
 	if scheme == "" {
 		scheme = "grpc" // 默认为 grpc
 	}
-	return &Resolver{
+	r := &Resolver{
 		rdb:           rdb,
 		serviceName:   serviceName,
 		whitelistNets: whitelistNets,
 		scheme:        scheme,
+		policy:        PreferIPv4,
+	}
+	for _, opt := range opts {
+		opt(r)
 	}
+	return r
 }
 
 // isWhitelist returns true if the given IP is in the whitelist.
@@ -59,21 +159,82 @@ func (r *Resolver) isWhitelist(ip net.IP) bool {
 	return false
 }
 
-// Resolve 从 Redis 解析服务地址列表
+// isAllowedHostname 判断域名端点是否允许连接
+func (r *Resolver) isAllowedHostname(host string) bool {
+	if len(r.whitelistNets) == 0 {
+		return true
+	}
+
+	for _, allowed := range r.allowedHostnames {
+		if strings.EqualFold(host, allowed) ||
+			strings.HasPrefix(allowed, ".") && len(host) > len(allowed) && strings.EqualFold(host[len(host)-len(allowed):], allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeEndpoints 按策略返回节点中协议匹配且在白名单中的端点
+func (r *Resolver) nodeEndpoints(node *compile.NodeInfo) []string {
+	var hosts []string
+	best := -1
+	for _, endpoint := range node.Endpoints {
+		if endpoint.Scheme != r.scheme {
+			continue
+		}
+		host, _, err := net.SplitHostPort(endpoint.Host)
+		if err != nil || host == "" {
+			continue
+		}
+
+		kind := hostName
+		if addr, err := netip.ParseAddr(host); err == nil {
+			// 检查IP是否在白名单中，IPv6 地址忽略 zone
+			if !r.isWhitelist(net.IP(addr.WithZone("").AsSlice())) {
+				continue
+			}
+			kind = hostIPv6
+			if addr.Unmap().Is4() {
+				kind = hostIPv4
+			}
+		} else if !r.isAllowedHostname(host) {
+			continue
+		}
+
+		if r.policy == AllAddresses {
+			hosts = append(hosts, endpoint.Host)
+			continue
+		}
+		// 同一优先级的端点按节点发布的顺序选择第一个
+		if pref := r.policy.preference(kind); best < 0 || pref < best {
+			best = pref
+			hosts = []string{endpoint.Host}
+		}
+	}
+	return hosts
+}
+
+// Resolve 从 Redis 解析服务地址列表，通过服务索引获取未过期的节点，不使用 KEYS
 func (r *Resolver) Resolve(ctx context.Context) ([]Address, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	key := "services:" + r.serviceName + ":*"
-	keys, err := r.rdb.Keys(ctx, key).Result()
+	service := &compile.NodeInfo{Name: r.serviceName}
+	ids, err := liveNodesScript.Run(ctx, r.rdb, []string{service.IndexKey()}).StringSlice()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get keys: %w", err)
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
 	}
 
-	if len(keys) == 0 {
+	if len(ids) == 0 {
 		return []Address{}, nil
 	}
 
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		service.Id = id
+		keys = append(keys, service.Key())
+	}
+
 	values, err := r.rdb.MGet(ctx, keys...).Result()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get values: %w", err)
@@ -91,25 +252,14 @@ func (r *Resolver) Resolve(ctx context.Context) ([]Address, error) {
 			continue
 		}
 
-		for _, endpoint := range nodeInfo.Endpoints {
-			if endpoint.Scheme != r.scheme {
-				continue
-			}
-			ipAddr, _, _ := net.SplitHostPort(endpoint.Host)
-			ip := net.ParseIP(ipAddr)
-			if ip == nil {
-				continue
-			}
-			// 检查IP是否在白名单中
-			if !r.isWhitelist(ip) {
-				continue
-			}
-
+		// 节点有多个地址时平均分配节点的权重，使节点整体承担的请求与权重一致
+		hosts := r.nodeEndpoints(&nodeInfo)
+		for _, host := range hosts {
+			attrs := nodeAttributes(&nodeInfo)
+			attrs[AttrWeight] = max(attrs[AttrWeight].(int)/len(hosts), 1)
 			addrs = append(addrs, Address{
-				Addr: endpoint.Host,
-				Attributes: map[string]any{
-					"id": nodeInfo.Id,
-				},
+				Addr:       host,
+				Attributes: attrs,
 				ServerName: r.serviceName,
 			})
 		}
@@ -121,15 +271,25 @@ func (r *Resolver) Resolve(ctx context.Context) ([]Address, error) {
 var _ resolver.Resolver = (*schemaResolver)(nil)
 
 // schemaResolver 是基于 gRPC 的解析器，内嵌 Resolver
+// 订阅节点变更事件后立即更新，定时解析仅用于对账，订阅不可用或断开时退化为轮询
+// 服务只有一个节点时事件丢失会导致服务不可用直到下一次对账，因此仍然使用轮询间隔
 type schemaResolver struct {
 	*Resolver
-	mu          sync.RWMutex
-	watchTicker *time.Ticker
-	logger      grpclog.LoggerV2
-	client      resolver.ClientConn
-	isClosed    atomic.Bool
-	rnChan      chan struct{}
-	closeChan   chan struct{}
+	mu                sync.RWMutex
+	watchTicker       *time.Ticker
+	pollInterval      time.Duration
+	reconcileInterval time.Duration
+	interval          atomic.Int64 // watchTicker 当前的间隔
+	watching          atomic.Bool  // 是否已订阅节点变更事件
+	nodes             atomic.Int64 // 最近一次解析到的节点数量
+	logger            grpclog.LoggerV2
+	client            resolver.ClientConn
+	isClosed          atomic.Bool
+	rnChan            chan struct{}
+	closeChan         chan struct{}
+	ctx               context.Context
+	cancel            context.CancelFunc
+	lastState         *string // 上一次更新的地址集合，用于跳过没有变化的更新
 }
 
 func (r *schemaResolver) watcher() {
@@ -145,8 +305,49 @@ func (r *schemaResolver) watcher() {
 	}
 }
 
+// watchEvents 订阅节点变更事件，收到事件后立即解析
+func (r *schemaResolver) watchEvents() {
+	events, err := r.Resolver.Watch(r.ctx)
+	if err != nil {
+		r.logger.Warningf("failed to watch %s://%s, falling back to polling: %v", schema, r.serviceName, err)
+		return
+	}
+	r.watching.Store(true)
+	r.resetTicker()
+	r.consumeEvents(events)
+}
+
+// consumeEvents 收到事件后立即解析，订阅断开后恢复轮询
+func (r *schemaResolver) consumeEvents(events <-chan Event) {
+	for event := range events {
+		r.logger.Infof("service %s node %s: %s", event.Service, event.Id, event.Type)
+		r.ResolveNow(resolver.ResolveNowOptions{})
+	}
+
+	r.watching.Store(false)
+	if !r.isClosed.Load() {
+		r.logger.Warningf("stopped watching %s://%s, falling back to polling", schema, r.serviceName)
+		r.resetTicker()
+	}
+}
+
+// resetTicker 按订阅状态和节点数量调整解析间隔：已订阅且有多个节点时使用对账间隔，否则使用轮询间隔
+func (r *schemaResolver) resetTicker() {
+	d := r.pollInterval
+	if r.watching.Load() && r.nodes.Load() > 1 {
+		d = r.reconcileInterval
+	}
+	if time.Duration(r.interval.Swap(int64(d))) != d {
+		r.watchTicker.Reset(d)
+	}
+}
+
+// ResolveNow 触发一次解析，已有待处理的解析请求时直接返回
 func (r *schemaResolver) ResolveNow(opts resolver.ResolveNowOptions) {
-	r.rnChan <- struct{}{}
+	select {
+	case r.rnChan <- struct{}{}:
+	default:
+	}
 }
 
 func (r *schemaResolver) resolveNow(force bool) {
@@ -154,16 +355,27 @@ func (r *schemaResolver) resolveNow(force bool) {
 		return
 	}
 
-	ctx := context.Background()
 	// 使用公共 Resolver 的 Resolve 方法
-	addrs, err := r.Resolver.Resolve(ctx)
+	addrs, err := r.Resolver.Resolve(r.ctx)
 	if err != nil {
 		r.logger.Warningf("failed to resolve: %v", err)
 		r.client.ReportError(fmt.Errorf("failed to resolve: %v", err))
 		return
 	}
 
-	r.updateState(addrs, force)
+	r.nodes.Store(int64(countNodes(addrs)))
+	r.resetTicker()
+	// 排除 draining 的节点，使用任意负载均衡器时都不再为其分配新的请求，已有的请求在子连接关闭前完成
+	r.updateState(filterAddrs(addrs), force)
+}
+
+// countNodes 返回地址所属的节点数量，一个节点可能有多个地址
+func countNodes(addrs []Address) int {
+	ids := make(map[any]struct{}, len(addrs))
+	for _, addr := range addrs {
+		ids[addr.Attributes[AttrId]] = struct{}{}
+	}
+	return len(ids)
 }
 
 func (r *schemaResolver) updateState(addrs []Address, force bool) {
@@ -174,11 +386,15 @@ func (r *schemaResolver) updateState(addrs []Address, force bool) {
 			Addr:       addr.Addr,
 			ServerName: addr.ServerName,
 		}
-		// 转换属性
-		if len(addr.Attributes) > 0 {
-			for k, v := range addr.Attributes {
-				grpcAddr.Attributes = attributes.New(k, v)
-			}
+		// 转换为负载均衡属性，不影响子连接的标识，节点的权重、状态等变化时不会重建子连接
+		// 按 key 排序保证相同的属性得到相同的结果
+		keys := make([]string, 0, len(addr.Attributes))
+		for k := range addr.Attributes {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			grpcAddr.BalancerAttributes = grpcAddr.BalancerAttributes.WithValue(k, addr.Attributes[k])
 		}
 		grpcAddrs = append(grpcAddrs, grpcAddr)
 	}
@@ -188,12 +404,32 @@ func (r *schemaResolver) updateState(addrs []Address, force bool) {
 		return
 	}
 
+	// 地址集合没有变化时不更新，避免 gRPC 重建子连接
+	state := stateKey(addrs)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lastState != nil && state == *r.lastState {
+		return
+	}
+
 	err := r.client.UpdateState(resolver.State{
 		Addresses: grpcAddrs,
 	})
 	if err != nil {
 		r.client.ReportError(fmt.Errorf("failed to update state: %v", err))
+		return
+	}
+	r.lastState = &state
+}
+
+// stateKey 返回与顺序无关的地址集合标识，fmt 输出 map 时按 key 排序
+func stateKey(addrs []Address) string {
+	keys := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		keys = append(keys, fmt.Sprintf("%s|%s|%v", addr.Addr, addr.ServerName, addr.Attributes))
 	}
+	slices.Sort(keys)
+	return strings.Join(keys, "\n")
 }
 
 func (r *schemaResolver) Close() {
@@ -202,6 +438,7 @@ func (r *schemaResolver) Close() {
 
 	if r.isClosed.CompareAndSwap(false, true) {
 		r.watchTicker.Stop()
+		r.cancel()
 		close(r.closeChan)
 	}
 }
@@ -0,0 +1,123 @@
+package token
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// 安全事件类型
+const (
+	SecurityEventRefreshTokenReuse = "refresh_token_reuse" // 已经轮换过的 refresh token 被再次使用
+)
+
+// SecurityEvent 是安全事件，不包含 token 本身
+type SecurityEvent struct {
+	Type       string    `json:"type"`
+	UserId     int64     `json:"user_id"`
+	FamilyId   string    `json:"family_id"`
+	Sessions   []string  `json:"sessions"`    // 被撤销的会话
+	RotatedAt  time.Time `json:"rotated_at"`  // 被重复使用的 refresh token 轮换的时间
+	DetectedAt time.Time `json:"detected_at"` // 发现的时间
+}
+
+// SecurityEventHandler 处理安全事件，在 Token 的调用方 goroutine 中同步调用
+type SecurityEventHandler func(ctx context.Context, event SecurityEvent)
+
+// rotation 是已轮换的 refresh token 的记录，保存到该 refresh token 原本的过期时间
+type rotation struct {
+	UserId    int64     `json:"user_id"`
+	FamilyId  string    `json:"family_id"`
+	RotatedAt time.Time `json:"rotated_at"`
+}
+
+// rotatedKey 返回已轮换的 refresh token 的记录键
+func (tk *Token) rotatedKey(refreshToken string) string {
+	return tk.rotatedKeyPrefix + refreshToken
+}
+
+// claimRefreshTokenScript 原子性地删除 refresh token、记录其已经轮换并写入新的 refresh token
+// 避免删除后记录前失败导致无法发现重复使用，或者旧 refresh token 已被删除而新 refresh token 没有写入
+// 轮换记录的键以 refresh token hash 的键作为 hash tag，在 Redis Cluster 中与其位于同一个 slot
+// KEYS[1]: refresh token hash，KEYS[2]: 轮换记录
+// ARGV[1]: refresh token，ARGV[2]: 轮换记录的数据，ARGV[3]: 轮换记录的有效期（毫秒），不大于 0 时不记录
+// ARGV[4]: 新的 refresh token，ARGV[5]: 新的 access token
+// 返回 1 表示删除成功，0 表示 refresh token 已经被删除
+var claimRefreshTokenScript = redis.NewScript(`
+if redis.call("HDEL", KEYS[1], ARGV[1]) == 0 then
+    return 0
+end
+local ttl = tonumber(ARGV[3])
+if ttl > 0 then
+    redis.call("SET", KEYS[2], ARGV[2], "PX", ttl)
+end
+redis.call("HSET", KEYS[1], ARGV[4], ARGV[5])
+return 1
+`)
+
+// claimRefreshToken 删除 refreshToken 并记录其已经轮换为 newVal，记录保存到 refreshExpiredAt，同时写入 newVal 的 refresh token
+// 返回 false 表示 refreshToken 已经被其他请求删除
+func (tk *Token) claimRefreshToken(ctx context.Context, refreshToken string, newVal *Value, refreshExpiredAt time.Time) (bool, error) {
+	data, err := json.Marshal(&rotation{UserId: newVal.UserId, FamilyId: newVal.FamilyId, RotatedAt: time.Now()})
+	if err != nil {
+		return false, err
+	}
+	keys := []string{tk.refreshTokenKey, tk.rotatedKey(refreshToken)}
+	claimed, err := claimRefreshTokenScript.Run(ctx, tk.rdb, keys, refreshToken, data, time.Until(refreshExpiredAt).Milliseconds(),
+		newVal.RefreshToken, newVal.AccessToken).Int()
+	return claimed == 1, err
+}
+
+// detectReuse 检查不存在的 refresh token 是否已经轮换过，是则撤销整个 token 家族并发出安全事件
+func (tk *Token) detectReuse(ctx context.Context, refreshToken string) error {
+	data, err := tk.rdb.Get(ctx, tk.rotatedKey(refreshToken)).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return ErrRefreshTokenNotFound
+		}
+		return err
+	}
+	var r rotation
+	if err := json.Unmarshal(data, &r); err != nil || r.FamilyId == "" {
+		return ErrRefreshTokenNotFound
+	}
+
+	sessions, err := tk.RevokeFamily(ctx, r.UserId, r.FamilyId)
+	if err != nil {
+		return err
+	}
+
+	event := SecurityEvent{
+		Type:       SecurityEventRefreshTokenReuse,
+		UserId:     r.UserId,
+		FamilyId:   r.FamilyId,
+		Sessions:   sessions,
+		RotatedAt:  r.RotatedAt,
+		DetectedAt: time.Now(),
+	}
+	if tk.opts.securityEvent != nil {
+		tk.opts.securityEvent(ctx, event)
+	} else {
+		log.Warn().Str("type", event.Type).Int64("user_id", event.UserId).Str("family_id", event.FamilyId).
+			Strs("sessions", event.Sessions).Time("rotated_at", event.RotatedAt).Msg("token security event")
+	}
+	return ErrRefreshTokenReused
+}
+
+// RevokeFamily revokes all sessions of the token family, returns the revoked sessions
+func (tk *Token) RevokeFamily(ctx context.Context, userId int64, familyId string) (revoked []string, err error) {
+	err = tk.updateSessions(ctx, userId, func(set *sessionSet) (family []*Value, _ *Value) {
+		revoked = nil
+		for _, val := range set.sessions {
+			if val.FamilyId == familyId {
+				family = append(family, val)
+				revoked = append(revoked, val.Session)
+			}
+		}
+		return
+	})
+	return
+}
@@ -6,6 +6,11 @@ type options struct {
 	prefix         string
 	tokenExpires   time.Duration
 	refreshExpires time.Duration
+	sessionScope   string
+	maxSessions    int
+	signingKeys    []*SigningKey
+	revocationSync time.Duration
+	securityEvent  SecurityEventHandler
 }
 
 // apply apply options
@@ -27,6 +32,12 @@ func (o *options) setDefault() {
 	if o.refreshExpires <= 0 {
 		o.refreshExpires = time.Hour * 24 * 7 // 默认7天
 	}
+	if o.revocationSync <= 0 {
+		o.revocationSync = defaultRevocationSync
+	}
+	if o.sessionScope == "" {
+		o.sessionScope = SessionScopeUser
+	}
 }
 
 type Option func(*options)
@@ -51,3 +62,43 @@ func WithRefreshExpires(d time.Duration) Option {
 		o.refreshExpires = d
 	}
 }
+
+// WithSessionScope sets the session scope, see SessionScopeUser, SessionScopePlatform and SessionScopeDevice
+func WithSessionScope(scope string) Option {
+	return func(o *options) {
+		o.sessionScope = scope
+	}
+}
+
+// WithMaxSessions sets the maximum number of concurrent sessions per user, 0 means unlimited
+// 超过时使最早创建的会话失效
+func WithMaxSessions(n int) Option {
+	return func(o *options) {
+		o.maxSessions = n
+	}
+}
+
+// WithSigningKeys enables stateless access tokens signed by keys[0]
+// access token 为自包含的 JWT，Get 在本地校验签名，不再读取 Redis；refresh token 仍然保存在 Redis
+// keys 中的其他密钥只用于校验，轮换密钥时先将新密钥放在最前面，旧 token 过期后再移除旧密钥
+func WithSigningKeys(keys ...*SigningKey) Option {
+	return func(o *options) {
+		o.signingKeys = keys
+	}
+}
+
+// WithRevocationSync sets the interval for syncing the revocation list of stateless access tokens
+// 同步在后台进行，失败时继续使用上次同步的结果并按指数退避重试
+func WithRevocationSync(d time.Duration) Option {
+	return func(o *options) {
+		o.revocationSync = d
+	}
+}
+
+// WithSecurityEventHandler sets the handler for security events such as refresh token reuse
+// 默认记录警告日志
+func WithSecurityEventHandler(h SecurityEventHandler) Option {
+	return func(o *options) {
+		o.securityEvent = h
+	}
+}
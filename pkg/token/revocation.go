@@ -0,0 +1,213 @@
+package token
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultRevocationSync  = 5 * time.Second  // 默认撤销列表的同步间隔
+	revocationSyncTimeout  = 5 * time.Second  // 单次同步的超时时间
+	revocationMaxBackoff   = time.Minute      // 同步失败后重试的最大间隔
+	revocationLogRetention = 10 * time.Minute // 撤销日志的保留时间，超过该时间没有同步的实例全量加载
+	revocationLogOverlap   = 30 * time.Second // 增量加载时向前多读取的时间，容忍实例之间的时钟偏差
+)
+
+// revocationList 是无状态 access token 的撤销列表
+// Redis ZSET 的成员为 jti，分数为 token 过期时间（Unix 毫秒），token 过期后自动清理
+// 撤销日志 ZSET 的成员为 jti:过期时间，分数为撤销时间（Unix 毫秒），用于按撤销时间增量加载
+// 首次同步和超过撤销日志保留时间没有同步时全量加载撤销列表，其余时候只增量加载撤销日志
+// 本地缓存按间隔在后台同步，同步期间和同步失败时继续使用上次的结果，其他实例撤销的 token 最多在一个同步间隔后生效
+type revocationList struct {
+	rdb      redis.Cmdable
+	key      string
+	logKey   string
+	interval time.Duration
+
+	mu       sync.RWMutex
+	revoked  map[string]time.Time // key: jti, value: token 过期时间
+	ready    bool                 // 至少成功同步过一次
+	err      error                // 上次同步的错误
+	failures int                  // 连续同步失败的次数
+	nextSync time.Time            // 下次同步的时间
+	cursor   int64                // 已加载的撤销日志的最大分数
+	syncing  chan struct{}        // 正在进行的同步，完成后关闭
+}
+
+func newRevocationList(rdb redis.Cmdable, key string, interval time.Duration) *revocationList {
+	return &revocationList{rdb: rdb, key: key, logKey: key + ":log", interval: interval, revoked: make(map[string]time.Time)}
+}
+
+// revocable 判断 token 是否需要加入撤销列表，只有未过期的无状态 access token 需要撤销
+func (l *revocationList) revocable(val *Value) bool {
+	return val.TokenId != "" && val.TokenExpiredAt.After(time.Now())
+}
+
+// logMember 返回撤销日志的成员
+func logMember(jti string, expiredAt time.Time) string {
+	return jti + ":" + strconv.FormatInt(expiredAt.UnixMilli(), 10)
+}
+
+// add 在 pipe 中撤销 token，并立即更新本地缓存
+func (l *revocationList) add(ctx context.Context, pipe redis.Pipeliner, val *Value) {
+	if !l.revocable(val) {
+		return
+	}
+	pipe.ZAdd(ctx, l.key, redis.Z{Score: float64(val.TokenExpiredAt.UnixMilli()), Member: val.TokenId})
+	pipe.ZAdd(ctx, l.logKey, redis.Z{Score: float64(time.Now().UnixMilli()), Member: logMember(val.TokenId, val.TokenExpiredAt)})
+	l.remember(val)
+}
+
+// remember 把已经写入 Redis 的撤销记录加入本地缓存
+func (l *revocationList) remember(val *Value) {
+	l.mu.Lock()
+	l.revoked[val.TokenId] = val.TokenExpiredAt
+	l.mu.Unlock()
+}
+
+// isRevoked 判断 token 是否已被撤销
+// 缓存过期时在后台同步并继续使用当前的结果，只有从未同步成功时才等待同步完成
+func (l *revocationList) isRevoked(ctx context.Context, jti string) (bool, error) {
+	if done := l.refresh(); done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if !l.ready {
+		return false, l.err
+	}
+	_, ok := l.revoked[jti]
+	return ok, nil
+}
+
+// refresh 在缓存过期且没有正在进行的同步时启动后台同步，同一时刻只有一个同步
+// 从未同步成功时返回正在进行的同步，调用方需要等待其完成
+func (l *revocationList) refresh() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.syncing == nil && !time.Now().Before(l.nextSync) {
+		l.syncing = make(chan struct{})
+		go l.sync()
+	}
+	if l.ready {
+		return nil
+	}
+	return l.syncing
+}
+
+// sync 从 Redis 加载撤销记录并合并到本地缓存，失败时按指数退避推迟下次同步
+// 撤销记录只会在 token 过期后删除，因此增量和全量加载都只需要合并，本地只清理已过期的 jti
+func (l *revocationList) sync() {
+	ctx, cancel := context.WithTimeout(context.Background(), revocationSyncTimeout)
+	defer cancel()
+
+	l.mu.RLock()
+	now := time.Now()
+	full := !l.ready || l.cursor < now.Add(-revocationLogRetention).UnixMilli()
+	cursor := l.cursor
+	l.mu.RUnlock()
+
+	var loaded map[string]time.Time
+	var err error
+	if full {
+		loaded, cursor, err = l.loadAll(ctx, now)
+	} else {
+		loaded, cursor, err = l.loadLog(ctx, cursor, now)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer func() {
+		close(l.syncing)
+		l.syncing = nil
+	}()
+
+	if err != nil {
+		l.err = err
+		l.failures++
+		backoff := min(l.interval<<min(l.failures, 16), revocationMaxBackoff)
+		l.nextSync = time.Now().Add(backoff)
+		log.Warn().Err(err).Int("failures", l.failures).Dur("backoff", backoff).Msg("failed to sync token revocation list")
+		return
+	}
+
+	for jti, expiredAt := range loaded {
+		l.revoked[jti] = expiredAt
+	}
+	for jti, expiredAt := range l.revoked {
+		if !expiredAt.After(now) {
+			delete(l.revoked, jti)
+		}
+	}
+	l.cursor = max(l.cursor, cursor)
+	l.ready, l.err, l.failures = true, nil, 0
+	l.nextSync = time.Now().Add(l.interval)
+}
+
+// trim 在 pipe 中清理撤销列表中已过期的 jti 和超过保留时间的撤销日志
+func (l *revocationList) trim(ctx context.Context, pipe redis.Pipeliner, now time.Time) {
+	pipe.ZRemRangeByScore(ctx, l.key, "-inf", strconv.FormatInt(now.UnixMilli(), 10))
+	pipe.ZRemRangeByScore(ctx, l.logKey, "-inf", strconv.FormatInt(now.Add(-revocationLogRetention).UnixMilli(), 10))
+}
+
+// loadAll 加载撤销列表中所有未过期的 jti，返回撤销日志新的游标
+func (l *revocationList) loadAll(ctx context.Context, now time.Time) (loaded map[string]time.Time, cursor int64, err error) {
+	var members *redis.ZSliceCmd
+	_, err = l.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		l.trim(ctx, pipe, now)
+		members = pipe.ZRangeByScoreWithScores(ctx, l.key, &redis.ZRangeBy{Min: "(" + strconv.FormatInt(now.UnixMilli(), 10), Max: "+inf"})
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	loaded = make(map[string]time.Time, len(members.Val()))
+	for _, z := range members.Val() {
+		loaded[z.Member.(string)] = time.UnixMilli(int64(z.Score))
+	}
+	// 全量加载已经包含此前写入撤销日志的 jti
+	return loaded, now.UnixMilli(), nil
+}
+
+// loadLog 加载撤销日志中 cursor 之后的 jti，返回撤销日志新的游标
+// 游标至少前进到本次同步开始的时间，没有新的撤销时也不会因为游标过旧而全量加载
+func (l *revocationList) loadLog(ctx context.Context, cursor int64, now time.Time) (loaded map[string]time.Time, next int64, err error) {
+	var members *redis.ZSliceCmd
+	_, err = l.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		l.trim(ctx, pipe, now)
+		members = pipe.ZRangeByScoreWithScores(ctx, l.logKey, &redis.ZRangeBy{
+			Min: strconv.FormatInt(cursor-revocationLogOverlap.Milliseconds(), 10),
+			Max: "+inf",
+		})
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	next = max(cursor, now.UnixMilli())
+	loaded = make(map[string]time.Time, len(members.Val()))
+	for _, z := range members.Val() {
+		jti, expiredAt, _ := strings.Cut(z.Member.(string), ":")
+		ms, err := strconv.ParseInt(expiredAt, 10, 64)
+		if err != nil {
+			continue
+		}
+		loaded[jti] = time.UnixMilli(ms)
+		next = max(next, int64(z.Score))
+	}
+	return loaded, next, nil
+}
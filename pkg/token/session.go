@@ -0,0 +1,265 @@
+package token
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/cast"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// 会话范围，决定同一用户的哪些登录会互相顶替
+const (
+	SessionScopeUser     = "user"     // 每个用户只保留一个会话（默认）
+	SessionScopePlatform = "platform" // 每个平台一个会话，如 web 和 app 可以同时登录
+	SessionScopeDevice   = "device"   // 每个设备一个会话，DeviceId 为空时按平台区分
+)
+
+// session 返回 val 所属的会话标识
+func (o *options) session(val *Value) string {
+	platform := strings.ToLower(val.Platform)
+	switch o.sessionScope {
+	case SessionScopePlatform:
+		return "platform:" + platform
+	case SessionScopeDevice:
+		if val.DeviceId == "" {
+			return "platform:" + platform
+		}
+		return "device:" + platform + ":" + val.DeviceId
+	default:
+		return SessionScopeUser
+	}
+}
+
+// sessionsKey 返回用户会话的 hash 键，field 为会话标识，value 为 access token
+func (tk *Token) sessionsKey(userId int64) string {
+	return tk.sessionsKeyPrefix + cast.ToString(userId)
+}
+
+// maxSessionRetries 是会话被并发修改时更新会话的最大尝试次数
+const maxSessionRetries = 5
+
+// ErrSessionConflict 表示会话被持续并发修改，多次重试后仍然无法更新
+var ErrSessionConflict = errors.New("sessions modified concurrently")
+
+// updateSessionsScript 在会话 hash 没有被并发修改时原子性地删除失效的会话并写入新的会话
+// 会话 hash 与读取时不同说明有并发的修改，返回 0 由调用方重新读取后重试
+// 脚本只访问会话 hash，token 数据等其他键在 Redis Cluster 中位于不同的 slot，由调用方在脚本成功后写入
+// KEYS[1]: 会话 hash
+// ARGV[1]: JSON 编码的 sessionUpdate
+// 返回 1 表示更新成功，0 表示会话已被并发修改
+var updateSessionsScript = redis.NewScript(`
+local op = cjson.decode(ARGV[1])
+local fields = op.fields or {}
+
+local current = redis.call("HGETALL", KEYS[1])
+for i = 1, #current, 2 do
+    if fields[current[i]] ~= current[i + 1] then
+        return 0
+    end
+end
+local expected = 0
+for _ in pairs(fields) do
+    expected = expected + 1
+end
+if expected * 2 ~= #current then
+    return 0
+end
+
+for _, name in ipairs(op.delete or {}) do
+    redis.call("HDEL", KEYS[1], name)
+end
+if op.session then
+    redis.call("HSET", KEYS[1], op.session, op.access_token)
+end
+return 1
+`)
+
+// compareAndDeleteScript 在 hash 的字段仍为指定值时删除该字段
+// KEYS[1]: hash
+// ARGV[1]: 字段，ARGV[2]: 期望的值
+// 返回 1 表示已删除
+var compareAndDeleteScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], ARGV[1]) == ARGV[2] then
+    return redis.call("HDEL", KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// sessionSet 是从 Redis 读取的用户会话
+type sessionSet struct {
+	fields      map[string]string // 会话 hash 的原始内容，用于检查并发修改
+	legacy      string            // tokenUniqueKey 中的 token
+	sessions    []*Value          // refresh token 未过期的会话，按创建时间排序
+	stale       []string          // 已经失效、需要从会话 hash 中删除的会话标识
+	staleLegacy bool              // tokenUniqueKey 中的 token 已经失效
+}
+
+// sessionUpdate 是 updateSessionsScript 执行的更新
+type sessionUpdate struct {
+	Fields      map[string]string `json:"fields,omitempty"`
+	Delete      []string          `json:"delete,omitempty"`
+	Session     string            `json:"session,omitempty"`
+	AccessToken string            `json:"access_token,omitempty"`
+}
+
+// loadSessions 返回用户所有 refresh token 未过期的会话，按创建时间排序
+// 升级前通过 tokenUniqueKey 保存的 token 作为 SessionScopeUser 会话返回
+// 旧版本实例只更新 tokenUniqueKey，与会话 hash 中的 SessionScopeUser 会话不同时两者都作为该会话返回
+func (tk *Token) loadSessions(ctx context.Context, userId int64) (set *sessionSet, err error) {
+	set = new(sessionSet)
+	set.fields, err = tk.rdb.HGetAll(ctx, tk.sessionsKey(userId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	set.legacy, err = tk.rdb.HGet(ctx, tk.tokenUniqueKey, cast.ToString(userId)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(set.fields)+1)
+	tokens := make([]string, 0, len(set.fields)+1)
+	for name, token := range set.fields {
+		names = append(names, name)
+		tokens = append(tokens, token)
+	}
+	legacyIndex := -1
+	if set.legacy != "" && set.legacy != set.fields[SessionScopeUser] {
+		legacyIndex = len(tokens)
+		names = append(names, SessionScopeUser)
+		tokens = append(tokens, set.legacy)
+	}
+	if len(tokens) == 0 {
+		return set, nil
+	}
+	values, err := tk.rdb.HMGet(ctx, tk.tokenDataKey, tokens...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, item := range values {
+		data, ok := item.(string)
+		val := new(Value)
+		if !ok || val.UnmarshalBinary([]byte(data)) != nil || val.IsRefreshExpired() {
+			if i == legacyIndex {
+				set.staleLegacy = true
+			} else {
+				set.stale = append(set.stale, names[i])
+			}
+			continue
+		}
+		val.Session = names[i]
+		set.sessions = append(set.sessions, val)
+	}
+	slices.SortFunc(set.sessions, func(a, b *Value) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return set, nil
+}
+
+// swapSessions 在会话 hash 仍为 set 读取时的内容时删除 names 中的会话，newVal 不为 nil 时写入新的会话
+// 返回 false 表示会话已被并发修改
+func (tk *Token) swapSessions(ctx context.Context, userId int64, set *sessionSet, names []string, newVal *Value) (bool, error) {
+	op := &sessionUpdate{Fields: set.fields, Delete: names}
+	if newVal != nil {
+		op.Session, op.AccessToken = newVal.Session, newVal.AccessToken
+	}
+	arg, err := json.Marshal(op)
+	if err != nil {
+		return false, err
+	}
+	ok, err := updateSessionsScript.Run(ctx, tk.rdb, []string{tk.sessionsKey(userId)}, arg).Int()
+	return ok == 1, err
+}
+
+// updateSessions 读取用户的会话，由 fn 决定需要失效的会话和新写入的会话（可以为 nil），然后更新
+// 会话记录通过 updateSessionsScript 原子性地更新，会话在读取后被并发修改时重新读取并调用 fn，多次重试失败返回 ErrSessionConflict
+// 会话记录更新成功后再写入新 token，并让失效的会话保留 token 数据以便客户端得知已被顶替，删除 refresh token
+func (tk *Token) updateSessions(ctx context.Context, userId int64, fn func(set *sessionSet) (expired []*Value, newVal *Value)) (err error) {
+	for range maxSessionRetries {
+		set, err := tk.loadSessions(ctx, userId)
+		if err != nil {
+			return err
+		}
+		expired, newVal := fn(set)
+		if len(expired) == 0 && newVal == nil && len(set.stale) == 0 && !set.staleLegacy {
+			return nil
+		}
+
+		names := slices.Clone(set.stale)
+		for _, val := range expired {
+			if set.fields[val.Session] == val.AccessToken {
+				names = append(names, val.Session)
+			}
+		}
+		ok, err := tk.swapSessions(ctx, userId, set, names, newVal)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		uid := cast.ToString(userId)
+		_, err = tk.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			if newVal != nil {
+				pipe.HSet(ctx, tk.tokenDataKey, newVal.AccessToken, newVal)
+				pipe.HSet(ctx, tk.refreshTokenKey, newVal.RefreshToken, newVal.AccessToken)
+			}
+			for _, val := range expired {
+				tk.revocation.add(ctx, pipe, val)
+				val.Expire()
+				pipe.HSet(ctx, tk.tokenDataKey, val.AccessToken, val)
+				pipe.HDel(ctx, tk.refreshTokenKey, val.RefreshToken)
+			}
+			// tokenUniqueKey 只用于兼容旧版本实例，不在会话的原子更新中
+			switch {
+			case newVal != nil && newVal.Session == SessionScopeUser:
+				pipe.HSet(ctx, tk.tokenUniqueKey, uid, newVal.AccessToken)
+			case set.staleLegacy || slices.ContainsFunc(expired, func(val *Value) bool { return val.AccessToken == set.legacy }):
+				compareAndDeleteScript.Eval(ctx, pipe, []string{tk.tokenUniqueKey}, uid, set.legacy)
+			}
+			return nil
+		})
+		return err
+	}
+	return ErrSessionConflict
+}
+
+// Sessions returns the active sessions of the user, ordered by creation time
+// 包括 access token 已过期但仍然可以刷新的会话
+func (tk *Token) Sessions(ctx context.Context, userId int64) (sessions []*Value, err error) {
+	err = tk.updateSessions(ctx, userId, func(set *sessionSet) ([]*Value, *Value) {
+		sessions = set.sessions
+		return nil, nil
+	})
+	return
+}
+
+// RevokeSession revokes one session of the user, session is Value.Session
+func (tk *Token) RevokeSession(ctx context.Context, userId int64, session string) (err error) {
+	found := false
+	err = tk.updateSessions(ctx, userId, func(set *sessionSet) (expired []*Value, _ *Value) {
+		for _, val := range set.sessions {
+			if val.Session == session {
+				expired = append(expired, val)
+			}
+		}
+		found = len(expired) > 0
+		return
+	})
+	if err == nil && !found {
+		err = ErrSessionNotFound
+	}
+	return
+}
+
+// RevokeAll revokes all sessions of the user
+func (tk *Token) RevokeAll(ctx context.Context, userId int64) (err error) {
+	return tk.updateSessions(ctx, userId, func(set *sessionSet) ([]*Value, *Value) {
+		return set.sessions, nil
+	})
+}
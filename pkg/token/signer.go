@@ -0,0 +1,191 @@
+package token
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/sjson"
+)
+
+var ErrInvalidSignature = errors.New("invalid token signature")
+
+// 签名算法，与 JWT 的 alg 一致
+const (
+	AlgorithmHS256 = "HS256" // HMAC-SHA256，签发和校验使用同一个密钥
+	AlgorithmEdDSA = "EdDSA" // Ed25519，校验只需要公钥，适合由其他服务校验
+)
+
+// SigningKey 是签发和校验无状态 access token 的密钥，Id 对应 JWT 头部的 kid
+type SigningKey struct {
+	Id         string
+	Algorithm  string
+	secret     []byte
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+// NewHMACKey 创建 HS256 密钥
+func NewHMACKey(id string, secret []byte) *SigningKey {
+	return &SigningKey{Id: id, Algorithm: AlgorithmHS256, secret: secret}
+}
+
+// NewEd25519Key 创建 Ed25519 密钥，可以签发和校验
+func NewEd25519Key(id string, privateKey ed25519.PrivateKey) *SigningKey {
+	return &SigningKey{Id: id, Algorithm: AlgorithmEdDSA, privateKey: privateKey, publicKey: privateKey.Public().(ed25519.PublicKey)}
+}
+
+// NewEd25519VerifyKey 创建只能校验的 Ed25519 密钥
+func NewEd25519VerifyKey(id string, publicKey ed25519.PublicKey) *SigningKey {
+	return &SigningKey{Id: id, Algorithm: AlgorithmEdDSA, publicKey: publicKey}
+}
+
+func (k *SigningKey) canSign() bool {
+	return len(k.secret) > 0 || len(k.privateKey) > 0
+}
+
+func (k *SigningKey) sign(data []byte) []byte {
+	if k.Algorithm == AlgorithmEdDSA {
+		return ed25519.Sign(k.privateKey, data)
+	}
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func (k *SigningKey) verify(data, sig []byte) bool {
+	if k.Algorithm == AlgorithmEdDSA {
+		return len(k.publicKey) == ed25519.PublicKeySize && ed25519.Verify(k.publicKey, data, sig)
+	}
+	return len(k.secret) > 0 && hmac.Equal(k.sign(data), sig)
+}
+
+// header 是 JWT 头部
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// claims 是无状态 access token 的内容，不包含 refresh token
+type claims struct {
+	Jti      string          `json:"jti"`
+	Sub      string          `json:"sub"`
+	Iat      int64           `json:"iat"`
+	Exp      int64           `json:"exp"`
+	UserType int8            `json:"uty,omitempty"`
+	Platform string          `json:"plt,omitempty"`
+	DeviceId string          `json:"dev,omitempty"`
+	Session  string          `json:"sid,omitempty"`
+	Extras   json.RawMessage `json:"ext,omitempty"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// unsignedExtras 是不写入无状态 access token 的 Extras 字段
+// 刷新时记录的旧 token 会让 token 逐代嵌套变长，并且会泄露仍然有效的 refresh token
+var unsignedExtras = []string{"old_access_token", "old_refresh_token"}
+
+// claimExtras 返回写入 ext 声明的 Extras，去掉 unsignedExtras
+func claimExtras(extras []byte) json.RawMessage {
+	ext := bytes.Clone(extras)
+	for _, key := range unsignedExtras {
+		if deleted, err := sjson.DeleteBytes(ext, key); err == nil {
+			ext = deleted
+		}
+	}
+	return ext
+}
+
+// signValue 用 keys[0] 为 val 签发无状态 access token，写入 val.TokenId 和 val.AccessToken
+func signValue(keys []*SigningKey, val *Value) error {
+	key := keys[0]
+	if !key.canSign() {
+		return errors.New("signing key " + key.Id + " cannot sign")
+	}
+
+	val.TokenId = genToken()
+	c := claims{
+		Jti:      val.TokenId,
+		Sub:      strconv.FormatInt(val.UserId, 10),
+		Iat:      val.CreatedAt.Unix(),
+		Exp:      val.TokenExpiredAt.Unix(),
+		UserType: val.UserType,
+		Platform: val.Platform,
+		DeviceId: val.DeviceId,
+		Session:  val.Session,
+	}
+	if json.Valid(val.Extras) {
+		c.Extras = claimExtras(val.Extras)
+	}
+
+	h, err := json.Marshal(header{Alg: key.Algorithm, Typ: "JWT", Kid: key.Id})
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	signed := b64.EncodeToString(h) + "." + b64.EncodeToString(payload)
+	val.AccessToken = signed + "." + b64.EncodeToString(key.sign([]byte(signed)))
+	return nil
+}
+
+// isSigned 判断 token 是否为无状态 access token
+func isSigned(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// parseValue 按 kid 选择密钥校验签名，返回 token 中的 Value，不检查是否过期
+func parseValue(keys []*SigningKey, token string) (*Value, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidSignature
+	}
+
+	var h header
+	if data, err := b64.DecodeString(parts[0]); err != nil || json.Unmarshal(data, &h) != nil {
+		return nil, ErrInvalidSignature
+	}
+	var key *SigningKey
+	for _, k := range keys {
+		// 算法必须与密钥一致，避免算法混淆攻击
+		if k.Id == h.Kid && k.Algorithm == h.Alg {
+			key = k
+			break
+		}
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if key == nil || err != nil || !key.verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return nil, ErrInvalidSignature
+	}
+
+	var c claims
+	if data, err := b64.DecodeString(parts[1]); err != nil || json.Unmarshal(data, &c) != nil {
+		return nil, ErrInvalidSignature
+	}
+	userId, err := strconv.ParseInt(c.Sub, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	return &Value{
+		UserId:         userId,
+		UserType:       c.UserType,
+		AccessToken:    token,
+		TokenId:        c.Jti,
+		Platform:       c.Platform,
+		DeviceId:       c.DeviceId,
+		Session:        c.Session,
+		CreatedAt:      time.Unix(c.Iat, 0),
+		TokenExpiredAt: time.Unix(c.Exp, 0),
+		Extras:         []byte(c.Extras),
+	}, nil
+}
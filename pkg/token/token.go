@@ -3,9 +3,13 @@ package token
 import (
 	"context"
 	"errors"
+	"fmt"
+	"maps"
+	"slices"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/cast"
 )
 
@@ -15,12 +19,19 @@ var (
 	ErrRefreshTokenExpired  = errors.New("refresh token expired")
 )
 
+// ErrRefreshTokenReused 表示已经轮换过的 refresh token 被再次使用，同时匹配 ErrRefreshTokenNotFound
+var ErrRefreshTokenReused = fmt.Errorf("%w: reused after rotation", ErrRefreshTokenNotFound)
+
 type Token struct {
 	rdb             redis.Cmdable
 	opts            *options
 	refreshTokenKey string
-	tokenUniqueKey  string
+	tokenUniqueKey  string // 升级前每个用户唯一的 token，SessionScopeUser 会话继续写入一个版本，供滚动升级期间的旧版本实例读取
 	tokenDataKey    string
+
+	sessionsKeyPrefix string
+	rotatedKeyPrefix  string
+	revocation        *revocationList
 }
 
 func New(rdb redis.Cmdable, opts ...Option) *Token {
@@ -33,10 +44,15 @@ func New(rdb redis.Cmdable, opts ...Option) *Token {
 		tokenDataKey:    o.prefix + ":token:data",
 		tokenUniqueKey:  o.prefix + ":token:unique",
 		refreshTokenKey: o.prefix + ":token:refresh",
+
+		sessionsKeyPrefix: o.prefix + ":token:sessions:",
+		rotatedKeyPrefix:  "{" + o.prefix + ":token:refresh}:rotated:",
+		revocation:        newRevocationList(rdb, o.prefix+":token:revoked", o.revocationSync),
 	}
 }
 
 // Set sets the token
+// 同一会话的旧 token 和超过最大会话数时最早创建的会话会失效，会话范围见 WithSessionScope
 func (tk *Token) Set(ctx context.Context, val *Value, opts ...Option) (err error) {
 	o := *tk.opts
 	o.apply(opts...)
@@ -46,35 +62,38 @@ func (tk *Token) Set(ctx context.Context, val *Value, opts ...Option) (err error
 	if val.RefreshExpiredAt.IsZero() {
 		val.RefreshExpiredAt = val.CreatedAt.Add(o.refreshExpires)
 	}
-
-	var oldValue Value
-	oldAccessToken := tk.rdb.HGet(ctx, tk.tokenUniqueKey, cast.ToString(val.UserId)).Val()
-	if oldAccessToken != val.AccessToken {
-		err = tk.rdb.HGet(ctx, tk.tokenDataKey, oldAccessToken).Scan(&oldValue)
-		if err != nil {
-			if err != redis.Nil {
-				return
-			}
-			err = nil
+	val.Session = o.session(val)
+	if val.FamilyId == "" {
+		val.FamilyId = genToken()
+	}
+	if len(o.signingKeys) > 0 && !isSigned(val.AccessToken) {
+		if err = signValue(o.signingKeys, val); err != nil {
+			return
 		}
 	}
 
-	_, err = tk.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) (err error) {
-		// 如果有旧的 token，则让旧 token 记录失效，让refresh token 失效
-		if oldValue.UserId > 0 {
-			oldValue.Expire()
-			pipe.HSet(ctx, tk.tokenDataKey, oldValue.AccessToken, &oldValue)
-			pipe.HDel(ctx, tk.refreshTokenKey, oldValue.RefreshToken, val.AccessToken)
+	// 如果有同一会话的旧 token，则让旧 token 记录失效，让refresh token 失效
+	return tk.updateSessions(ctx, val.UserId, func(set *sessionSet) (expired []*Value, _ *Value) {
+		var kept []*Value
+		for _, old := range set.sessions {
+			switch {
+			case old.AccessToken == val.AccessToken:
+			case old.Session == val.Session:
+				expired = append(expired, old)
+			default:
+				kept = append(kept, old)
+			}
 		}
-		pipe.HSet(ctx, tk.tokenDataKey, val.AccessToken, val)
-		pipe.HSet(ctx, tk.refreshTokenKey, val.RefreshToken, val.AccessToken)
-		pipe.HSet(ctx, tk.tokenUniqueKey, val.UserId, val.AccessToken)
-		return
+		// 超过最大会话数时让最早创建的会话失效
+		if o.maxSessions > 0 && len(kept) >= o.maxSessions {
+			expired = append(expired, kept[:len(kept)-o.maxSessions+1]...)
+		}
+		return expired, val
 	})
-	return
 }
 
 // Update updates the token
+// 无状态 access token 的过期时间已经签名在 token 中，不会被延长
 func (tk *Token) Update(ctx context.Context, val *Value, opts ...Option) (err error) {
 	o := *tk.opts
 	o.apply(opts...)
@@ -88,12 +107,10 @@ func (tk *Token) Update(ctx context.Context, val *Value, opts ...Option) (err er
 }
 
 // Delete removes the token
+// token 为空时删除用户的所有会话
 func (tk *Token) Delete(ctx context.Context, userId int64, token string) (err error) {
-	if userId > 0 && token == "" { // 通过 userId 查找 token
-		token = tk.rdb.HGet(ctx, tk.tokenUniqueKey, cast.ToString(userId)).Val()
-		if token == "" {
-			return
-		}
+	if userId > 0 && token == "" {
+		return tk.deleteAll(ctx, userId)
 	}
 
 	val := new(Value)
@@ -105,21 +122,80 @@ func (tk *Token) Delete(ctx context.Context, userId int64, token string) (err er
 		return
 	}
 
+	// 会话记录仍指向该 token 时才删除，避免删除并发写入的同一会话的新 token
+	session := val.Session
+	if session == "" {
+		session = SessionScopeUser
+	}
+	uid := cast.ToString(val.UserId)
 	_, err = tk.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) (err error) {
 		pipe.HDel(ctx, tk.tokenDataKey, token)
 		pipe.HDel(ctx, tk.refreshTokenKey, val.RefreshToken)
-		pipe.HDel(ctx, tk.tokenUniqueKey, cast.ToString(val.UserId))
+		tk.revocation.add(ctx, pipe, val)
+		compareAndDeleteScript.Eval(ctx, pipe, []string{tk.sessionsKey(val.UserId)}, session, token)
+		compareAndDeleteScript.Eval(ctx, pipe, []string{tk.tokenUniqueKey}, uid, token)
 		return
 	})
 	return
 }
 
+// deleteAll 删除用户所有会话的 token 数据
+// 会话记录与读取时相同才删除，避免删除并发写入的新会话
+func (tk *Token) deleteAll(ctx context.Context, userId int64) (err error) {
+	for range maxSessionRetries {
+		set, err := tk.loadSessions(ctx, userId)
+		if err != nil {
+			return err
+		}
+		ok, err := tk.swapSessions(ctx, userId, set, slices.Collect(maps.Keys(set.fields)), nil)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		_, err = tk.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, val := range set.sessions {
+				pipe.HDel(ctx, tk.tokenDataKey, val.AccessToken)
+				pipe.HDel(ctx, tk.refreshTokenKey, val.RefreshToken)
+				tk.revocation.add(ctx, pipe, val)
+			}
+			if set.legacy != "" {
+				compareAndDeleteScript.Eval(ctx, pipe, []string{tk.tokenUniqueKey}, cast.ToString(userId), set.legacy)
+			}
+			return nil
+		})
+		return err
+	}
+	return ErrSessionConflict
+}
+
 // Get gets the token
+// 启用无状态 access token 时在本地校验签名和撤销列表，签名无效时返回空的 Value，已撤销时返回已过期的 Value
 func (tk *Token) Get(ctx context.Context, token string) (val *Value, err error) {
 	if token == "" {
 		return
 	}
+	if len(tk.opts.signingKeys) > 0 && isSigned(token) {
+		val, err = parseValue(tk.opts.signingKeys, token)
+		if err != nil {
+			return new(Value), nil
+		}
+		revoked, err := tk.revocation.isRevoked(ctx, val.TokenId)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			val.Expire()
+		}
+		return val, nil
+	}
+	return tk.load(ctx, token)
+}
 
+// load 从 Redis 读取 token 数据
+func (tk *Token) load(ctx context.Context, token string) (val *Value, err error) {
 	val = new(Value)
 	err = tk.rdb.HGet(ctx, tk.tokenDataKey, token).Scan(val)
 	if err == redis.Nil {
@@ -129,21 +205,25 @@ func (tk *Token) Get(ctx context.Context, token string) (val *Value, err error)
 }
 
 // Refresh refreshes the token
-// 把老的数据设置为过期，新的数据重新生成
+// 把老的数据设置为过期，新的数据重新生成，新 token 与老 token 属于同一个 token 家族
+// 已经轮换过的 refresh token 被再次使用时，说明 refresh token 可能已经泄露，撤销整个家族并发出安全事件
 func (tk *Token) Refresh(ctx context.Context, refreshToken string, opts ...Option) (val *Value, err error) {
 	accessToken := tk.rdb.HGet(ctx, tk.refreshTokenKey, refreshToken).Val()
 	if accessToken == "" {
-		err = ErrRefreshTokenNotFound
-		return
+		return nil, tk.detectReuse(ctx, refreshToken)
 	}
 
-	val, err = tk.Get(ctx, accessToken)
-	if err != nil || val == nil {
+	val, err = tk.load(ctx, accessToken)
+	if err != nil || val.UserId == 0 {
 		err = ErrInvalidAccessToken
 		return
 	}
 
 	if val.IsRefreshExpired() {
+		// 并发的请求刚刚轮换了该 refresh token，与删除失败一样处理
+		if exists, err := tk.rdb.HExists(ctx, tk.refreshTokenKey, refreshToken).Result(); err == nil && !exists {
+			return nil, tk.detectReuse(ctx, refreshToken)
+		}
 		err = ErrRefreshTokenExpired
 		return
 	}
@@ -151,21 +231,50 @@ func (tk *Token) Refresh(ctx context.Context, refreshToken string, opts ...Optio
 	o := *tk.opts
 	o.apply(opts...)
 
+	// 先生成并签名新 token，签名失败时 refresh token 不会被消耗
 	newVal := val.Refresh()
 	newVal.updateExpire(&o)
-	val.Expire()
+	if newVal.Session == "" {
+		newVal.Session = SessionScopeUser
+	}
+	if newVal.FamilyId == "" {
+		newVal.FamilyId = genToken()
+	}
+	if len(o.signingKeys) > 0 {
+		if err = signValue(o.signingKeys, newVal); err != nil {
+			return nil, err
+		}
+	}
 
+	// 先写入新 token 的数据，新的 refresh token 在认领旧 refresh token 的脚本中写入，认领成功后新 token 立即可用
+	if err = tk.rdb.HSet(ctx, tk.tokenDataKey, newVal.AccessToken, newVal).Err(); err != nil {
+		return nil, err
+	}
+	// 删除成功的请求才能轮换，并发使用同一个 refresh token 时只有一个请求成功
+	claimed, err := tk.claimRefreshToken(ctx, refreshToken, newVal, val.RefreshExpiredAt)
+	if err != nil || !claimed {
+		tk.rdb.HDel(ctx, tk.tokenDataKey, newVal.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		return nil, tk.detectReuse(ctx, refreshToken)
+	}
+
+	// 以下更新会话记录并让旧 token 失效，失败时新 token 仍然可用，只记录错误
+	tokenExpiredAt := val.TokenExpiredAt
+	val.Expire()
 	_, err = tk.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) (err error) {
-		pipe.HSet(ctx, tk.tokenDataKey, newVal.AccessToken, newVal)
-		pipe.HSet(ctx, tk.refreshTokenKey, newVal.RefreshToken, newVal.AccessToken)
-		pipe.HSet(ctx, tk.tokenUniqueKey, newVal.UserId, newVal.AccessToken)
+		pipe.HSet(ctx, tk.sessionsKey(newVal.UserId), newVal.Session, newVal.AccessToken)
+		if newVal.Session == SessionScopeUser {
+			pipe.HSet(ctx, tk.tokenUniqueKey, cast.ToString(newVal.UserId), newVal.AccessToken)
+		}
 
 		pipe.HSet(ctx, tk.tokenDataKey, val.AccessToken, val)
-		pipe.HDel(ctx, tk.refreshTokenKey, refreshToken)
+		tk.revocation.add(ctx, pipe, &Value{TokenId: val.TokenId, TokenExpiredAt: tokenExpiredAt})
 		return
 	})
 	if err != nil {
-		return nil, err
+		log.Error().Err(err).Int64("user_id", newVal.UserId).Str("session", newVal.Session).Msg("failed to update session after refresh")
 	}
 	return newVal, nil
 }
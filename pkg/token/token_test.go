@@ -2,12 +2,17 @@ package token
 
 import (
 	"context"
+	"crypto/ed25519"
 	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/alicebob/miniredis/v2"
 	"github.com/redis/go-redis/v9"
+	"github.com/spf13/cast"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -18,9 +23,55 @@ func setupTestRedis(t *testing.T) (*redis.Client, *miniredis.Miniredis) {
 	client := redis.NewClient(&redis.Options{
 		Addr: mr.Addr(),
 	})
+	client.AddHook(slotChecker{t})
 	return client, mr
 }
 
+// slotChecker 检查 Lua 脚本访问的键在 Redis Cluster 中位于同一个 slot
+type slotChecker struct{ t *testing.T }
+
+func (c slotChecker) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (c slotChecker) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		c.check(cmd)
+		return next(ctx, cmd)
+	}
+}
+
+func (c slotChecker) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			c.check(cmd)
+		}
+		return next(ctx, cmds)
+	}
+}
+
+func (c slotChecker) check(cmd redis.Cmder) {
+	if name := cmd.Name(); name != "eval" && name != "evalsha" {
+		return
+	}
+	args := cmd.Args()
+	n := cast.ToInt(args[2])
+	for _, key := range args[4 : 3+n] {
+		if hashTag(key.(string)) != hashTag(args[3].(string)) {
+			c.t.Errorf("script keys %v are in different slots", args[3:3+n])
+			return
+		}
+	}
+}
+
+// hashTag 返回决定键所在 slot 的部分
+func hashTag(key string) string {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			return key[start+1 : start+1+end]
+		}
+	}
+	return key
+}
+
 func TestToken_Set(t *testing.T) {
 	client, mr := setupTestRedis(t)
 	defer mr.Close()
@@ -278,6 +329,21 @@ func TestToken_Delete(t *testing.T) {
 		assert.Error(t, err)
 	})
 
+	t.Run("keep newer token of the session", func(t *testing.T) {
+		old := NewValue(5002)
+		require.NoError(t, tk.Set(ctx, old))
+		val := NewValue(5002)
+		require.NoError(t, tk.Set(ctx, val))
+
+		require.NoError(t, tk.Delete(ctx, 0, old.AccessToken))
+		assert.Equal(t, val.AccessToken, client.HGet(ctx, tk.sessionsKey(5002), SessionScopeUser).Val())
+		assert.Equal(t, val.AccessToken, client.HGet(ctx, tk.tokenUniqueKey, "5002").Val())
+
+		require.NoError(t, tk.Delete(ctx, 0, val.AccessToken))
+		assert.False(t, client.HExists(ctx, tk.sessionsKey(5002), SessionScopeUser).Val())
+		assert.False(t, client.HExists(ctx, tk.tokenUniqueKey, "5002").Val())
+	})
+
 	t.Run("remove non-existing token", func(t *testing.T) {
 		err := tk.Delete(ctx, 0, "non-existing-token")
 		assert.NoError(t, err) // 不应该报错
@@ -499,3 +565,505 @@ func TestValue_Expire(t *testing.T) {
 		assert.Equal(t, oldRefreshExpire, val.RefreshExpiredAt)
 	})
 }
+
+func TestToken_Sessions(t *testing.T) {
+	client, mr := setupTestRedis(t)
+	defer mr.Close()
+	defer client.Close()
+
+	ctx := context.Background()
+
+	newSession := func(userId int64, platform, deviceId string) *Value {
+		val := NewValue(userId)
+		val.Platform = platform
+		val.DeviceId = deviceId
+		return val
+	}
+	assertExpired := func(t *testing.T, tk *Token, val *Value) {
+		t.Helper()
+		got, err := tk.Get(ctx, val.AccessToken)
+		require.NoError(t, err)
+		assert.True(t, got.IsTokenExpired())
+		_, err = tk.Refresh(ctx, val.RefreshToken)
+		assert.True(t, errors.Is(err, ErrRefreshTokenNotFound))
+	}
+
+	t.Run("platform scope keeps sessions of different platforms", func(t *testing.T) {
+		tk := New(client, WithPrefix("test"), WithSessionScope(SessionScopePlatform))
+
+		web := newSession(12001, "web", "")
+		app := newSession(12001, "app", "")
+		require.NoError(t, tk.Set(ctx, web))
+		require.NoError(t, tk.Set(ctx, app))
+
+		sessions, err := tk.Sessions(ctx, 12001)
+		require.NoError(t, err)
+		require.Len(t, sessions, 2)
+		assert.Equal(t, web.AccessToken, sessions[0].AccessToken)
+		assert.Equal(t, "platform:web", sessions[0].Session)
+		assert.Equal(t, app.AccessToken, sessions[1].AccessToken)
+
+		// 同一平台再次登录顶替旧会话
+		web2 := newSession(12001, "Web", "")
+		require.NoError(t, tk.Set(ctx, web2))
+		assertExpired(t, tk, web)
+
+		sessions, err = tk.Sessions(ctx, 12001)
+		require.NoError(t, err)
+		assert.Len(t, sessions, 2)
+	})
+
+	t.Run("device scope and max sessions evict oldest", func(t *testing.T) {
+		tk := New(client, WithPrefix("test"), WithSessionScope(SessionScopeDevice), WithMaxSessions(2))
+
+		phone1 := newSession(12002, "app", "phone-1")
+		phone1.CreatedAt = time.Now().Add(-time.Minute)
+		phone2 := newSession(12002, "app", "phone-2")
+		require.NoError(t, tk.Set(ctx, phone1))
+		require.NoError(t, tk.Set(ctx, phone2))
+
+		// 第三个设备登录时最早的会话失效
+		web := newSession(12002, "web", "")
+		require.NoError(t, tk.Set(ctx, web))
+		assertExpired(t, tk, phone1)
+
+		sessions, err := tk.Sessions(ctx, 12002)
+		require.NoError(t, err)
+		require.Len(t, sessions, 2)
+		assert.Equal(t, "device:app:phone-2", sessions[0].Session)
+		assert.Equal(t, "platform:web", sessions[1].Session)
+	})
+
+	t.Run("refresh keeps session", func(t *testing.T) {
+		tk := New(client, WithPrefix("test"), WithSessionScope(SessionScopeDevice))
+
+		val := newSession(12003, "app", "phone-1")
+		require.NoError(t, tk.Set(ctx, val))
+		newVal, err := tk.Refresh(ctx, val.RefreshToken)
+		require.NoError(t, err)
+		assert.Equal(t, "phone-1", newVal.DeviceId)
+
+		sessions, err := tk.Sessions(ctx, 12003)
+		require.NoError(t, err)
+		require.Len(t, sessions, 1)
+		assert.Equal(t, newVal.AccessToken, sessions[0].AccessToken)
+	})
+
+	t.Run("revoke one and all sessions", func(t *testing.T) {
+		tk := New(client, WithPrefix("test"), WithSessionScope(SessionScopePlatform))
+
+		web := newSession(12004, "web", "")
+		app := newSession(12004, "app", "")
+		ios := newSession(12004, "ios", "")
+		require.NoError(t, tk.Set(ctx, web))
+		require.NoError(t, tk.Set(ctx, app))
+		require.NoError(t, tk.Set(ctx, ios))
+
+		require.NoError(t, tk.RevokeSession(ctx, 12004, "platform:web"))
+		assertExpired(t, tk, web)
+		assert.True(t, errors.Is(tk.RevokeSession(ctx, 12004, "platform:web"), ErrSessionNotFound))
+
+		sessions, err := tk.Sessions(ctx, 12004)
+		require.NoError(t, err)
+		assert.Len(t, sessions, 2)
+
+		require.NoError(t, tk.RevokeAll(ctx, 12004))
+		assertExpired(t, tk, app)
+		assertExpired(t, tk, ios)
+
+		sessions, err = tk.Sessions(ctx, 12004)
+		require.NoError(t, err)
+		assert.Empty(t, sessions)
+	})
+
+	t.Run("legacy unique token", func(t *testing.T) {
+		tk := New(client, WithPrefix("test"))
+
+		// 升级前只写入 tokenUniqueKey 的 token
+		legacy := newSession(12005, "web", "")
+		legacy.TokenExpiredAt = legacy.CreatedAt.Add(time.Hour)
+		legacy.RefreshExpiredAt = legacy.CreatedAt.Add(time.Hour * 24)
+		require.NoError(t, client.HSet(ctx, tk.tokenDataKey, legacy.AccessToken, legacy).Err())
+		require.NoError(t, client.HSet(ctx, tk.refreshTokenKey, legacy.RefreshToken, legacy.AccessToken).Err())
+		require.NoError(t, client.HSet(ctx, tk.tokenUniqueKey, legacy.UserId, legacy.AccessToken).Err())
+
+		sessions, err := tk.Sessions(ctx, 12005)
+		require.NoError(t, err)
+		require.Len(t, sessions, 1)
+		assert.Equal(t, SessionScopeUser, sessions[0].Session)
+
+		// 新登录顶替旧 token
+		val := newSession(12005, "app", "")
+		require.NoError(t, tk.Set(ctx, val))
+		assertExpired(t, tk, legacy)
+		// 滚动升级期间继续写入 tokenUniqueKey，供旧版本实例读取
+		assert.Equal(t, val.AccessToken, client.HGet(ctx, tk.tokenUniqueKey, "12005").Val())
+
+		newVal, err := tk.Refresh(ctx, val.RefreshToken)
+		require.NoError(t, err)
+		assert.Equal(t, newVal.AccessToken, client.HGet(ctx, tk.tokenUniqueKey, "12005").Val())
+
+		// 旧版本实例登录时只更新 tokenUniqueKey，新版本登录时同样会被顶替
+		old := newSession(12005, "web", "")
+		old.TokenExpiredAt = old.CreatedAt.Add(time.Hour)
+		old.RefreshExpiredAt = old.CreatedAt.Add(time.Hour * 24)
+		require.NoError(t, client.HSet(ctx, tk.tokenDataKey, old.AccessToken, old).Err())
+		require.NoError(t, client.HSet(ctx, tk.refreshTokenKey, old.RefreshToken, old.AccessToken).Err())
+		require.NoError(t, client.HSet(ctx, tk.tokenUniqueKey, old.UserId, old.AccessToken).Err())
+
+		sessions, err = tk.Sessions(ctx, 12005)
+		require.NoError(t, err)
+		assert.Len(t, sessions, 2)
+
+		latest := newSession(12005, "app", "")
+		require.NoError(t, tk.Set(ctx, latest))
+		assertExpired(t, tk, newVal)
+		assertExpired(t, tk, old)
+		sessions, err = tk.Sessions(ctx, 12005)
+		require.NoError(t, err)
+		require.Len(t, sessions, 1)
+		assert.Equal(t, latest.AccessToken, sessions[0].AccessToken)
+	})
+
+	t.Run("concurrent logins respect max sessions", func(t *testing.T) {
+		tk := New(client, WithPrefix("test"), WithSessionScope(SessionScopeDevice), WithMaxSessions(2))
+
+		var wg sync.WaitGroup
+		// 每次冲突都意味着另一个登录成功，并发数不超过重试次数时不会返回 ErrSessionConflict
+		for i := range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, tk.Set(ctx, newSession(12006, "app", fmt.Sprintf("phone-%d", i))))
+			}()
+		}
+		wg.Wait()
+
+		sessions, err := tk.Sessions(ctx, 12006)
+		require.NoError(t, err)
+		assert.Len(t, sessions, 2)
+		assert.EqualValues(t, 2, client.HLen(ctx, tk.sessionsKey(12006)).Val())
+	})
+}
+
+func TestToken_Stateless(t *testing.T) {
+	client, mr := setupTestRedis(t)
+	defer mr.Close()
+	defer client.Close()
+
+	ctx := context.Background()
+	oldKey := NewHMACKey("k1", []byte("old-secret"))
+	newKey := NewHMACKey("k2", []byte("new-secret"))
+	tk := New(client, WithPrefix("test"), WithSigningKeys(oldKey), WithSessionScope(SessionScopePlatform))
+
+	val := NewValue(13001)
+	val.Platform = "web"
+	val.UserType = 2
+	require.NoError(t, val.Set("role", "admin"))
+	require.NoError(t, tk.Set(ctx, val))
+	assert.True(t, isSigned(val.AccessToken))
+	assert.NotEmpty(t, val.TokenId)
+
+	t.Run("get verifies locally", func(t *testing.T) {
+		// 同步撤销列表后不再访问 Redis
+		_, err := tk.Get(ctx, val.AccessToken)
+		require.NoError(t, err)
+		mr.SetError("server unavailable")
+		defer mr.SetError("")
+
+		got, err := tk.Get(ctx, val.AccessToken)
+		require.NoError(t, err)
+		assert.True(t, got.IsTokenValid("web"))
+		assert.Equal(t, int64(13001), got.UserId)
+		assert.Equal(t, int8(2), got.UserType)
+		assert.Equal(t, "platform:web", got.Session)
+		assert.Equal(t, "admin", got.Get("role").String())
+		assert.Equal(t, val.TokenExpiredAt.Unix(), got.TokenExpiredAt.Unix())
+	})
+
+	t.Run("invalid signature", func(t *testing.T) {
+		tampered := val.AccessToken[:len(val.AccessToken)-2] + "xx"
+		got, err := tk.Get(ctx, tampered)
+		require.NoError(t, err)
+		assert.False(t, got.IsTokenValid(""))
+
+		// 使用其他密钥签发的 token
+		other := New(client, WithPrefix("other"), WithSigningKeys(NewHMACKey("k1", []byte("another-secret"))))
+		otherVal := NewValue(13001)
+		require.NoError(t, other.Set(ctx, otherVal))
+		got, err = tk.Get(ctx, otherVal.AccessToken)
+		require.NoError(t, err)
+		assert.False(t, got.IsTokenValid(""))
+	})
+
+	t.Run("key rotation", func(t *testing.T) {
+		rotated := New(client, WithPrefix("test"), WithSigningKeys(newKey, oldKey))
+		got, err := rotated.Get(ctx, val.AccessToken)
+		require.NoError(t, err)
+		assert.True(t, got.IsTokenValid(""))
+
+		// 移除旧密钥后旧 token 失效
+		got, err = New(client, WithPrefix("test"), WithSigningKeys(newKey)).Get(ctx, val.AccessToken)
+		require.NoError(t, err)
+		assert.False(t, got.IsTokenValid(""))
+	})
+
+	t.Run("refresh revokes old token", func(t *testing.T) {
+		other := New(client, WithPrefix("test"), WithSigningKeys(oldKey), WithRevocationSync(time.Millisecond))
+		got, err := other.Get(ctx, val.AccessToken)
+		require.NoError(t, err)
+		assert.True(t, got.IsTokenValid(""))
+
+		newVal, err := tk.Refresh(ctx, val.RefreshToken)
+		require.NoError(t, err)
+		assert.True(t, isSigned(newVal.AccessToken))
+
+		got, err = tk.Get(ctx, val.AccessToken)
+		require.NoError(t, err)
+		assert.True(t, got.IsTokenExpired())
+		got, err = tk.Get(ctx, newVal.AccessToken)
+		require.NoError(t, err)
+		assert.True(t, got.IsTokenValid("web"))
+
+		// 其他实例在后台同步撤销列表后生效
+		assert.Eventually(t, func() bool {
+			got, err := other.Get(ctx, val.AccessToken)
+			return err == nil && got.IsTokenExpired()
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("revoke all sessions", func(t *testing.T) {
+		require.NoError(t, tk.RevokeAll(ctx, 13001))
+		sessions, err := tk.Sessions(ctx, 13001)
+		require.NoError(t, err)
+		assert.Empty(t, sessions)
+
+		members, err := client.ZCard(ctx, "test:token:revoked").Result()
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), members)
+	})
+
+	t.Run("refresh keeps token size bounded", func(t *testing.T) {
+		cur := NewValue(13004)
+		require.NoError(t, cur.Set("role", "admin"))
+		require.NoError(t, tk.Set(ctx, cur))
+		size := len(cur.AccessToken)
+
+		for range 12 {
+			next, err := tk.Refresh(ctx, cur.RefreshToken)
+			require.NoError(t, err)
+			// 旧 token 不写入 ext 声明，token 长度不随刷新次数增长
+			payload, err := b64.DecodeString(strings.Split(next.AccessToken, ".")[1])
+			require.NoError(t, err)
+			assert.NotContains(t, string(payload), cur.RefreshToken)
+			assert.NotContains(t, string(payload), next.RefreshToken)
+			assert.Less(t, len(next.AccessToken), size+128)
+			cur = next
+		}
+
+		got, err := tk.Get(ctx, cur.AccessToken)
+		require.NoError(t, err)
+		assert.Equal(t, "admin", got.Get("role").String())
+		assert.False(t, got.Get("old_access_token").Exists())
+	})
+
+	t.Run("ed25519", func(t *testing.T) {
+		pub, priv, err := ed25519.GenerateKey(nil)
+		require.NoError(t, err)
+		issuer := New(client, WithPrefix("ed"), WithSigningKeys(NewEd25519Key("ed1", priv)))
+		val := NewValue(13002)
+		require.NoError(t, issuer.Set(ctx, val))
+
+		// 只持有公钥的服务可以校验
+		verifier := New(client, WithPrefix("ed"), WithSigningKeys(NewEd25519VerifyKey("ed1", pub)))
+		got, err := verifier.Get(ctx, val.AccessToken)
+		require.NoError(t, err)
+		assert.True(t, got.IsTokenValid(""))
+		assert.Error(t, verifier.Set(ctx, NewValue(13003)))
+
+		// kid 相同但算法不同的 token 无效
+		hmacVal := NewValue(13002)
+		require.NoError(t, New(client, WithPrefix("ed"), WithSigningKeys(NewHMACKey("ed1", pub))).Set(ctx, hmacVal))
+		got, err = verifier.Get(ctx, hmacVal.AccessToken)
+		require.NoError(t, err)
+		assert.False(t, got.IsTokenValid(""))
+	})
+}
+
+func TestToken_RefreshReuse(t *testing.T) {
+	client, mr := setupTestRedis(t)
+	defer mr.Close()
+	defer client.Close()
+
+	ctx := context.Background()
+	var events []SecurityEvent
+	tk := New(client, WithPrefix("test"), WithSessionScope(SessionScopePlatform),
+		WithSecurityEventHandler(func(_ context.Context, event SecurityEvent) {
+			events = append(events, event)
+		}))
+
+	web := NewValue(14001)
+	web.Platform = "web"
+	app := NewValue(14001)
+	app.Platform = "app"
+	require.NoError(t, tk.Set(ctx, web))
+	require.NoError(t, tk.Set(ctx, app))
+	assert.NotEqual(t, web.FamilyId, app.FamilyId)
+
+	// 正常轮换两次，家族不变
+	rotated, err := tk.Refresh(ctx, web.RefreshToken)
+	require.NoError(t, err)
+	current, err := tk.Refresh(ctx, rotated.RefreshToken)
+	require.NoError(t, err)
+	assert.Equal(t, web.FamilyId, current.FamilyId)
+	assert.Empty(t, events)
+
+	// 重复使用已轮换的 refresh token，撤销整个家族
+	_, err = tk.Refresh(ctx, web.RefreshToken)
+	assert.True(t, errors.Is(err, ErrRefreshTokenReused))
+	assert.True(t, errors.Is(err, ErrRefreshTokenNotFound))
+	require.Len(t, events, 1)
+	assert.Equal(t, SecurityEventRefreshTokenReuse, events[0].Type)
+	assert.Equal(t, int64(14001), events[0].UserId)
+	assert.Equal(t, web.FamilyId, events[0].FamilyId)
+	assert.Equal(t, []string{"platform:web"}, events[0].Sessions)
+
+	got, err := tk.Get(ctx, current.AccessToken)
+	require.NoError(t, err)
+	assert.True(t, got.IsTokenExpired())
+	_, err = tk.Refresh(ctx, current.RefreshToken)
+	assert.True(t, errors.Is(err, ErrRefreshTokenNotFound))
+
+	// 其他家族不受影响
+	sessions, err := tk.Sessions(ctx, 14001)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, app.AccessToken, sessions[0].AccessToken)
+
+	t.Run("concurrent refresh", func(t *testing.T) {
+		val := NewValue(14002)
+		require.NoError(t, tk.Set(ctx, val))
+
+		results := make(chan error, 2)
+		for range 2 {
+			go func() {
+				_, err := tk.Refresh(ctx, val.RefreshToken)
+				results <- err
+			}()
+		}
+		succeeded := 0
+		for range 2 {
+			if err := <-results; err == nil {
+				succeeded++
+			} else {
+				assert.True(t, errors.Is(err, ErrRefreshTokenNotFound), err)
+			}
+		}
+		assert.Equal(t, 1, succeeded)
+	})
+
+	t.Run("claim records rotation", func(t *testing.T) {
+		val := NewValue(14003)
+		require.NoError(t, tk.Set(ctx, val))
+		_, err := tk.Refresh(ctx, val.RefreshToken)
+		require.NoError(t, err)
+		assert.False(t, client.HExists(ctx, tk.refreshTokenKey, val.RefreshToken).Val())
+		// 轮换记录保存到旧 refresh token 原本的过期时间
+		ttl := client.PTTL(ctx, tk.rotatedKey(val.RefreshToken)).Val()
+		assert.InDelta(t, time.Until(val.RefreshExpiredAt).Seconds(), ttl.Seconds(), 1)
+	})
+
+	t.Run("sign failure keeps refresh token", func(t *testing.T) {
+		pub, _, err := ed25519.GenerateKey(nil)
+		require.NoError(t, err)
+		val := NewValue(14004)
+		require.NoError(t, tk.Set(ctx, val))
+
+		// 只有公钥时无法签名，refresh token 不会被消耗
+		_, err = tk.Refresh(ctx, val.RefreshToken, WithSigningKeys(NewEd25519VerifyKey("ed1", pub)))
+		require.Error(t, err)
+		assert.False(t, errors.Is(err, ErrRefreshTokenNotFound))
+		assert.True(t, client.HExists(ctx, tk.refreshTokenKey, val.RefreshToken).Val())
+
+		_, err = tk.Refresh(ctx, val.RefreshToken)
+		require.NoError(t, err)
+	})
+}
+
+func TestRevocationList(t *testing.T) {
+	client, mr := setupTestRedis(t)
+	defer mr.Close()
+	defer client.Close()
+
+	ctx := context.Background()
+	expiredAt := time.Now().Add(time.Hour)
+	revoke := func(l *revocationList, jti string) {
+		_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			l.add(ctx, pipe, &Value{TokenId: jti, TokenExpiredAt: expiredAt})
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	// waitSynced 等待后台同步完成
+	waitSynced := func(l *revocationList) {
+		l.mu.RLock()
+		done := l.syncing
+		l.mu.RUnlock()
+		if done != nil {
+			<-done
+		}
+	}
+
+	t.Run("unavailable before first sync", func(t *testing.T) {
+		l := newRevocationList(client, "rv1", time.Second)
+		mr.SetError("server unavailable")
+		_, err := l.isRevoked(ctx, "a")
+		mr.SetError("")
+		assert.Error(t, err)
+
+		// 退避期间不再访问 Redis
+		_, err = l.isRevoked(ctx, "a")
+		assert.Error(t, err)
+		assert.Equal(t, 1, l.failures)
+	})
+
+	t.Run("incremental load", func(t *testing.T) {
+		l := newRevocationList(client, "rv2", time.Millisecond)
+		other := newRevocationList(client, "rv2", time.Millisecond)
+		revoked, err := l.isRevoked(ctx, "a")
+		require.NoError(t, err)
+		assert.False(t, revoked)
+
+		// 其他实例撤销的 jti 通过撤销日志增量加载，只写入撤销列表的 jti 不会再被加载
+		require.NoError(t, client.ZAdd(ctx, "rv2", redis.Z{Score: float64(expiredAt.UnixMilli()), Member: "b"}).Err())
+		revoke(other, "a")
+		assert.Eventually(t, func() bool {
+			revoked, err := l.isRevoked(ctx, "a")
+			return err == nil && revoked
+		}, time.Second, time.Millisecond)
+		revoked, err = l.isRevoked(ctx, "b")
+		require.NoError(t, err)
+		assert.False(t, revoked)
+	})
+
+	t.Run("serve last list on error", func(t *testing.T) {
+		l := newRevocationList(client, "rv3", time.Millisecond)
+		revoke(newRevocationList(client, "rv3", time.Millisecond), "a")
+		revoked, err := l.isRevoked(ctx, "a")
+		require.NoError(t, err)
+		assert.True(t, revoked)
+
+		mr.SetError("server unavailable")
+		defer mr.SetError("")
+		time.Sleep(time.Millisecond * 2)
+		revoked, err = l.isRevoked(ctx, "a")
+		require.NoError(t, err)
+		assert.True(t, revoked)
+		waitSynced(l)
+
+		l.mu.RLock()
+		defer l.mu.RUnlock()
+		assert.Equal(t, 1, l.failures)
+		assert.Error(t, l.err)
+	})
+}
@@ -18,8 +18,12 @@ type Value struct {
 	UserId           int64
 	UserType         int8
 	AccessToken      string
+	TokenId          string // 无状态 access token 的 jti，用于撤销
 	RefreshToken     string
 	Platform         string // 平台类型
+	DeviceId         string // 设备ID，会话范围为 SessionScopeDevice 时用于区分同一平台的不同设备
+	Session          string // 会话标识，由 Token.Set 根据会话范围生成，同一会话的新 token 会顶替旧 token
+	FamilyId         string // token 家族ID，登录时生成，刷新后的 token 沿用，用于检测 refresh token 重复使用
 	CreatedAt        time.Time
 	TokenExpiredAt   time.Time
 	RefreshExpiredAt time.Time
@@ -62,6 +66,9 @@ func (v *Value) Refresh() (newVal *Value) {
 	}
 	newVal = NewValue(v.UserId)
 	newVal.Platform = v.Platform
+	newVal.DeviceId = v.DeviceId
+	newVal.Session = v.Session
+	newVal.FamilyId = v.FamilyId
 	newVal.UserType = v.UserType
 	newVal.Extras = v.Extras
 	newVal.Set("refreshed_at", time.Now().Unix())